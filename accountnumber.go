@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// AccountNumberScheme generates account numbers and validates numbers
+// supplied by clients. Implementations must produce numbers that pass their
+// own Valid check.
+type AccountNumberScheme interface {
+	Generate() (int64, error)
+	Valid(int64) bool
+}
+
+// luhnAccountNumberScheme produces fixed-length numbers whose last digit is a
+// Luhn (mod 10) check digit, so single-digit typos and most transpositions
+// are rejected before they reach the database.
+type luhnAccountNumberScheme struct {
+	length int
+}
+
+func newLuhnAccountNumberScheme(length int) *luhnAccountNumberScheme {
+	return &luhnAccountNumberScheme{length: length}
+}
+
+func (l *luhnAccountNumberScheme) Generate() (int64, error) {
+	// The body is every digit except the check digit; its first digit is
+	// never zero so the number always has the full length.
+	lowest := pow10(l.length - 2)
+	span := big.NewInt(9 * lowest)
+	n, err := rand.Int(rand.Reader, span)
+	if err != nil {
+		return 0, err
+	}
+	body := lowest + n.Int64()
+
+	return body*10 + int64(luhnCheckDigit(body)), nil
+}
+
+func (l *luhnAccountNumberScheme) Valid(number int64) bool {
+	if number < pow10(l.length-1) || number >= pow10(l.length) {
+		return false
+	}
+	return luhnCheckDigit(number/10) == int(number%10)
+}
+
+// luhnCheckDigit returns the digit that makes body followed by it pass the
+// Luhn check.
+func luhnCheckDigit(body int64) int {
+	sum := 0
+	double := true
+	for ; body > 0; body /= 10 {
+		d := int(body % 10)
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestLuhnCheckDigit(t *testing.T) {
+	tests := []struct {
+		body int64
+		want int
+	}{
+		{7992739871, 3},
+		{1234567890, 3},
+		{12345678, 2},
+		{453914880343646, 7},
+		{1, 8},
+	}
+	for _, tt := range tests {
+		if got := luhnCheckDigit(tt.body); got != tt.want {
+			t.Errorf("luhnCheckDigit(%d) = %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestLuhnAccountNumberSchemeValid(t *testing.T) {
+	scheme := newLuhnAccountNumberScheme(11)
+	tests := []struct {
+		name   string
+		number int64
+		want   bool
+	}{
+		{"valid", 79927398713, true},
+		{"wrong check digit", 79927398710, false},
+		{"single digit typo", 79927308713, false},
+		{"adjacent transposition", 79927389713, false},
+		{"too short", 7992739871, false},
+		{"too long", 799273987135, false},
+		{"zero", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scheme.Valid(tt.number); got != tt.want {
+				t.Errorf("Valid(%d) = %v, want %v", tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLuhnAccountNumberSchemeGenerate(t *testing.T) {
+	scheme := newLuhnAccountNumberScheme(12)
+	for i := 0; i < 100; i++ {
+		number, err := scheme.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !scheme.Valid(number) {
+			t.Fatalf("Generate() = %d, which does not pass Valid", number)
+		}
+	}
+}
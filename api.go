@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
@@ -20,10 +21,21 @@ type APIError struct {
 	Message string `json:"message"`
 }
 
+// transferRequest pays Amount from the caller's account numbered
+// FromAccountID, or their oldest account if it is zero. Currency, if given,
+// must be that account's currency; Convert pays a destination account in
+// another currency at the rate of the caller's FX quote QuoteID.
 type transferRequest struct {
 	FromAccountID int64   `json:"from_account_id"`
 	ToAccountID   int64   `json:"to_account_id"`
+	ToIBAN        string  `json:"to_iban"`
 	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Convert       bool    `json:"convert"`
+	QuoteID       int     `json:"quote_id"`
+	// ExecuteOn (YYYY-MM-DD) schedules the transfer for a later date;
+	// empty or today executes it now.
+	ExecuteOn string `json:"execute_on"`
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
@@ -32,7 +44,31 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+// withRequestDeadline bounds every request by timeout. Storage calls run
+// under the request context, so queries still in flight when it expires,
+// or when the client disconnects, are cancelled and their transactions
+// rolled back.
+func withRequestDeadline(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// withBodyLimit rejects request bodies larger than limit bytes.
+func withBodyLimit(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *APIServer) withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get the Authorization header from the request
 		authHeader := r.Header.Get("Authorization")
@@ -48,12 +84,9 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		secret := os.Getenv("JWT_SECRET")
-
 		// Parse the JWT token
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			// TODO: Replace with your actual JWT secret or public key
-			return []byte(secret), nil
+			return []byte(s.config.JWT.Secret), nil
 		})
 		if err != nil {
 			writeAPIError(w, http.StatusUnauthorized, "Invalid token")
@@ -85,15 +118,61 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// withRole authenticates the request like withJWTAuth and additionally
+// requires the user to hold one of the given roles. Internal services
+// authenticated by client certificate are checked against their
+// configured role instead.
+func (s *APIServer) withRole(handlerFunc http.HandlerFunc, roles ...string) http.HandlerFunc {
+	userHandler := s.withJWTAuth(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id").(int)
+
+		user, err := s.storage.getUserById(r.Context(), userID)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		if user == nil {
+			writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in token")
+			return
+		}
+
+		for _, role := range roles {
+			if user.Role == role {
+				handlerFunc(w, r)
+				return
+			}
+		}
+		writeAPIError(w, http.StatusForbidden, "Insufficient permissions")
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		service, ok := serviceIdentityFromContext(r.Context())
+		if !ok {
+			userHandler(w, r)
+			return
+		}
+
+		for _, role := range roles {
+			if service.Role == role {
+				handlerFunc(w, r)
+				return
+			}
+		}
+		writeAPIError(w, http.StatusForbidden, "Insufficient permissions")
+	}
+}
+
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
 func (s *APIServer) makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			//handle the error
+			s.logger.Error("Handler failed",
+				"request_id", requestIDFromContext(r.Context()),
+				"path", r.URL.Path,
+				"error", err,
+			)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			// You can also log the error for debugging purposes
-			// log.Printf("Error: %v", err)
 		}
 	}
 }
@@ -104,30 +183,103 @@ func writeAPIError(w http.ResponseWriter, status int, message string) error {
 }
 
 type APIServer struct {
-	listenAddr string
-	router     *mux.Router
-	storage    Storage
+	listenAddr     string
+	router         *mux.Router
+	logger         *slog.Logger
+	storage        Storage
+	accountNumbers AccountNumberScheme
+	config         *Config
+	// certs serves the TLS certificate; nil when TLS is disabled.
+	certs      *certReloader
+	rateLimits RateLimitStore
+	calendar   *Calendar
+	// shuttingDown makes /readyz fail so that load balancers drain this
+	// instance before it stops accepting connections.
+	shuttingDown atomic.Bool
 }
 
-func newAPIServer(listenAddr string, store Storage) *APIServer {
+func newAPIServer(logger *slog.Logger, cfg *Config, store Storage, accountNumbers AccountNumberScheme, rateLimits RateLimitStore, calendar *Calendar) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		router:     mux.NewRouter(),
-		storage:    store,
+		listenAddr:     cfg.Server.Addr,
+		router:         mux.NewRouter(),
+		logger:         logger,
+		storage:        store,
+		accountNumbers: accountNumbers,
+		config:         cfg,
+		rateLimits:     rateLimits,
+		calendar:       calendar,
 	}
 }
 
 func (s *APIServer) setupRoutes() {
+	s.router.Use(withTracing, withRequestID, s.withClientIdentity, s.withAccessLog, withMetrics, withRequestDeadline(s.config.Server.RequestTimeout), withBodyLimit(s.config.Limits.MaxRequestBodyBytes), s.withDefaultRateLimit)
+
+	if s.config.Features.Metrics {
+		s.router.Handle("/metrics", metricsHandler()).Methods("GET")
+	}
+	s.router.HandleFunc("/healthz", s.makeHTTPHandleFunc(s.handleHealthz)).Methods("GET")
+	s.router.HandleFunc("/readyz", s.makeHTTPHandleFunc(s.handleReadyz)).Methods("GET")
+	s.router.HandleFunc("/calendar", s.makeHTTPHandleFunc(s.handleCalendar)).Methods("GET")
 	//s.router.HandleFunc("/", s.makeHTTPHandleFunc(s.handleAccount)).Methods("GET")
-	s.router.HandleFunc("/users/signup", s.makeHTTPHandleFunc(s.handleSignup)).Methods("POST")
-	s.router.HandleFunc("/users/login", s.makeHTTPHandleFunc(s.handleLogin)).Methods("POST")
+	s.router.HandleFunc("/users/signup", s.rateLimit("signup", s.config.RateLimit.Signup, s.makeHTTPHandleFunc(s.handleSignup))).Methods("POST")
+	s.router.HandleFunc("/users/login", s.rateLimit("login", s.config.RateLimit.Login, s.makeHTTPHandleFunc(s.handleLogin))).Methods("POST")
 	s.router.HandleFunc("/accounts", s.makeHTTPHandleFunc(s.handleAllAccounts)).Methods("GET")
-	s.router.HandleFunc("/user/details", withJWTAuth(s.makeHTTPHandleFunc(s.handleGetUserDetails))).Methods("GET")
-	s.router.HandleFunc("/accounts", withJWTAuth(s.makeHTTPHandleFunc(s.handleCreateAccount))).Methods("POST")
-	s.router.HandleFunc("/accounts/{id}", s.makeHTTPHandleFunc(s.handleDeleteAccount)).Methods("DELETE")
+	s.router.HandleFunc("/user/details", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleGetUserDetails))).Methods("GET")
+	s.router.HandleFunc("/accounts", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCreateAccount))).Methods("POST")
+	s.router.HandleFunc("/accounts/{id}", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCloseAccount))).Methods("DELETE")
+	s.router.HandleFunc("/accounts/{id}/close", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCloseAccount))).Methods("POST")
+	s.router.HandleFunc("/accounts/{id}/status", s.withRole(s.makeHTTPHandleFunc(s.handleChangeAccountStatus), RoleOperator)).Methods("POST")
+	s.router.HandleFunc("/accounts/{id}/status/history", s.withRole(s.makeHTTPHandleFunc(s.handleAccountStatusHistory), RoleOperator)).Methods("GET")
+	s.router.HandleFunc("/accounts/{id}/limits", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleTransferLimits))).Methods("GET")
+	s.router.HandleFunc("/accounts/{id}/holds", s.withRole(s.makeHTTPHandleFunc(s.handlePlaceHold), RoleOperator)).Methods("POST")
+	s.router.HandleFunc("/accounts/{id}/holds", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListHolds))).Methods("GET")
+	s.router.HandleFunc("/holds/{id}/capture", s.withRole(s.makeHTTPHandleFunc(s.handleCaptureHold), RoleOperator)).Methods("POST")
+	s.router.HandleFunc("/holds/{id}/release", s.withRole(s.makeHTTPHandleFunc(s.handleReleaseHold), RoleOperator)).Methods("POST")
+	s.router.HandleFunc("/accounts/{id}/interest", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleAccountInterest))).Methods("GET")
+	s.router.HandleFunc("/accounts/{id}/fees", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListFees))).Methods("GET")
+	s.router.HandleFunc("/fees/{id}/waive", s.withRole(s.makeHTTPHandleFunc(s.handleWaiveFee), RoleOperator)).Methods("POST")
+	s.router.HandleFunc("/fee-rules", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListFeeRules))).Methods("GET")
+	s.router.HandleFunc("/fx/rates", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListFXRates))).Methods("GET")
+	s.router.HandleFunc("/fx/quotes", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCreateFXQuote))).Methods("POST")
+	s.router.HandleFunc("/interest-products", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListInterestProducts))).Methods("GET")
+	s.router.HandleFunc("/accounts/{id}/statement", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleAccountStatement))).Methods("GET")
+	s.router.HandleFunc("/admin/users/{id}", s.withRole(s.makeHTTPHandleFunc(s.handleDeleteUser), RoleAdmin)).Methods("DELETE")
+	s.router.HandleFunc("/admin/accounts/{id}", s.withRole(s.makeHTTPHandleFunc(s.handleSoftDeleteAccount), RoleAdmin)).Methods("DELETE")
+	s.router.HandleFunc("/admin/users/{id}/transfer-limits", s.withRole(s.makeHTTPHandleFunc(s.handleGetTransferLimitOverride), RoleAdmin)).Methods("GET")
+	s.router.HandleFunc("/admin/users/{id}/transfer-limits", s.withRole(s.makeHTTPHandleFunc(s.handleSetTransferLimitOverride), RoleAdmin)).Methods("PUT")
+	s.router.HandleFunc("/admin/users/{id}/transfer-limits", s.withRole(s.makeHTTPHandleFunc(s.handleDeleteTransferLimitOverride), RoleAdmin)).Methods("DELETE")
+	s.router.HandleFunc("/admin/accounts/{id}/overdraft", s.withRole(s.makeHTTPHandleFunc(s.handleSetOverdraft), RoleAdmin)).Methods("PUT")
+	s.router.HandleFunc("/admin/accounts/{id}/interest-product", s.withRole(s.makeHTTPHandleFunc(s.handleSetInterestProduct), RoleAdmin)).Methods("PUT")
+	s.router.HandleFunc("/admin/interest-products", s.withRole(s.makeHTTPHandleFunc(s.handleCreateInterestProduct), RoleAdmin)).Methods("POST")
+	s.router.HandleFunc("/admin/interest/run", s.withRole(s.makeHTTPHandleFunc(s.handleRunInterest), RoleAdmin)).Methods("POST")
+	s.router.HandleFunc("/admin/fee-rules/{account_type}/{event}", s.withRole(s.makeHTTPHandleFunc(s.handleSetFeeRule), RoleAdmin)).Methods("PUT")
+	s.router.HandleFunc("/admin/fee-rules/{account_type}/{event}", s.withRole(s.makeHTTPHandleFunc(s.handleDeleteFeeRule), RoleAdmin)).Methods("DELETE")
+	s.router.HandleFunc("/admin/fx/rates/{base}/{quote}", s.withRole(s.makeHTTPHandleFunc(s.handleSetFXRate), RoleAdmin)).Methods("PUT")
+	s.router.HandleFunc("/admin/deleted", s.withRole(s.makeHTTPHandleFunc(s.handleListDeleted), RoleAdmin)).Methods("GET")
+	s.router.HandleFunc("/admin/users/{id}/restore", s.withRole(s.makeHTTPHandleFunc(s.handleRestoreUser), RoleAdmin)).Methods("POST")
+	s.router.HandleFunc("/audit", s.withRole(s.makeHTTPHandleFunc(s.handleQueryAudit), RoleAuditor)).Methods("GET")
+	s.router.HandleFunc("/audit/verify", s.withRole(s.makeHTTPHandleFunc(s.handleVerifyAudit), RoleAuditor)).Methods("GET")
+	s.router.HandleFunc("/admin/accounts/{id}/restore", s.withRole(s.makeHTTPHandleFunc(s.handleRestoreAccount), RoleAdmin)).Methods("POST")
 	s.router.HandleFunc("/accounts/{id}", s.makeHTTPHandleFunc(s.handleAccountById)).Methods("GET")
-	s.router.HandleFunc("/accounts/{id}", s.makeHTTPHandleFunc(s.handleUpdateAccount)).Methods("PATCH")
-	s.router.HandleFunc("/accounts/transfer", withJWTAuth(s.makeHTTPHandleFunc(s.handleAccountTransfer))).Methods("POST")
+	s.router.HandleFunc("/accounts/iban/{iban}", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleAccountByIBAN))).Methods("GET")
+	s.router.HandleFunc("/accounts/{id}", s.withRole(s.makeHTTPHandleFunc(s.handleUpdateAccount), RoleAdmin)).Methods("PATCH")
+	s.router.HandleFunc("/accounts/transfer", s.withJWTAuth(s.rateLimit("transfer", s.config.RateLimit.Transfer, s.makeHTTPHandleFunc(s.handleAccountTransfer)))).Methods("POST")
+	s.router.HandleFunc("/transfers", s.withJWTAuth(s.rateLimit("transfer", s.config.RateLimit.Transfer, s.makeHTTPHandleFunc(s.handleAccountTransfer)))).Methods("POST")
+	s.router.HandleFunc("/transfers/scheduled", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListScheduledTransfers))).Methods("GET")
+	s.router.HandleFunc("/transfers/scheduled/{id}", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCancelScheduledTransfer))).Methods("DELETE")
+	s.router.HandleFunc("/standing-orders", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCreateStandingOrder))).Methods("POST")
+	s.router.HandleFunc("/standing-orders", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListStandingOrders))).Methods("GET")
+	s.router.HandleFunc("/standing-orders/{id}/history", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleStandingOrderHistory))).Methods("GET")
+	s.router.HandleFunc("/standing-orders/{id}/pause", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleStandingOrderAction(StandingOrderPause)))).Methods("POST")
+	s.router.HandleFunc("/standing-orders/{id}/resume", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleStandingOrderAction(StandingOrderResume)))).Methods("POST")
+	s.router.HandleFunc("/standing-orders/{id}/skip", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleStandingOrderAction(StandingOrderSkip)))).Methods("POST")
+	s.router.HandleFunc("/standing-orders/{id}", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleStandingOrderAction(StandingOrderCancel)))).Methods("DELETE")
+	s.router.HandleFunc("/notifications", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleListNotifications))).Methods("GET")
+	s.router.HandleFunc("/notifications/{id}/read", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleReadNotification))).Methods("POST")
+	s.router.HandleFunc("/profile", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleCreateProfile))).Methods("POST")
+	s.router.HandleFunc("/profile", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleGetProfile))).Methods("GET")
+	s.router.HandleFunc("/profile", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleUpdateProfile))).Methods("PATCH")
+	s.router.HandleFunc("/profile/history", s.withJWTAuth(s.makeHTTPHandleFunc(s.handleProfileHistory))).Methods("GET")
 }
 
 // func (s *APIServer) run() {
@@ -195,36 +347,75 @@ func (s *APIServer) setupRoutes() {
 // 	wg.Wait()
 // }
 
-func (s *APIServer) run() {
+// run serves HTTP until ctx is cancelled, then stops accepting connections,
+// flips readiness to failing and waits up to ShutdownTimeout for in-flight
+// requests to finish. Requests still running at the deadline have their
+// contexts cancelled and their connections closed.
+func (s *APIServer) run(ctx context.Context) error {
 	s.setupRoutes()
 
-	// Create a channel to collect responses from Goroutines
-	responseChan := make(chan error, 1)
-
-	// Use a WaitGroup to wait for Goroutines to finish
-	var wg sync.WaitGroup
-
-	// Start a Goroutine to handle incoming requests
-	go func() {
-		defer close(responseChan)
+	// Handler contexts derive from baseCtx, which outlives ctx so that a
+	// shutdown signal alone does not abort requests that are draining.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           s.router,
+		ReadTimeout:       s.config.Server.ReadTimeout,
+		ReadHeaderTimeout: s.config.Server.ReadHeaderTimeout,
+		WriteTimeout:      s.config.Server.WriteTimeout,
+		IdleTimeout:       s.config.Server.IdleTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ErrorLog:          slog.NewLogLogger(s.logger.Handler(), slog.LevelWarn),
+	}
 
-		fmt.Printf("Server listening on %s...\n", s.listenAddr)
-		err := http.ListenAndServe(s.listenAddr, s.router)
-		responseChan <- err
-	}()
+	if tlsCfg := s.config.Server.TLS; tlsCfg.Enabled {
+		certs, err := newCertReloader(s.logger, tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig, err = newServerTLSConfig(tlsCfg, certs)
+		if err != nil {
+			return err
+		}
+		s.certs = certs
+		go certs.watch(ctx, tlsCfg.ReloadInterval)
+	}
 
-	// Wait for the server to finish
-	wg.Add(1)
+	serveErr := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		err := <-responseChan
-		if err != nil {
-			log.Fatalf("HTTP server error: %v", err)
+		if s.certs != nil {
+			s.logger.Info("Server listening", "addr", s.listenAddr, "tls", true, "client_ca", s.config.Server.TLS.ClientCAFile != "")
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
 		}
+		s.logger.Info("Server listening", "addr", s.listenAddr)
+		serveErr <- srv.ListenAndServe()
 	}()
 
-	// Wait for the server and all Goroutines to finish
-	wg.Wait()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.logger.Info("Shutting down", "timeout", s.config.Server.ShutdownTimeout)
+	s.markShuttingDown()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		s.logger.Warn("Shutdown deadline exceeded, cancelling in-flight requests", "error", err)
+		cancelRequests()
+		srv.Close()
+	}
+
+	if err := <-serveErr; err != http.ErrServerClosed {
+		return err
+	}
+	s.logger.Info("Server stopped")
+	return nil
 }
 
 // func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
@@ -245,7 +436,7 @@ func (s *APIServer) run() {
 
 func (s *APIServer) handleAllAccounts(w http.ResponseWriter, r *http.Request) error {
 	batchSize := 10000
-	accounts, err := s.storage.allAccounts(batchSize)
+	accounts, err := s.storageFor(r).allAccounts(r.Context(), batchSize)
 
 	if err != nil {
 		return err
@@ -273,13 +464,60 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
 	}
 
-	account := newAccount(createAccountReq.FIRST_NAME, createAccountReq.LAST_NAME, createAccountReq.HOBBY, createAccountReq.AGE, createAccountReq.BALANCE, userID)
+	// Accounts reference the customer's profile, so one must exist first
+	profile, err := s.storageFor(r).getProfileByUserId(r.Context(), userID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return writeAPIError(w, http.StatusBadRequest, "Create a customer profile before opening an account")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	switch createAccountReq.Type {
+	case "":
+		createAccountReq.Type = AccountTypePersonal
+	case AccountTypePersonal, AccountTypeBusiness, AccountTypeSavings:
+	default:
+		return writeAPIError(w, http.StatusBadRequest, "account_type must be personal, business or savings")
+	}
+
+	if createAccountReq.Currency == "" {
+		createAccountReq.Currency = s.config.Currency.Default
+	}
+	if !isCurrency(createAccountReq.Currency) {
+		return writeAPIError(w, http.StatusBadRequest, "currency must be a supported ISO 4217 code")
+	}
+	if _, ok := s.config.Currency.amountScale(createAccountReq.Currency); !ok {
+		return writeAPIError(w, http.StatusUnprocessableEntity, "Accounts are not offered in "+createAccountReq.Currency)
+	}
+	if createAccountReq.BALANCE < 0 {
+		return writeAPIError(w, http.StatusBadRequest, "balance cannot be negative")
+	}
+	if !validAmount(createAccountReq.BALANCE, createAccountReq.Currency) {
+		return writeAPIError(w, http.StatusBadRequest, "balance has more decimal places than "+createAccountReq.Currency+" allows")
+	}
+
+	// An opening balance is posted as a deposit with no funding source, so
+	// only admins may set one; customers open at zero and pay in
+	if createAccountReq.BALANCE != 0 {
+		user, err := s.storageFor(r).getUserById(r.Context(), userID)
+		if err != nil {
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		if user == nil || user.Role != RoleAdmin {
+			return writeAPIError(w, http.StatusForbidden, "Only admins may open an account with a balance")
+		}
+	}
+
+	account := newAccount(createAccountReq.BALANCE, userID, profile.ID)
+	account.Type = createAccountReq.Type
+	account.Currency = createAccountReq.Currency
 
 	// Attempt to create the account
-	if err := s.storage.createAccount(account); err != nil {
+	if err := s.storageFor(r).createAccount(r.Context(), account); err != nil {
 		// Check the specific error to determine the error response
-		if strings.Contains(err.Error(), "user ID already exists") {
-			return writeAPIError(w, http.StatusConflict, "An account with the same user ID already exists")
+		if strings.Contains(err.Error(), "user already has an account in this currency") {
+			return writeAPIError(w, http.StatusConflict, "You already have an account in "+account.Currency)
 		}
 		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
 	}
@@ -287,7 +525,7 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 	return writeJSON(w, http.StatusCreated, account)
 }
 
-func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+func (s *APIServer) handleAccountById(w http.ResponseWriter, r *http.Request) error {
 	// Extract the account ID from the request URL
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -297,48 +535,74 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 		return nil
 	}
 
-	// Call the storage method to delete the account by ID
-	err = s.storage.deleteAccount(id)
+	// Call the storage method to get the account by ID
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
 	if err != nil {
-		// Check if the error is "account not found"
 		if err.Error() == "account not found" {
 			writeAPIError(w, http.StatusNotFound, "Account not found")
 			return nil
 		}
-
-		// Handle other errors
 		writeAPIError(w, http.StatusInternalServerError, "Internal server error")
 		return nil
 	}
 
-	// Respond with success status
-	return writeJSON(w, http.StatusOK, map[string]string{"message": "Account deleted successfully"})
+	return writeJSON(w, http.StatusOK, account)
 }
 
-func (s *APIServer) handleAccountById(w http.ResponseWriter, r *http.Request) error {
-	// Extract the account ID from the request URL
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.Atoi(idStr)
+// ownAccount loads the account named in the URL if it belongs to the
+// caller, writing the error response otherwise.
+func (s *APIServer) ownAccount(w http.ResponseWriter, r *http.Request) (*Account, error) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return nil, writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
-		return nil
+		return nil, writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
 	}
 
-	// Call the storage method to get the account by ID
-	account, err := s.storage.getAccountById(id)
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
 	if err != nil {
 		if err.Error() == "account not found" {
-			writeAPIError(w, http.StatusNotFound, "Account not found")
-			return nil
+			return nil, writeAPIError(w, http.StatusNotFound, "Account not found")
 		}
-		writeAPIError(w, http.StatusInternalServerError, "Internal server error")
-		return nil
+		return nil, writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if account.UserID != userID {
+		return nil, writeAPIError(w, http.StatusNotFound, "Account not found")
+	}
+	return account, nil
+}
+
+// handleAccountByIBAN shows the owner their whole account; other callers
+// only see the fields needed to confirm a payee.
+func (s *APIServer) handleAccountByIBAN(w http.ResponseWriter, r *http.Request) error {
+	iban, err := parseIBAN(mux.Vars(r)["iban"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid IBAN")
 	}
 
+	account, err := s.storageFor(r).getAccountByIBAN(r.Context(), iban.String())
+	if err != nil {
+		if err.Error() == "account not found" {
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	if userID, _ := r.Context().Value("user_id").(int); account.UserID != userID {
+		return writeJSON(w, http.StatusOK, payeeAccount{
+			IBAN:     account.IBAN,
+			Currency: account.Currency,
+			Status:   account.Status,
+		})
+	}
 	return writeJSON(w, http.StatusOK, account)
 }
 
+// handleUpdateAccount lets an admin correct an account's balance. The
+// difference is posted to the ledger as an adjustment.
 func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -349,7 +613,7 @@ func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Call the storage method to get the existing account by ID
-	existingAccount, err := s.storage.getAccountById(id)
+	existingAccount, err := s.storageFor(r).getAccountById(r.Context(), id)
 	if err != nil {
 		if err.Error() == "account not found" {
 			writeAPIError(w, http.StatusNotFound, "Account not found")
@@ -359,6 +623,10 @@ func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request)
 		return nil
 	}
 
+	if existingAccount.Status == AccountClosed {
+		return writeAPIError(w, http.StatusConflict, "Account is closed")
+	}
+
 	// Decode the updated account details from the request body
 	updatedAccount := &Account{}
 	if err := json.NewDecoder(r.Body).Decode(updatedAccount); err != nil {
@@ -366,27 +634,27 @@ func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request)
 		return nil
 	}
 
-	// Update the existing account with the new data if provided
-	if updatedAccount.FIRST_NAME != "" {
-		existingAccount.FIRST_NAME = updatedAccount.FIRST_NAME
-	}
-	if updatedAccount.LAST_NAME != "" {
-		existingAccount.LAST_NAME = updatedAccount.LAST_NAME
-	}
-	if updatedAccount.HOBBY != "" {
-		existingAccount.HOBBY = updatedAccount.HOBBY
-	}
-	if updatedAccount.AGE != 0 {
-		existingAccount.AGE = updatedAccount.AGE
-	}
-
+	// Update the existing account with the new data if provided. Personal
+	// details are managed through the customer profile endpoints.
 	if updatedAccount.BALANCE != 0 {
 		existingAccount.BALANCE = updatedAccount.BALANCE
 	}
 
 	// Call the storage method to update the account
-	err = s.storage.updateAccount(existingAccount)
+	err = s.storageFor(r).updateAccount(r.Context(), existingAccount)
 	if err != nil {
+		switch err.Error() {
+		case "account not found":
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		case "amount is not valid in the account currency":
+			return writeAPIError(w, http.StatusBadRequest, "Balance has more decimal places than "+existingAccount.Currency+" allows")
+		case "source account cannot be debited":
+			return writeAPIError(w, http.StatusConflict, "The account is not active for debits")
+		case "destination account cannot be credited":
+			return writeAPIError(w, http.StatusConflict, "The account cannot be credited")
+		case "insufficient balance in the account":
+			return writeAPIError(w, http.StatusConflict, "The balance would fall below the account's held funds and overdraft limit")
+		}
 		writeAPIError(w, http.StatusInternalServerError, "Internal server error")
 		return nil
 	}
@@ -403,7 +671,7 @@ func (s *APIServer) handleGetUserDetails(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Call the storage method to retrieve user details
-	userDetails, err := s.storage.getUserDetails(userID)
+	userDetails, err := s.storageFor(r).getUserDetails(r.Context(), userID)
 	if err != nil {
 		// Handle the error, for example, return a 404 Not Found response
 		if err.Error() == "user not found" {
@@ -416,6 +684,23 @@ func (s *APIServer) handleGetUserDetails(w http.ResponseWriter, r *http.Request)
 	return writeJSON(w, http.StatusOK, userDetails)
 }
 
+// knownAccountNumber reports whether number can be paid: it either passes
+// the account number check or, being from before check digits were
+// issued, belongs to an existing account.
+func (s *APIServer) knownAccountNumber(r *http.Request, number int64) (bool, error) {
+	if s.accountNumbers.Valid(number) {
+		return true, nil
+	}
+	_, err := s.storageFor(r).getAccountByNumber(r.Context(), number)
+	if err != nil {
+		if err.Error() == "account not found" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (s *APIServer) handleAccountTransfer(w http.ResponseWriter, r *http.Request) error {
 	// Decode the transfer request details from the request body
 
@@ -424,19 +709,18 @@ func (s *APIServer) handleAccountTransfer(w http.ResponseWriter, r *http.Request
 	if !ok {
 		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
 	}
-	fmt.Println(userID)
 
 	// Fetch the user's account details using getUserDetails
-	user, err := s.storage.getUserDetails(userID)
+	user, err := s.storageFor(r).getUserDetails(r.Context(), userID)
 	if err != nil {
 		writeAPIError(w, http.StatusInternalServerError, "Error fetching user details")
 		return nil
 	}
-	// Now you have the user's account information, including the "from" account
-	fromAccount := user.Accounts[0] // Assuming the first account in the slice is the "from" account
-	fromAccountNumber := fromAccount.ACCOUNT
-	// Decode the transfer request details from the request body
+	if len(user.Accounts) == 0 {
+		return writeAPIError(w, http.StatusBadRequest, "You have no account to transfer from")
+	}
 
+	// Decode the transfer request details from the request body
 	var transferReq transferRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&transferReq); err != nil {
@@ -444,8 +728,74 @@ func (s *APIServer) handleAccountTransfer(w http.ResponseWriter, r *http.Request
 		return nil
 	}
 
+	fromAccount, ok := user.sourceAccount(transferReq.FromAccountID)
+	if !ok {
+		return writeAPIError(w, http.StatusBadRequest, "from_account_id is not one of your accounts")
+	}
+	fromAccountNumber := fromAccount.ACCOUNT
+
+	// An IBAN destination takes precedence over a bare account number
+	if transferReq.ToIBAN != "" {
+		iban, err := parseIBAN(transferReq.ToIBAN)
+		if err != nil {
+			return writeAPIError(w, http.StatusBadRequest, "Invalid destination IBAN")
+		}
+		toAccount, err := s.storageFor(r).getAccountByIBAN(r.Context(), iban.String())
+		if err != nil {
+			if err.Error() == "account not found" {
+				return writeAPIError(w, http.StatusNotFound, "One or both accounts not found")
+			}
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		transferReq.ToAccountID = toAccount.ACCOUNT
+	}
+
+	// Reject mistyped destination numbers before attempting the transfer
+	known, err := s.knownAccountNumber(r, transferReq.ToAccountID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if !known {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid destination account number")
+	}
+	if transferReq.Amount <= 0 {
+		return writeAPIError(w, http.StatusBadRequest, "Amount must be positive")
+	}
+	if transferReq.Currency == "" {
+		transferReq.Currency = fromAccount.Currency
+	}
+	if transferReq.Currency != fromAccount.Currency {
+		return writeAPIError(w, http.StatusUnprocessableEntity, "currency must be the currency of the account you pay from, "+fromAccount.Currency)
+	}
+	if !validAmount(transferReq.Amount, transferReq.Currency) {
+		return writeAPIError(w, http.StatusBadRequest, "Amount has more decimal places than "+transferReq.Currency+" allows")
+	}
+	if transferReq.Convert && transferReq.QuoteID == 0 {
+		return writeAPIError(w, http.StatusBadRequest, "quote_id is required to convert; request a quote from /fx/quotes")
+	}
+
+	if transferReq.ExecuteOn != "" {
+		executeOn, err := time.Parse(executeOnLayout, transferReq.ExecuteOn)
+		if err != nil {
+			return writeAPIError(w, http.StatusBadRequest, "execute_on must be a date in YYYY-MM-DD format")
+		}
+		if executeOn.Before(s.calendar.today()) {
+			return writeAPIError(w, http.StatusBadRequest, "execute_on must not be in the past")
+		}
+		if executeOn.After(s.calendar.today()) {
+			if transferReq.Convert {
+				return writeAPIError(w, http.StatusUnprocessableEntity, "Converted transfers cannot be scheduled")
+			}
+			return s.scheduleTransfer(w, r, userID, fromAccountNumber, transferReq, executeOn)
+		}
+	}
+
 	// Call the storage method to perform the balance transfer
-	err = s.storage.transferBalance(fromAccountNumber, transferReq.ToAccountID, transferReq.Amount)
+	if transferReq.Convert {
+		err = s.storageFor(r).convertBalance(r.Context(), fromAccountNumber, transferReq.ToAccountID, transferReq.Amount, transferReq.QuoteID)
+	} else {
+		err = s.storageFor(r).transferBalance(r.Context(), fromAccountNumber, transferReq.ToAccountID, transferReq.Amount)
+	}
 	if err != nil {
 		// Handle different error scenarios
 		if err.Error() == "insufficient balance in the account" {
@@ -456,6 +806,41 @@ func (s *APIServer) handleAccountTransfer(w http.ResponseWriter, r *http.Request
 			writeAPIError(w, http.StatusNotFound, "One or both accounts not found")
 			return nil
 		}
+		if err.Error() == "cannot transfer to the same account" {
+			return writeAPIError(w, http.StatusBadRequest, "Cannot transfer to the same account")
+		}
+		if err.Error() == "source account cannot be debited" {
+			return writeAPIError(w, http.StatusConflict, "Your account is not active for outgoing transfers")
+		}
+		if err.Error() == "destination account cannot be credited" {
+			return writeAPIError(w, http.StatusConflict, "The destination account cannot receive transfers")
+		}
+		if err.Error() == "accounts are in different currencies" {
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The destination account is in a different currency; set convert and quote_id to pay it")
+		}
+		switch err.Error() {
+		case "fx quote not found":
+			return writeAPIError(w, http.StatusNotFound, "Quote not found")
+		case "fx quote already used":
+			return writeAPIError(w, http.StatusConflict, "The quote has already been used")
+		case "fx quote has expired":
+			return writeAPIError(w, http.StatusConflict, "The quote has expired; request a new one")
+		case "fx quote does not match the transfer":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The quote is for a different amount or pair of currencies")
+		case "no transfer limits for this currency":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "Transfers are not available in this account's currency")
+		case "transfer exceeds the single transaction limit":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The amount exceeds your single transfer limit")
+		case "daily transfer count exceeded":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "You have reached the maximum number of transfers for today")
+		case "transfer exceeds the daily limit":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The amount exceeds your remaining daily transfer limit")
+		case "transfer exceeds the monthly limit":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The amount exceeds your remaining monthly transfer limit")
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			return writeAPIError(w, http.StatusGatewayTimeout, "The transfer timed out and was not applied")
+		}
 		writeAPIError(w, http.StatusInternalServerError, "Internal server error")
 		return nil
 	}
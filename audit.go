@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RoleAuditor = "auditor"
+
+// AuditEvent is one entry of the append-only audit log. Each entry stores
+// the hash of its predecessor, and its own hash covers every field plus that
+// previous hash, so editing or removing any row breaks the chain from that
+// point on.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type"`
+	TargetID   string          `json:"target_id"`
+	Before     json.RawMessage `json:"before"`
+	After      json.RawMessage `json:"after"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"request_id"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// computeHash returns the chain hash of the event given its PrevHash.
+func (e *AuditEvent) computeHash() string {
+	h := sha256.New()
+	for _, field := range []string{
+		e.PrevHash,
+		e.OccurredAt.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Action,
+		e.TargetType,
+		e.TargetID,
+		string(e.Before),
+		string(e.After),
+		e.IP,
+		e.RequestID,
+	} {
+		// Length-prefix every field so that shifting bytes between
+		// neighbouring fields changes the hash
+		fmt.Fprintf(h, "%d:%s|", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Limit      int
+}
+
+type AuditVerification struct {
+	Valid          bool   `json:"valid"`
+	EntriesChecked int64  `json:"entries_checked"`
+	FirstBrokenID  int64  `json:"first_broken_id,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// auditMeta identifies who performed a mutation and from where.
+type auditMeta struct {
+	Actor     string
+	IP        string
+	RequestID string
+}
+
+// auditMetaFromRequest records the same client address the rate limiter
+// uses, so a request behind a trusted proxy is not logged as the proxy's.
+func (s *APIServer) auditMetaFromRequest(r *http.Request) auditMeta {
+	meta := auditMeta{Actor: "anonymous", IP: s.clientIP(r), RequestID: requestIDFromContext(r.Context())}
+	if actor, ok := actorFromRequest(r); ok {
+		meta.Actor = actor
+	}
+	return meta
+}
+
+// auditedStorage wraps a Storage and appends an audit event after every
+// successful mutating call. Reads pass straight through.
+type auditedStorage struct {
+	Storage
+	logger *slog.Logger
+	meta   auditMeta
+}
+
+func newAuditedStorage(store Storage, logger *slog.Logger, meta auditMeta) *auditedStorage {
+	return &auditedStorage{Storage: store, logger: logger, meta: meta}
+}
+
+// storageFor returns the storage handlers should use for r: calls are
+// traced and mutations are attributed to the authenticated user.
+func (s *APIServer) storageFor(r *http.Request) Storage {
+	return newAuditedStorage(newTracedStorage(s.storage), s.logger, s.auditMetaFromRequest(r))
+}
+
+// auditWriteAttempts bounds how often record tries to append an event
+// before giving up on it.
+const auditWriteAttempts = 3
+
+// record appends the audit event for a mutation that has already been
+// committed. It ignores cancellation of ctx so that a client hanging up
+// cannot leave a committed change unaudited, and retries briefly. If the
+// event still cannot be written it is logged in full, so that it can be
+// replayed, and gobank_audit_write_failures_total is raised for alerting.
+func (a *auditedStorage) record(ctx context.Context, action, targetType, targetID string, before, after interface{}) error {
+	event := &AuditEvent{
+		Actor:      a.meta.Actor,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IP:         a.meta.IP,
+		RequestID:  a.meta.RequestID,
+	}
+
+	var err error
+	if event.Before, err = json.Marshal(before); err != nil {
+		return err
+	}
+	if event.After, err = json.Marshal(after); err != nil {
+		return err
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	for attempt := 1; ; attempt++ {
+		err = a.Storage.appendAudit(ctx, event)
+		if err == nil {
+			return nil
+		}
+		if attempt == auditWriteAttempts {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+
+	auditWriteFailures.Inc()
+	a.logger.Error("Committed change left unaudited",
+		"actor", event.Actor,
+		"action", action,
+		"target_type", targetType,
+		"target_id", targetID,
+		"before", string(event.Before),
+		"after", string(event.After),
+		"ip", event.IP,
+		"request_id", a.meta.RequestID,
+		"error", err,
+	)
+	return err
+}
+
+func (a *auditedStorage) createAccount(ctx context.Context, account *Account) error {
+	if err := a.Storage.createAccount(ctx, account); err != nil {
+		return err
+	}
+	return a.record(ctx, "account.create", "account", strconv.Itoa(account.ID), nil, account)
+}
+
+func (a *auditedStorage) updateAccount(ctx context.Context, account *Account) error {
+	before, _ := a.Storage.getAccountById(ctx, account.ID)
+	if err := a.Storage.updateAccount(ctx, account); err != nil {
+		return err
+	}
+	return a.record(ctx, "account.update", "account", strconv.Itoa(account.ID), before, account)
+}
+
+func (a *auditedStorage) transferBalance(ctx context.Context, from, to int64, amount float64) error {
+	if err := a.Storage.transferBalance(ctx, from, to, amount); err != nil {
+		return err
+	}
+	after := map[string]interface{}{"from": from, "to": to, "amount": amount}
+	return a.record(ctx, "transfer.create", "transfer", fmt.Sprintf("%d->%d", from, to), nil, after)
+}
+
+func (a *auditedStorage) convertBalance(ctx context.Context, from, to int64, amount float64, quoteID int) error {
+	if err := a.Storage.convertBalance(ctx, from, to, amount, quoteID); err != nil {
+		return err
+	}
+	after := map[string]interface{}{"from": from, "to": to, "amount": amount, "quote_id": quoteID}
+	return a.record(ctx, "transfer.create", "transfer", fmt.Sprintf("%d->%d", from, to), nil, after)
+}
+
+func (a *auditedStorage) createUser(ctx context.Context, user *User) error {
+	if err := a.Storage.createUser(ctx, user); err != nil {
+		return err
+	}
+	return a.record(ctx, "user.create", "user", strconv.Itoa(user.ID), nil, user)
+}
+
+func (a *auditedStorage) createProfile(ctx context.Context, profile *CustomerProfile) error {
+	if err := a.Storage.createProfile(ctx, profile); err != nil {
+		return err
+	}
+	return a.record(ctx, "profile.create", "profile", strconv.Itoa(profile.ID), nil, profile)
+}
+
+func (a *auditedStorage) updateProfile(ctx context.Context, profile *CustomerProfile, changedBy int) error {
+	before, _ := a.Storage.getProfileByUserId(ctx, profile.UserID)
+	if err := a.Storage.updateProfile(ctx, profile, changedBy); err != nil {
+		return err
+	}
+	return a.record(ctx, "profile.update", "profile", strconv.Itoa(profile.ID), before, profile)
+}
+
+func (a *auditedStorage) changeAccountStatus(ctx context.Context, accountID int, status, reason, changedBy string) error {
+	before, _ := a.Storage.getAccountById(ctx, accountID)
+	if err := a.Storage.changeAccountStatus(ctx, accountID, status, reason, changedBy); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getAccountById(context.WithoutCancel(ctx), accountID)
+	return a.record(ctx, "account.status", "account", strconv.Itoa(accountID), before, after)
+}
+
+func (a *auditedStorage) softDeleteUser(ctx context.Context, id int) error {
+	before, _ := a.Storage.getUserById(ctx, id)
+	if err := a.Storage.softDeleteUser(ctx, id); err != nil {
+		return err
+	}
+	return a.record(ctx, "user.delete", "user", strconv.Itoa(id), before, nil)
+}
+
+func (a *auditedStorage) softDeleteAccount(ctx context.Context, id int) error {
+	before, _ := a.Storage.getAccountById(ctx, id)
+	if err := a.Storage.softDeleteAccount(ctx, id); err != nil {
+		return err
+	}
+	return a.record(ctx, "account.delete", "account", strconv.Itoa(id), before, nil)
+}
+
+func (a *auditedStorage) restoreUser(ctx context.Context, id int) error {
+	if err := a.Storage.restoreUser(ctx, id); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getUserById(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "user.restore", "user", strconv.Itoa(id), nil, after)
+}
+
+func (a *auditedStorage) restoreAccount(ctx context.Context, id int) error {
+	if err := a.Storage.restoreAccount(ctx, id); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getAccountById(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "account.restore", "account", strconv.Itoa(id), nil, after)
+}
+
+func (a *auditedStorage) purgeDeleted(ctx context.Context) (*PurgeResult, error) {
+	result, err := a.Storage.purgeDeleted(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if result.Users == 0 && result.Accounts == 0 {
+		return result, nil
+	}
+	return result, a.record(ctx, "records.purge", "records", "", nil, result)
+}
+
+func (a *auditedStorage) setTransferLimitOverride(ctx context.Context, override *TransferLimitOverride) error {
+	before, _ := a.Storage.getTransferLimitOverride(ctx, override.UserID)
+	if err := a.Storage.setTransferLimitOverride(ctx, override); err != nil {
+		return err
+	}
+	return a.record(ctx, "transfer_limits.override", "user", strconv.Itoa(override.UserID), before, override)
+}
+
+func (a *auditedStorage) deleteTransferLimitOverride(ctx context.Context, userID int) error {
+	before, _ := a.Storage.getTransferLimitOverride(ctx, userID)
+	if err := a.Storage.deleteTransferLimitOverride(ctx, userID); err != nil {
+		return err
+	}
+	return a.record(ctx, "transfer_limits.clear", "user", strconv.Itoa(userID), before, nil)
+}
+
+func (a *auditedStorage) setOverdraftLimit(ctx context.Context, accountID int, limit float64) error {
+	before, _ := a.Storage.getAccountById(ctx, accountID)
+	if err := a.Storage.setOverdraftLimit(ctx, accountID, limit); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getAccountById(context.WithoutCancel(ctx), accountID)
+	return a.record(ctx, "account.overdraft", "account", strconv.Itoa(accountID), before, after)
+}
+
+// chargeOverdrafts records whatever was charged, even if some accounts
+// failed or the run stopped part way through.
+func (a *auditedStorage) chargeOverdrafts(ctx context.Context) (*OverdraftRun, error) {
+	result, err := a.Storage.chargeOverdrafts(ctx)
+	if result == nil || result.Accounts == 0 {
+		return result, err
+	}
+	if recordErr := a.record(ctx, "overdraft.charge", "accounts", "", nil, result); err == nil {
+		err = recordErr
+	}
+	return result, err
+}
+
+func (a *auditedStorage) placeHold(ctx context.Context, hold *Hold) error {
+	if err := a.Storage.placeHold(ctx, hold); err != nil {
+		return err
+	}
+	return a.record(ctx, "hold.place", "hold", strconv.Itoa(hold.ID), nil, hold)
+}
+
+func (a *auditedStorage) captureHold(ctx context.Context, id int, amount float64) error {
+	before, _ := a.Storage.getHold(ctx, id)
+	if err := a.Storage.captureHold(ctx, id, amount); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getHold(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "hold.capture", "hold", strconv.Itoa(id), before, after)
+}
+
+func (a *auditedStorage) releaseHold(ctx context.Context, id int) error {
+	before, _ := a.Storage.getHold(ctx, id)
+	if err := a.Storage.releaseHold(ctx, id); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getHold(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "hold.release", "hold", strconv.Itoa(id), before, after)
+}
+
+func (a *auditedStorage) expireHolds(ctx context.Context) (int64, error) {
+	expired, err := a.Storage.expireHolds(ctx)
+	if err != nil || expired == 0 {
+		return expired, err
+	}
+	return expired, a.record(ctx, "holds.expire", "holds", "", nil, map[string]int64{"expired": expired})
+}
+
+func (a *auditedStorage) createScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	if err := a.Storage.createScheduledTransfer(ctx, transfer); err != nil {
+		return err
+	}
+	return a.record(ctx, "transfer.schedule", "scheduled_transfer", strconv.Itoa(transfer.ID), nil, transfer)
+}
+
+func (a *auditedStorage) cancelScheduledTransfer(ctx context.Context, id, userID int) error {
+	before, _ := a.Storage.getScheduledTransfer(ctx, id)
+	if err := a.Storage.cancelScheduledTransfer(ctx, id, userID); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getScheduledTransfer(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "transfer.cancel", "scheduled_transfer", strconv.Itoa(id), before, after)
+}
+
+// claimDueTransfers records which transfers were taken for execution.
+func (a *auditedStorage) claimDueTransfers(ctx context.Context, limit int) ([]*ScheduledTransfer, error) {
+	transfers, err := a.Storage.claimDueTransfers(ctx, limit)
+	if err != nil || len(transfers) == 0 {
+		return transfers, err
+	}
+	ids := make([]int, len(transfers))
+	for i, transfer := range transfers {
+		ids[i] = transfer.ID
+	}
+	return transfers, a.record(ctx, "transfers.claim", "scheduled_transfers", "", nil, map[string][]int{"ids": ids})
+}
+
+func (a *auditedStorage) finishScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	before, _ := a.Storage.getScheduledTransfer(ctx, transfer.ID)
+	if err := a.Storage.finishScheduledTransfer(ctx, transfer); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getScheduledTransfer(context.WithoutCancel(ctx), transfer.ID)
+	return a.record(ctx, "transfer.finish", "scheduled_transfer", strconv.Itoa(transfer.ID), before, after)
+}
+
+func (a *auditedStorage) createStandingOrder(ctx context.Context, order *StandingOrder) error {
+	if err := a.Storage.createStandingOrder(ctx, order); err != nil {
+		return err
+	}
+	return a.record(ctx, "standing_order.create", "standing_order", strconv.Itoa(order.ID), nil, order)
+}
+
+func (a *auditedStorage) changeStandingOrder(ctx context.Context, id int, action string) error {
+	before, _ := a.Storage.getStandingOrder(ctx, id)
+	if err := a.Storage.changeStandingOrder(ctx, id, action); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getStandingOrder(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "standing_order."+action, "standing_order", strconv.Itoa(id), before, after)
+}
+
+// generateStandingOrderTransfers records how many transfers standing
+// orders produced for date; each one is recorded again when it executes.
+func (a *auditedStorage) generateStandingOrderTransfers(ctx context.Context, date time.Time) (int, error) {
+	created, err := a.Storage.generateStandingOrderTransfers(ctx, date)
+	if created == 0 {
+		return created, err
+	}
+	after := map[string]interface{}{"date": date.Format(executeOnLayout), "created": created}
+	if recordErr := a.record(ctx, "standing_orders.generate", "scheduled_transfers", "", nil, after); err == nil {
+		err = recordErr
+	}
+	return created, err
+}
+
+func (a *auditedStorage) createNotification(ctx context.Context, notification *Notification) error {
+	if err := a.Storage.createNotification(ctx, notification); err != nil {
+		return err
+	}
+	return a.record(ctx, "notification.create", "notification", strconv.Itoa(notification.ID), nil, notification)
+}
+
+func (a *auditedStorage) markNotificationRead(ctx context.Context, id, userID int) error {
+	if err := a.Storage.markNotificationRead(ctx, id, userID); err != nil {
+		return err
+	}
+	return a.record(ctx, "notification.read", "notification", strconv.Itoa(id), nil, nil)
+}
+
+func (a *auditedStorage) createInterestProduct(ctx context.Context, product *InterestProduct) error {
+	if err := a.Storage.createInterestProduct(ctx, product); err != nil {
+		return err
+	}
+	return a.record(ctx, "interest_product.create", "interest_product", strconv.Itoa(product.ID), nil, product)
+}
+
+func (a *auditedStorage) setAccountInterestProduct(ctx context.Context, accountID, productID int) error {
+	before, _ := a.Storage.getAccountById(ctx, accountID)
+	if err := a.Storage.setAccountInterestProduct(ctx, accountID, productID); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getAccountById(context.WithoutCancel(ctx), accountID)
+	return a.record(ctx, "account.interest_product", "account", strconv.Itoa(accountID), before, after)
+}
+
+// runInterest records whatever was accrued and posted, even if some
+// accounts failed or the run stopped part way through.
+func (a *auditedStorage) runInterest(ctx context.Context, date time.Time) (*InterestRun, error) {
+	result, err := a.Storage.runInterest(ctx, date)
+	if result == nil || result.Accounts == 0 {
+		return result, err
+	}
+	if recordErr := a.record(ctx, "interest.run", "accounts", "", nil, result); err == nil {
+		err = recordErr
+	}
+	return result, err
+}
+
+func (a *auditedStorage) setFeeRule(ctx context.Context, rule *FeeRule) error {
+	if err := a.Storage.setFeeRule(ctx, rule); err != nil {
+		return err
+	}
+	return a.record(ctx, "fee_rule.set", "fee_rule", rule.AccountType+"/"+rule.Event, nil, rule)
+}
+
+func (a *auditedStorage) deleteFeeRule(ctx context.Context, accountType, event string) error {
+	if err := a.Storage.deleteFeeRule(ctx, accountType, event); err != nil {
+		return err
+	}
+	return a.record(ctx, "fee_rule.delete", "fee_rule", accountType+"/"+event, nil, nil)
+}
+
+func (a *auditedStorage) waiveFee(ctx context.Context, id int, waivedBy, reason string) error {
+	before, _ := a.Storage.getFee(ctx, id)
+	if err := a.Storage.waiveFee(ctx, id, waivedBy, reason); err != nil {
+		return err
+	}
+	after, _ := a.Storage.getFee(context.WithoutCancel(ctx), id)
+	return a.record(ctx, "fee.waive", "fee", strconv.Itoa(id), before, after)
+}
+
+func (a *auditedStorage) setFXRates(ctx context.Context, rates []*FXRate) error {
+	if err := a.Storage.setFXRates(ctx, rates); err != nil {
+		return err
+	}
+	return a.record(ctx, "fx_rates.set", "fx_rates", "", nil, rates)
+}
+
+func (a *auditedStorage) createFXQuote(ctx context.Context, quote *FXQuote) error {
+	if err := a.Storage.createFXQuote(ctx, quote); err != nil {
+		return err
+	}
+	return a.record(ctx, "fx_quote.create", "fx_quote", strconv.Itoa(quote.ID), nil, quote)
+}
+
+// chargeMaintenanceFees records whatever was charged, even if some
+// accounts failed or the run stopped part way through.
+func (a *auditedStorage) chargeMaintenanceFees(ctx context.Context, period time.Time) (*FeeRun, error) {
+	result, err := a.Storage.chargeMaintenanceFees(ctx, period)
+	if result == nil || result.Accounts == 0 {
+		return result, err
+	}
+	if recordErr := a.record(ctx, "fees.maintenance", "accounts", "", nil, result); err == nil {
+		err = recordErr
+	}
+	return result, err
+}
+
+func (s *APIServer) handleQueryAudit(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+		Limit:      min(100, s.config.Limits.MaxAuditQueryLimit),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > s.config.Limits.MaxAuditQueryLimit {
+			return writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", s.config.Limits.MaxAuditQueryLimit))
+		}
+		filter.Limit = n
+	}
+
+	events, err := s.storage.queryAudit(r.Context(), filter)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, events)
+}
+
+func (s *APIServer) handleVerifyAudit(w http.ResponseWriter, r *http.Request) error {
+	result, err := s.storage.verifyAuditChain(r.Context())
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// runVerifyAuditCommand implements `gobank verify-audit`: it walks the whole
+// audit chain and exits non-zero if any entry has been tampered with.
+func runVerifyAuditCommand(logger *slog.Logger, store Storage) int {
+	result, err := store.verifyAuditChain(context.Background())
+	if err != nil {
+		logger.Error("Error verifying audit log", "error", err)
+		return 2
+	}
+
+	if !result.Valid {
+		fmt.Printf("audit log BROKEN at entry %d: %s (%d entries checked)\n", result.FirstBrokenID, result.Reason, result.EntriesChecked)
+		return 1
+	}
+
+	fmt.Printf("audit log OK (%d entries checked)\n", result.EntriesChecked)
+	return 0
+}
+
+// auditFilterClause builds the WHERE clause and arguments for queryAudit.
+func auditFilterClause(filter AuditFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(column, value string) {
+		if value == "" {
+			return
+		}
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	add("actor", filter.Actor)
+	add("action", filter.Action)
+	add("target_type", filter.TargetType)
+	add("target_id", filter.TargetID)
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
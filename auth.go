@@ -3,7 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -16,12 +16,40 @@ type SignupRequest struct {
 	// Other signup fields
 }
 
+// User roles. Customers are the default; operators manage account
+// lifecycles.
+const (
+	RoleCustomer = "customer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// actorFromRequest names the caller of an authenticated request: "user:<id>"
+// for a user token or "service:<name>" for an internal service's client
+// certificate. Handlers behind withRole record it wherever they note who
+// made a change.
+func actorFromRequest(r *http.Request) (string, bool) {
+	if userID, ok := r.Context().Value("user_id").(int); ok {
+		return userActor(userID), true
+	}
+	if service, ok := serviceIdentityFromContext(r.Context()); ok {
+		return "service:" + service.Name, true
+	}
+	return "", false
+}
+
+func userActor(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id"`
+	Username  string     `json:"username"`
+	Password  string     `json:"-"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 func (s *APIServer) handleSignup(w http.ResponseWriter, r *http.Request) error {
@@ -36,7 +64,7 @@ func (s *APIServer) handleSignup(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	// Check if the username already exists
-	existingUser, err := s.storage.getUserByUsername(signupRequest.Username)
+	existingUser, err := s.storageFor(r).getUserByUsername(r.Context(), signupRequest.Username)
 	if err != nil {
 		return err
 	}
@@ -54,7 +82,7 @@ func (s *APIServer) handleSignup(w http.ResponseWriter, r *http.Request) error {
 		Username: signupRequest.Username,
 		Password: hashedPassword,
 	}
-	err = s.storage.createUser(user)
+	err = s.storageFor(r).createUser(r.Context(), user)
 	if err != nil {
 		return err
 	}
@@ -75,17 +103,20 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	// Authenticate the user
-	user, err := s.storage.authenticateUser(loginRequest.Username, loginRequest.Password)
+	user, err := s.storageFor(r).authenticateUser(r.Context(), loginRequest.Username, loginRequest.Password)
 	if err != nil {
 		if err.Error() == "invalid password" {
+			loginAttempts.WithLabelValues("failure").Inc()
 			writeAPIError(w, http.StatusUnauthorized, "Invalid username or password")
 			return nil
 		}
 		return err
 	}
 	if user == nil {
+		loginAttempts.WithLabelValues("failure").Inc()
 		return writeAPIError(w, http.StatusUnauthorized, "Invalid username or password")
 	}
+	loginAttempts.WithLabelValues("success").Inc()
 
 	// Generate JWT token
 	tokenString, err := s.generateJWTToken(user.ID)
@@ -98,13 +129,12 @@ func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *APIServer) generateJWTToken(userID int) (string, error) {
-	// TODO: Replace with your actual JWT secret or private key
-	secret := []byte(os.Getenv("JWT_SECRET"))
+	secret := []byte(s.config.JWT.Secret)
 
 	// Create the token claims
 	claims := jwt.MapClaims{
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(), // Token expires in 24 hours
+		"exp":     time.Now().Add(s.config.JWT.TTL).Unix(),
 	}
 
 	// Create the token
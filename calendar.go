@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// Embedded zone data so calendar.time_zone works on minimal images
+	_ "time/tzdata"
+)
+
+// Calendar knows which days banks are open in one country and when the
+// daily cut-off falls. Dates are handled as UTC midnights standing for a
+// calendar day in the calendar's time zone.
+type Calendar struct {
+	country  string
+	location *time.Location
+	holidays map[string]string
+	cutoff   time.Duration
+	cutoffs  map[time.Weekday]time.Duration
+}
+
+func loadCalendar(cfg CalendarConfig) (*Calendar, error) {
+	location, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	cutoff, err := parseCutoff(cfg.Cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Calendar{
+		country:  cfg.Country,
+		location: location,
+		holidays: map[string]string{},
+		cutoff:   cutoff,
+		cutoffs:  map[time.Weekday]time.Duration{},
+	}
+	for day, value := range cfg.Cutoffs {
+		weekday, ok := parseWeekday(day)
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q in calendar.cutoffs", day)
+		}
+		if c.cutoffs[weekday], err = parseCutoff(value); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.HolidaysDir != "" {
+		path := filepath.Join(cfg.HolidaysDir, cfg.Country+".txt")
+		if c.holidays, err = loadHolidays(path); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// loadHolidays reads a holiday file: one "YYYY-MM-DD Name" per line, with
+// blank lines and lines starting with # ignored.
+func loadHolidays(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading holidays: %w", err)
+	}
+	defer f.Close()
+
+	holidays := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		date, name, _ := strings.Cut(text, " ")
+		if _, err := time.Parse(executeOnLayout, date); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid date %q", path, line, date)
+		}
+		holidays[date] = strings.TrimSpace(name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loading holidays: %w", err)
+	}
+	return holidays, nil
+}
+
+// parseCutoff parses a "15:04" time of day into the offset from midnight.
+func parseCutoff(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cut-off time %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()) {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// dateOf returns the calendar day t falls on in the calendar's time zone.
+func (c *Calendar) dateOf(t time.Time) time.Time {
+	y, m, d := t.In(c.location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func (c *Calendar) today() time.Time {
+	return c.dateOf(time.Now())
+}
+
+func (c *Calendar) isBusinessDay(date time.Time) bool {
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return false
+	}
+	_, holiday := c.holidays[date.Format(executeOnLayout)]
+	return !holiday
+}
+
+// onOrAfter returns date if it is a business day, else the next one.
+func (c *Calendar) onOrAfter(date time.Time) time.Time {
+	for !c.isBusinessDay(date) {
+		date = date.AddDate(0, 0, 1)
+	}
+	return date
+}
+
+// onOrBefore returns date if it is a business day, else the previous one.
+func (c *Calendar) onOrBefore(date time.Time) time.Time {
+	for !c.isBusinessDay(date) {
+		date = date.AddDate(0, 0, -1)
+	}
+	return date
+}
+
+// addBusinessDays moves n business days from date, backwards for negative
+// n. Zero returns date unchanged even if it is not a business day.
+func (c *Calendar) addBusinessDays(date time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
+	}
+	for ; n > 0; n-- {
+		date = date.AddDate(0, 0, step)
+		for !c.isBusinessDay(date) {
+			date = date.AddDate(0, 0, step)
+		}
+	}
+	return date
+}
+
+func (c *Calendar) lastBusinessDayOfMonth(year int, month time.Month) time.Time {
+	return c.onOrBefore(time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC))
+}
+
+func (c *Calendar) cutoffOn(weekday time.Weekday) time.Duration {
+	if cutoff, ok := c.cutoffs[weekday]; ok {
+		return cutoff
+	}
+	return c.cutoff
+}
+
+// valueDate is the day a transaction made at t settles: the same day if
+// that is a business day and t is before its cut-off, otherwise the next
+// business day.
+func (c *Calendar) valueDate(t time.Time) time.Time {
+	local := t.In(c.location)
+	date := c.dateOf(t)
+	if !c.isBusinessDay(date) {
+		return c.onOrAfter(date)
+	}
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	if sinceMidnight >= c.cutoffOn(date.Weekday()) {
+		return c.addBusinessDays(date, 1)
+	}
+	return date
+}
+
+type Holiday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+type CalendarStatus struct {
+	Country     string    `json:"country"`
+	Today       string    `json:"today"`
+	BusinessDay bool      `json:"business_day"`
+	Cutoff      string    `json:"cutoff"`
+	ValueDate   string    `json:"value_date"`
+	Holidays    []Holiday `json:"upcoming_holidays"`
+}
+
+// handleCalendar reports the value date a transaction made now would get,
+// the cut-off that decides it and the holidays coming up.
+func (s *APIServer) handleCalendar(w http.ResponseWriter, r *http.Request) error {
+	now := time.Now()
+	today := s.calendar.today()
+	cutoff := s.calendar.cutoffOn(today.Weekday())
+
+	status := &CalendarStatus{
+		Country:     s.calendar.country,
+		Today:       today.Format(executeOnLayout),
+		BusinessDay: s.calendar.isBusinessDay(today),
+		Cutoff:      fmt.Sprintf("%02d:%02d", int(cutoff.Hours()), int(cutoff.Minutes())%60),
+		ValueDate:   s.calendar.valueDate(now).Format(executeOnLayout),
+		Holidays:    []Holiday{},
+	}
+
+	days := 90
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 366 {
+			return writeAPIError(w, http.StatusBadRequest, "days must be between 1 and 366")
+		}
+		days = n
+	}
+	until := today.AddDate(0, 0, days).Format(executeOnLayout)
+	for date, name := range s.calendar.holidays {
+		if date >= status.Today && date <= until {
+			status.Holidays = append(status.Holidays, Holiday{Date: date, Name: name})
+		}
+	}
+	sort.Slice(status.Holidays, func(i, j int) bool { return status.Holidays[i].Date < status.Holidays[j].Date })
+
+	return writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testCalendar is a London calendar with a 16:00 cut-off, 15:00 on
+// Fridays, and a few 2024 bank holidays.
+func testCalendar(t *testing.T) *Calendar {
+	t.Helper()
+	location, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Calendar{
+		country:  "GB",
+		location: location,
+		holidays: map[string]string{
+			"2024-03-29": "Good Friday",
+			"2024-04-01": "Easter Monday",
+			"2024-05-27": "Spring bank holiday",
+			"2024-12-25": "Christmas Day",
+			"2024-12-26": "Boxing Day",
+		},
+		cutoff:  16 * time.Hour,
+		cutoffs: map[time.Weekday]time.Duration{time.Friday: 15 * time.Hour},
+	}
+}
+
+func TestCalendarValueDate(t *testing.T) {
+	cal := testCalendar(t)
+	london := func(year int, month time.Month, day, hour, minute, sec int) time.Time {
+		return time.Date(year, month, day, hour, minute, sec, 0, cal.location)
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want time.Time
+	}{
+		{"business day before cut-off", london(2024, time.March, 13, 10, 0, 0), date(2024, time.March, 13)},
+		{"last second before cut-off", london(2024, time.March, 13, 15, 59, 59), date(2024, time.March, 13)},
+		{"at cut-off", london(2024, time.March, 13, 16, 0, 0), date(2024, time.March, 14)},
+		{"Friday before its earlier cut-off", london(2024, time.March, 15, 14, 59, 0), date(2024, time.March, 15)},
+		{"Friday after its earlier cut-off", london(2024, time.March, 15, 15, 0, 0), date(2024, time.March, 18)},
+		{"Saturday", london(2024, time.March, 16, 10, 0, 0), date(2024, time.March, 18)},
+		{"Sunday after cut-off", london(2024, time.March, 17, 18, 0, 0), date(2024, time.March, 18)},
+		{"Thursday before Easter after cut-off", london(2024, time.March, 28, 17, 0, 0), date(2024, time.April, 2)},
+		{"Good Friday", london(2024, time.March, 29, 9, 0, 0), date(2024, time.April, 2)},
+		{"Friday after cut-off before a bank holiday Monday", london(2024, time.May, 24, 16, 0, 0), date(2024, time.May, 28)},
+		{"Christmas Eve after cut-off", london(2024, time.December, 24, 17, 0, 0), date(2024, time.December, 27)},
+		{"Christmas Day", london(2024, time.December, 25, 9, 0, 0), date(2024, time.December, 27)},
+		{"cut-off in local summer time", time.Date(2024, time.July, 1, 15, 30, 0, 0, time.UTC), date(2024, time.July, 2)},
+		{"UTC Friday night is local Saturday", time.Date(2024, time.June, 14, 23, 30, 0, 0, time.UTC), date(2024, time.June, 17)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cal.valueDate(tt.at); !got.Equal(tt.want) {
+				t.Errorf("valueDate(%s) = %s, want %s", tt.at, got.Format(executeOnLayout), tt.want.Format(executeOnLayout))
+			}
+		})
+	}
+}
+
+func TestCalendarAddBusinessDays(t *testing.T) {
+	cal := testCalendar(t)
+	tests := []struct {
+		name string
+		from time.Time
+		n    int
+		want time.Time
+	}{
+		{"zero on a weekend", date(2024, time.March, 16), 0, date(2024, time.March, 16)},
+		{"over a weekend", date(2024, time.March, 15), 1, date(2024, time.March, 18)},
+		{"over Easter", date(2024, time.March, 28), 1, date(2024, time.April, 2)},
+		{"backwards over Easter", date(2024, time.April, 2), -1, date(2024, time.March, 28)},
+		{"over Christmas", date(2024, time.December, 24), 2, date(2024, time.December, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cal.addBusinessDays(tt.from, tt.n); !got.Equal(tt.want) {
+				t.Errorf("addBusinessDays(%s, %d) = %s, want %s", tt.from.Format(executeOnLayout), tt.n, got.Format(executeOnLayout), tt.want.Format(executeOnLayout))
+			}
+		})
+	}
+}
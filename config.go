@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the complete service configuration. Every leaf setting can be
+// given in the YAML config file, through an environment variable (env tag,
+// first name set wins) or as a command-line flag named after its YAML path,
+// e.g. -database.max_open_conns. Flags override the environment, which
+// overrides the file, which overrides the defaults.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	JWT       JWTConfig       `yaml:"jwt"`
+	Log       LogConfig       `yaml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	IBAN      IBANConfig      `yaml:"iban"`
+	Limits    LimitsConfig    `yaml:"limits"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// TransferLimits are the defaults per account type; admins can
+	// override them per user.
+	TransferLimits TransferLimitsConfig `yaml:"transfer_limits"`
+	Overdraft      OverdraftConfig      `yaml:"overdraft"`
+	Holds          HoldsConfig          `yaml:"holds"`
+	Scheduler      SchedulerConfig      `yaml:"scheduler"`
+	Calendar       CalendarConfig       `yaml:"calendar"`
+	Interest       InterestConfig       `yaml:"interest"`
+	Fees           FeesConfig           `yaml:"fees"`
+	Currency       CurrencyConfig       `yaml:"currency"`
+	FX             FXConfig             `yaml:"fx"`
+	Features       FeaturesConfig       `yaml:"features"`
+}
+
+// ServerConfig bounds how long a client may take to send a request, how
+// long a handler may run, how long a response may take to write, how long
+// keep-alive connections idle, and how long shutdown waits for in-flight
+// requests.
+type ServerConfig struct {
+	Addr              string        `yaml:"addr" env:"LISTEN_ADDR"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	RequestTimeout    time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	TLS               TLSConfig     `yaml:"tls"`
+}
+
+// TLSConfig enables HTTPS. With a client CA, internal callers can
+// authenticate with a client certificate; ClientRoles maps the
+// certificate's common name to the role that service acts with, given in
+// the environment or on the command line as "name=role,name=role".
+type TLSConfig struct {
+	Enabled           bool              `yaml:"enabled" env:"TLS_ENABLED"`
+	CertFile          string            `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile           string            `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ReloadInterval    time.Duration     `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	ClientCAFile      string            `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	RequireClientCert bool              `yaml:"require_client_cert" env:"TLS_REQUIRE_CLIENT_CERT"`
+	ClientRoles       map[string]string `yaml:"client_roles" env:"TLS_CLIENT_ROLES"`
+}
+
+type DatabaseConfig struct {
+	Host            string        `yaml:"host" env:"DB_HOST"`
+	Port            int           `yaml:"port" env:"DB_PORT"`
+	User            string        `yaml:"user" env:"DB_USER"`
+	Password        string        `yaml:"password" env:"DB_PASSWORD,PASSWORD" secret:"true"`
+	Name            string        `yaml:"name" env:"DB_NAME"`
+	SSLMode         string        `yaml:"sslmode" env:"DB_SSLMODE"`
+	SSLRootCert     string        `yaml:"sslrootcert" env:"DB_SSLROOTCERT"`
+	SSLCert         string        `yaml:"sslcert" env:"DB_SSLCERT"`
+	SSLKey          string        `yaml:"sslkey" env:"DB_SSLKEY"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME"`
+}
+
+// DSN returns the lib/pq connection string for c.
+func (c DatabaseConfig) DSN() string {
+	quote := func(v string) string {
+		return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+	}
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quote(c.Host), c.Port, quote(c.User), quote(c.Password), quote(c.Name), quote(c.SSLMode))
+	for _, opt := range []struct{ key, value string }{
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+	} {
+		if opt.value != "" {
+			dsn += " " + opt.key + "=" + quote(opt.value)
+		}
+	}
+	return dsn
+}
+
+type JWTConfig struct {
+	Secret string        `yaml:"secret" env:"JWT_SECRET" secret:"true"`
+	TTL    time.Duration `yaml:"ttl" env:"JWT_TTL"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type TracingConfig struct {
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+}
+
+type IBANConfig struct {
+	Country  string `yaml:"country" env:"IBAN_COUNTRY"`
+	BankCode string `yaml:"bank_code" env:"IBAN_BANK_CODE"`
+}
+
+type LimitsConfig struct {
+	// DeletedRetentionDays is how long soft-deleted users and accounts
+	// can be restored before the purge job removes them for good.
+	DeletedRetentionDays int           `yaml:"deleted_retention_days" env:"DELETED_RETENTION_DAYS"`
+	PurgeInterval        time.Duration `yaml:"purge_interval" env:"PURGE_INTERVAL"`
+	MaxRequestBodyBytes  int64         `yaml:"max_request_body_bytes" env:"MAX_REQUEST_BODY_BYTES"`
+	MaxAuditQueryLimit   int           `yaml:"max_audit_query_limit" env:"MAX_AUDIT_QUERY_LIMIT"`
+}
+
+// RateLimitConfig sets the token-bucket policies. Each rule allows
+// per_minute requests on average with bursts of up to burst, counted per
+// ip, user or api_key. The X-API-Key header is not validated here, so key
+// by api_key only behind a gateway that checks it. With TrustForwardedFor
+// the client IP is the right-most X-Forwarded-For entry that is not one of
+// the TrustedProxies CIDRs; with no TrustedProxies that is the entry added
+// by the proxy in front of the server.
+type RateLimitConfig struct {
+	Enabled           bool          `yaml:"enabled" env:"RATE_LIMIT_ENABLED"`
+	Store             string        `yaml:"store" env:"RATE_LIMIT_STORE"`
+	TrustForwardedFor bool          `yaml:"trust_forwarded_for" env:"RATE_LIMIT_TRUST_FORWARDED_FOR"`
+	TrustedProxies    []string      `yaml:"trusted_proxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+	Default           RateLimitRule `yaml:"default"`
+	Signup            RateLimitRule `yaml:"signup"`
+	Login             RateLimitRule `yaml:"login"`
+	Transfer          RateLimitRule `yaml:"transfer"`
+}
+
+type RateLimitRule struct {
+	PerMinute int    `yaml:"per_minute"`
+	Burst     int    `yaml:"burst"`
+	Key       string `yaml:"key"`
+}
+
+// TransferLimitsConfig holds the limits per account type in the default
+// currency; accounts in other currencies get them scaled by the currency's
+// amount scale.
+type TransferLimitsConfig struct {
+	Personal TransferLimits `yaml:"personal"`
+	Business TransferLimits `yaml:"business"`
+}
+
+// OverdraftConfig prices overdrafts. Interest is charged daily at
+// InterestRate/365 on the overdrawn amount; UnarrangedFee is added on each
+// day an account is overdrawn beyond its arranged limit. UnarrangedFee and
+// MaxLimit are in the default currency and scaled like transfer limits.
+type OverdraftConfig struct {
+	InterestRate   float64       `yaml:"interest_rate" env:"OVERDRAFT_INTEREST_RATE"`
+	UnarrangedFee  float64       `yaml:"unarranged_fee" env:"OVERDRAFT_UNARRANGED_FEE"`
+	MaxLimit       float64       `yaml:"max_limit" env:"OVERDRAFT_MAX_LIMIT"`
+	ChargeInterval time.Duration `yaml:"charge_interval" env:"OVERDRAFT_CHARGE_INTERVAL"`
+}
+
+// HoldsConfig bounds how long reserved funds stay unavailable and how
+// often expired holds are released.
+type HoldsConfig struct {
+	DefaultExpiry  time.Duration `yaml:"default_expiry" env:"HOLD_DEFAULT_EXPIRY"`
+	MaxExpiry      time.Duration `yaml:"max_expiry" env:"HOLD_MAX_EXPIRY"`
+	ExpiryInterval time.Duration `yaml:"expiry_interval" env:"HOLD_EXPIRY_INTERVAL"`
+}
+
+// SchedulerConfig controls how future-dated transfers are executed. A
+// transfer that fails transiently is retried after RetryBackoff, doubling
+// each time, until MaxAttempts have been made.
+type SchedulerConfig struct {
+	Interval         time.Duration `yaml:"interval" env:"SCHEDULER_INTERVAL"`
+	BatchSize        int           `yaml:"batch_size" env:"SCHEDULER_BATCH_SIZE"`
+	MaxAttempts      int           `yaml:"max_attempts" env:"SCHEDULER_MAX_ATTEMPTS"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff" env:"SCHEDULER_RETRY_BACKOFF"`
+	ExecutionTimeout time.Duration `yaml:"execution_timeout" env:"SCHEDULER_EXECUTION_TIMEOUT"`
+	MaxDaysAhead     int           `yaml:"max_days_ahead" env:"SCHEDULER_MAX_DAYS_AHEAD"`
+}
+
+// CalendarConfig decides value dates. Holidays are read from
+// HolidaysDir/<Country>.txt; with no directory only weekends are closed.
+// Cutoffs overrides Cutoff for individual weekdays, e.g. friday=14:00.
+type CalendarConfig struct {
+	Country     string            `yaml:"country" env:"CALENDAR_COUNTRY"`
+	HolidaysDir string            `yaml:"holidays_dir" env:"HOLIDAYS_DIR"`
+	TimeZone    string            `yaml:"time_zone" env:"CALENDAR_TIME_ZONE"`
+	Cutoff      string            `yaml:"cutoff" env:"CALENDAR_CUTOFF"`
+	Cutoffs     map[string]string `yaml:"cutoffs" env:"CALENDAR_CUTOFFS"`
+}
+
+// InterestConfig controls the interest batch. Each run covers the last
+// CatchUpDays completed days, so a day missed while the job was down is
+// picked up on the next run.
+type InterestConfig struct {
+	RunInterval time.Duration `yaml:"run_interval" env:"INTEREST_RUN_INTERVAL"`
+	CatchUpDays int           `yaml:"catch_up_days" env:"INTEREST_CATCH_UP_DAYS"`
+}
+
+// FeesConfig names the account that fees are paid into; with none, no
+// fees are charged. Fee rules themselves are managed through the admin API,
+// and only accounts in the revenue account's currency pay them.
+type FeesConfig struct {
+	RevenueAccount      int64         `yaml:"revenue_account" env:"FEE_REVENUE_ACCOUNT"`
+	MaintenanceInterval time.Duration `yaml:"maintenance_interval" env:"FEE_MAINTENANCE_INTERVAL"`
+}
+
+// CurrencyConfig sets the currency new accounts are opened in when none is
+// asked for. Accounts that predate currencies are given it too. Configured
+// amounts such as transfer limits and overdraft fees are in the default
+// currency; AmountScales maps each other currency accounts may be opened
+// in to what one unit of the default is worth in it, e.g. "JPY": "190"
+// turns a 5000 limit into 950000 yen.
+type CurrencyConfig struct {
+	Default      string            `yaml:"default" env:"DEFAULT_CURRENCY"`
+	AmountScales map[string]string `yaml:"amount_scales" env:"CURRENCY_AMOUNT_SCALES"`
+}
+
+// FXConfig controls currency conversion. Customers are quoted the
+// mid-market rate less Spread, or less Spreads["GBP/EUR"] when converting
+// that way round, and a quote holds for QuoteTTL. Converted money passes
+// through the bank's position account in each currency: PositionAccounts
+// maps currency codes to account numbers, and currencies without one
+// cannot be converted. RatesFile, if set, is loaded into the rate store at
+// startup; rates can also be set through the admin API.
+type FXConfig struct {
+	RatesFile        string            `yaml:"rates_file" env:"FX_RATES_FILE"`
+	Spread           float64           `yaml:"spread" env:"FX_SPREAD"`
+	Spreads          map[string]string `yaml:"spreads" env:"FX_SPREADS"`
+	QuoteTTL         time.Duration     `yaml:"quote_ttl" env:"FX_QUOTE_TTL"`
+	PositionAccounts map[string]string `yaml:"position_accounts" env:"FX_POSITION_ACCOUNTS"`
+}
+
+type FeaturesConfig struct {
+	Metrics       bool `yaml:"metrics" env:"FEATURE_METRICS"`
+	PurgeJob      bool `yaml:"purge_job" env:"FEATURE_PURGE_JOB"`
+	OverdraftJob  bool `yaml:"overdraft_job" env:"FEATURE_OVERDRAFT_JOB"`
+	HoldExpiryJob bool `yaml:"hold_expiry_job" env:"FEATURE_HOLD_EXPIRY_JOB"`
+	Scheduler     bool `yaml:"scheduler" env:"FEATURE_SCHEDULER"`
+	InterestJob   bool `yaml:"interest_job" env:"FEATURE_INTEREST_JOB"`
+	FeeJob        bool `yaml:"fee_job" env:"FEATURE_FEE_JOB"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:              ":8080",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			RequestTimeout:    10 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			TLS:               TLSConfig{ReloadInterval: 30 * time.Second},
+		},
+		Database: DatabaseConfig{
+			Host:            "localhost",
+			Port:            5432,
+			User:            "postgres",
+			Name:            "goLearning_db",
+			SSLMode:         "verify-full",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		JWT:     JWTConfig{TTL: 24 * time.Hour},
+		Log:     LogConfig{Level: "info", Format: "json"},
+		Tracing: TracingConfig{Exporter: "none"},
+		IBAN:    IBANConfig{Country: "GB", BankCode: "GOBK"},
+		Limits: LimitsConfig{
+			DeletedRetentionDays: 30,
+			PurgeInterval:        time.Hour,
+			MaxRequestBodyBytes:  1 << 20,
+			MaxAuditQueryLimit:   1000,
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:        true,
+			Store:          "memory",
+			TrustedProxies: []string{},
+			Default:        RateLimitRule{PerMinute: 300, Burst: 100, Key: RateLimitByIP},
+			Signup:         RateLimitRule{PerMinute: 5, Burst: 5, Key: RateLimitByIP},
+			Login:          RateLimitRule{PerMinute: 10, Burst: 10, Key: RateLimitByIP},
+			Transfer:       RateLimitRule{PerMinute: 30, Burst: 10, Key: RateLimitByUser},
+		},
+		TransferLimits: TransferLimitsConfig{
+			Personal: TransferLimits{SingleMax: 5000, DailyAmount: 10000, MonthlyAmount: 50000, DailyCount: 20},
+			Business: TransferLimits{SingleMax: 100000, DailyAmount: 250000, MonthlyAmount: 2000000, DailyCount: 500},
+		},
+		Overdraft: OverdraftConfig{
+			InterestRate:   0.19,
+			UnarrangedFee:  25,
+			MaxLimit:       50000,
+			ChargeInterval: time.Hour,
+		},
+		Holds: HoldsConfig{
+			DefaultExpiry:  7 * 24 * time.Hour,
+			MaxExpiry:      30 * 24 * time.Hour,
+			ExpiryInterval: time.Minute,
+		},
+		Scheduler: SchedulerConfig{
+			Interval:         time.Minute,
+			BatchSize:        100,
+			MaxAttempts:      5,
+			RetryBackoff:     5 * time.Minute,
+			ExecutionTimeout: 30 * time.Second,
+			MaxDaysAhead:     365,
+		},
+		Calendar: CalendarConfig{
+			Country:  "GB",
+			TimeZone: "Europe/London",
+			Cutoff:   "16:00",
+			Cutoffs:  map[string]string{},
+		},
+		Interest: InterestConfig{
+			RunInterval: time.Hour,
+			CatchUpDays: 7,
+		},
+		Fees: FeesConfig{
+			MaintenanceInterval: time.Hour,
+		},
+		Currency: CurrencyConfig{
+			Default:      "GBP",
+			AmountScales: map[string]string{},
+		},
+		FX: FXConfig{
+			Spread:           0.005,
+			Spreads:          map[string]string{},
+			QuoteTTL:         30 * time.Second,
+			PositionAccounts: map[string]string{},
+		},
+		Features: FeaturesConfig{Metrics: true, PurgeJob: true, OverdraftJob: true, HoldExpiryJob: true, Scheduler: true, InterestJob: true, FeeJob: true},
+	}
+}
+
+// loadConfig builds the configuration from args (without the program name)
+// and the environment, and returns it with the remaining positional
+// arguments. The config file is taken from -config or GOBANK_CONFIG.
+func loadConfig(args []string, getenv func(string) string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("gobank", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("GOBANK_CONFIG"), "path to a YAML config file")
+	fields := configFields(cfg)
+	flagValues := map[string]string{}
+	for _, field := range fields {
+		fs.Var(&configFlag{field: field, values: flagValues}, field.path, "sets "+field.path)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading config file: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return nil, nil, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, field := range fields {
+		for _, name := range field.env {
+			if value := getenv(name); value != "" {
+				if err := setConfigValue(field.value, value); err != nil {
+					return nil, nil, fmt.Errorf("invalid %s: %w", name, err)
+				}
+				break
+			}
+		}
+		if value, ok := flagValues[field.path]; ok {
+			if err := setConfigValue(field.value, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid -%s: %w", field.path, err)
+			}
+		}
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr is required")
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"server.read_timeout", c.Server.ReadTimeout},
+		{"server.read_header_timeout", c.Server.ReadHeaderTimeout},
+		{"server.write_timeout", c.Server.WriteTimeout},
+		{"server.idle_timeout", c.Server.IdleTimeout},
+		{"server.request_timeout", c.Server.RequestTimeout},
+		{"server.shutdown_timeout", c.Server.ShutdownTimeout},
+	} {
+		check(t.d > 0, "%s must be positive", t.name)
+	}
+	check(c.Server.RequestTimeout <= c.Server.WriteTimeout, "server.request_timeout must not exceed server.write_timeout")
+
+	if tls := c.Server.TLS; tls.Enabled {
+		check(tls.CertFile != "" && tls.KeyFile != "", "server.tls.cert_file and server.tls.key_file are required when TLS is enabled")
+		check(tls.ReloadInterval > 0, "server.tls.reload_interval must be positive")
+		check(!tls.RequireClientCert || tls.ClientCAFile != "", "server.tls.require_client_cert needs server.tls.client_ca_file")
+		check(len(tls.ClientRoles) == 0 || tls.ClientCAFile != "", "server.tls.client_roles needs server.tls.client_ca_file")
+		for name, role := range tls.ClientRoles {
+			check(oneOf(role, RoleCustomer, RoleOperator, RoleAdmin, RoleAuditor), "server.tls.client_roles: unknown role %q for %q", role, name)
+		}
+	} else {
+		check(tls.ClientCAFile == "" && len(tls.ClientRoles) == 0, "client certificate settings need server.tls.enabled")
+	}
+
+	check(c.Database.Host != "", "database.host is required")
+	check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be between 1 and 65535")
+	check(c.Database.User != "", "database.user is required")
+	check(c.Database.Name != "", "database.name is required")
+	check(oneOf(c.Database.SSLMode, "disable", "require", "verify-ca", "verify-full"), "database.sslmode must be disable, require, verify-ca or verify-full")
+	check((c.Database.SSLCert == "") == (c.Database.SSLKey == ""), "database.sslcert and database.sslkey must be set together")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns must not be negative")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns must not be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "database.max_idle_conns must not exceed database.max_open_conns")
+
+	check(c.JWT.Secret != "", "jwt.secret is required")
+	check(c.JWT.TTL > 0, "jwt.ttl must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level must be debug, info, warn or error")
+	check(oneOf(c.Log.Format, "json", "text"), "log.format must be json or text")
+	check(oneOf(c.Tracing.Exporter, "none", "otlp", "stdout"), "tracing.exporter must be none, otlp or stdout")
+
+	check(c.Limits.DeletedRetentionDays > 0, "limits.deleted_retention_days must be positive")
+	check(c.Limits.PurgeInterval > 0, "limits.purge_interval must be positive")
+	check(c.Limits.MaxRequestBodyBytes > 0, "limits.max_request_body_bytes must be positive")
+	check(c.Limits.MaxAuditQueryLimit > 0, "limits.max_audit_query_limit must be positive")
+
+	check(c.TransferLimits.Personal.valid(), "transfer_limits.personal must not be negative")
+	check(c.TransferLimits.Business.valid(), "transfer_limits.business must not be negative")
+
+	check(c.Overdraft.InterestRate >= 0, "overdraft.interest_rate must not be negative")
+	check(c.Overdraft.UnarrangedFee >= 0, "overdraft.unarranged_fee must not be negative")
+	check(c.Overdraft.MaxLimit >= 0, "overdraft.max_limit must not be negative")
+	check(c.Overdraft.ChargeInterval > 0, "overdraft.charge_interval must be positive")
+
+	check(c.Holds.DefaultExpiry > 0, "holds.default_expiry must be positive")
+	check(c.Holds.MaxExpiry >= c.Holds.DefaultExpiry, "holds.max_expiry must not be less than holds.default_expiry")
+	check(c.Holds.ExpiryInterval > 0, "holds.expiry_interval must be positive")
+
+	check(c.Scheduler.Interval > 0, "scheduler.interval must be positive")
+	check(c.Scheduler.BatchSize > 0, "scheduler.batch_size must be positive")
+	check(c.Scheduler.MaxAttempts > 0, "scheduler.max_attempts must be positive")
+	check(c.Scheduler.RetryBackoff > 0, "scheduler.retry_backoff must be positive")
+	check(c.Scheduler.ExecutionTimeout > 0, "scheduler.execution_timeout must be positive")
+	check(c.Scheduler.MaxDaysAhead > 0, "scheduler.max_days_ahead must be positive")
+
+	check(len(c.Calendar.Country) == 2, "calendar.country must be a two-letter country code")
+	_, err := time.LoadLocation(c.Calendar.TimeZone)
+	check(err == nil, "calendar.time_zone must be a known time zone")
+	_, err = parseCutoff(c.Calendar.Cutoff)
+	check(err == nil, "calendar.cutoff must be a time of day as HH:MM")
+	cutoffsValid := true
+	for day, cutoff := range c.Calendar.Cutoffs {
+		_, known := parseWeekday(day)
+		_, err := parseCutoff(cutoff)
+		cutoffsValid = cutoffsValid && known && err == nil
+	}
+	check(cutoffsValid, "calendar.cutoffs must map weekday names to HH:MM times")
+	check(c.Interest.RunInterval > 0, "interest.run_interval must be positive")
+	check(c.Interest.CatchUpDays > 0, "interest.catch_up_days must be positive")
+	check(c.Fees.RevenueAccount >= 0, "fees.revenue_account must not be negative")
+	check(c.Fees.MaintenanceInterval > 0, "fees.maintenance_interval must be positive")
+	check(isCurrency(c.Currency.Default), "currency.default must be a supported ISO 4217 code")
+	scalesValid := true
+	for currency, value := range c.Currency.AmountScales {
+		scale, err := strconv.ParseFloat(value, 64)
+		scalesValid = scalesValid && isCurrency(currency) && err == nil && scale > 0
+	}
+	check(scalesValid, "currency.amount_scales must map currency codes to positive numbers")
+	check(c.FX.Spread >= 0 && c.FX.Spread < 1, "fx.spread must be between 0 and 1")
+	spreadsValid := true
+	for pair, value := range c.FX.Spreads {
+		_, _, known := parseCurrencyPair(pair)
+		spread, err := strconv.ParseFloat(value, 64)
+		spreadsValid = spreadsValid && known && err == nil && spread >= 0 && spread < 1
+	}
+	check(spreadsValid, "fx.spreads must map currency pairs like GBP/EUR to spreads between 0 and 1")
+	check(c.FX.QuoteTTL > 0, "fx.quote_ttl must be positive")
+	positionsValid := true
+	for currency, value := range c.FX.PositionAccounts {
+		number, err := strconv.ParseInt(value, 10, 64)
+		positionsValid = positionsValid && isCurrency(currency) && err == nil && number > 0
+	}
+	check(positionsValid, "fx.position_accounts must map currency codes to account numbers")
+
+	check(oneOf(c.RateLimit.Store, "memory"), "rate_limit.store must be memory")
+	proxiesValid := true
+	for _, cidr := range c.RateLimit.TrustedProxies {
+		_, err := netip.ParsePrefix(cidr)
+		proxiesValid = proxiesValid && err == nil
+	}
+	check(proxiesValid, "rate_limit.trusted_proxies must be CIDR ranges like 10.0.0.0/8")
+	for _, rule := range []struct {
+		name string
+		RateLimitRule
+	}{
+		{"default", c.RateLimit.Default},
+		{"signup", c.RateLimit.Signup},
+		{"login", c.RateLimit.Login},
+		{"transfer", c.RateLimit.Transfer},
+	} {
+		check(rule.PerMinute > 0, "rate_limit.%s.per_minute must be positive", rule.name)
+		check(rule.Burst > 0, "rate_limit.%s.burst must be positive", rule.name)
+		check(oneOf(rule.Key, RateLimitByIP, RateLimitByUser, RateLimitByAPIKey), "rate_limit.%s.key must be ip, user or api_key", rule.name)
+	}
+
+	return errors.Join(errs...)
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRedacted writes c as YAML with every secret that is set replaced by
+// a placeholder, so the output can be shared safely.
+func (c *Config) writeRedacted(w io.Writer) error {
+	out := *c
+	for _, field := range configFields(&out) {
+		if field.secret && field.value.String() != "" {
+			field.value.SetString(redacted)
+		}
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&out); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// configField is one leaf setting of Config.
+type configField struct {
+	path   string
+	env    []string
+	secret bool
+	value  reflect.Value
+}
+
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			path := sf.Tag.Get("yaml")
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			if sf.Type.Kind() == reflect.Struct {
+				walk(path, v.Field(i))
+				continue
+			}
+			field := configField{path: path, secret: sf.Tag.Get("secret") == "true", value: v.Field(i)}
+			if env := sf.Tag.Get("env"); env != "" {
+				field.env = strings.Split(env, ",")
+			}
+			fields = append(fields, field)
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return fields
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		m := map[string]string{}
+		for _, pair := range strings.Split(s, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || key == "" {
+				return fmt.Errorf("expected name=value pairs, got %q", pair)
+			}
+			m[key] = value
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// configFlag records a flag's raw value so it can be applied after the
+// file and environment, whatever the order of parsing.
+type configFlag struct {
+	field  configField
+	values map[string]string
+}
+
+func (f *configFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.field.path]
+}
+
+func (f *configFlag) Set(s string) error {
+	if err := setConfigValue(reflect.New(f.field.value.Type()).Elem(), s); err != nil {
+		return err
+	}
+	f.values[f.field.path] = s
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.field.value.Kind() == reflect.Bool
+}
+
+// runConfigCommand implements `gobank config print`.
+func runConfigCommand(cfg *Config, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 || args[0] != "print" {
+		fmt.Fprintln(stderr, "usage: gobank [flags] config print")
+		return 2
+	}
+
+	if err := cfg.writeRedacted(stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(stderr, "configuration is invalid:\n%v\n", err)
+		return 1
+	}
+	return 0
+}
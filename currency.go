@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// currencyMinorUnits lists the ISO 4217 currencies accounts may be held in
+// with the number of decimal places each one's minor unit has. Amounts are
+// stored with two decimal places, so currencies with three are not offered.
+var currencyMinorUnits = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"CZK": 2,
+	"DKK": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"HUF": 2,
+	"ISK": 0,
+	"JPY": 0,
+	"KRW": 0,
+	"NOK": 2,
+	"NZD": 2,
+	"PLN": 2,
+	"SEK": 2,
+	"SGD": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+func isCurrency(code string) bool {
+	_, ok := currencyMinorUnits[code]
+	return ok
+}
+
+// roundMinor rounds amount to the currency's minor unit, e.g. to the cent
+// for EUR or to whole yen.
+func roundMinor(amount float64, currency string) float64 {
+	scale := math.Pow10(currencyMinorUnits[currency])
+	return math.Round(amount*scale) / scale
+}
+
+// validAmount reports whether amount can be expressed in the currency's
+// minor unit without rounding.
+func validAmount(amount float64, currency string) bool {
+	return math.Abs(roundMinor(amount, currency)-amount) < 1e-9
+}
+
+// amountScale returns what one unit of the default currency is worth in
+// currency, for sizing configured amounts, and false if currency has no
+// scale and so cannot be used.
+func (c CurrencyConfig) amountScale(currency string) (float64, bool) {
+	if currency == c.Default {
+		return 1, true
+	}
+	scale, err := strconv.ParseFloat(c.AmountScales[currency], 64)
+	return scale, err == nil && scale > 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestRoundMinor(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{12.345, "GBP", 12.35},
+		{12.344, "GBP", 12.34},
+		{0.1 + 0.2, "EUR", 0.3},
+		{-7.125, "USD", -7.13},
+		{1234.5, "JPY", 1235},
+		{1234.49, "JPY", 1234},
+		{99.9, "ISK", 100},
+		{1e9 + 0.005, "GBP", 1000000000.01},
+	}
+	for _, tt := range tests {
+		if got := roundMinor(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("roundMinor(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestValidAmount(t *testing.T) {
+	tests := []struct {
+		amount   float64
+		currency string
+		want     bool
+	}{
+		{12.34, "GBP", true},
+		{12.3, "GBP", true},
+		{12, "GBP", true},
+		{12.345, "GBP", false},
+		{0.1 + 0.2, "GBP", true},
+		{1234, "JPY", true},
+		{1234.5, "JPY", false},
+		{0.01, "KRW", false},
+		{-5.25, "EUR", true},
+	}
+	for _, tt := range tests {
+		if got := validAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("validAmount(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestCurrencyAmountScale(t *testing.T) {
+	cfg := CurrencyConfig{Default: "GBP", AmountScales: map[string]string{"EUR": "1.15", "JPY": "190", "USD": "0", "CHF": "x"}}
+	tests := []struct {
+		currency string
+		want     float64
+		ok       bool
+	}{
+		{"GBP", 1, true},
+		{"EUR", 1.15, true},
+		{"JPY", 190, true},
+		{"USD", 0, false},
+		{"CHF", 0, false},
+		{"SEK", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := cfg.amountScale(tt.currency)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("amountScale(%s) = %v, %v; want %v, %v", tt.currency, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fee events. A transfer_out fee is charged with each outbound transfer,
+// an overdraft fee on each day the overdraft job charges an account, and a
+// monthly_maintenance fee once per calendar month.
+const (
+	FeeTransferOut        = "transfer_out"
+	FeeOverdraft          = "overdraft"
+	FeeMonthlyMaintenance = "monthly_maintenance"
+)
+
+// Fee methods.
+const (
+	FeeFlat       = "flat"
+	FeePercentage = "percentage"
+	FeeTiered     = "tiered"
+)
+
+// FeeTier applies from MinAmount of the charged base upwards: the fee is
+// Amount plus Rate times the whole base.
+type FeeTier struct {
+	MinAmount float64 `json:"min_amount"`
+	Amount    float64 `json:"amount"`
+	Rate      float64 `json:"rate"`
+}
+
+// FeeRule prices one event for one account type. Amount is used by flat
+// rules, Rate by percentage rules and Tiers by tiered rules; the result is
+// then held between MinFee and MaxFee, where a zero MaxFee means no cap.
+// Amounts are in the fee revenue account's currency, the only currency fees
+// are taken in. Only active accounts are charged unless ChargeInactive is
+// set.
+type FeeRule struct {
+	ID             int       `json:"id"`
+	AccountType    string    `json:"account_type"`
+	Event          string    `json:"event"`
+	Method         string    `json:"method"`
+	Amount         float64   `json:"amount,omitempty"`
+	Rate           float64   `json:"rate,omitempty"`
+	Tiers          []FeeTier `json:"tiers,omitempty"`
+	MinFee         float64   `json:"min_fee"`
+	MaxFee         float64   `json:"max_fee"`
+	ChargeInactive bool      `json:"charge_inactive"`
+	UpdatedBy      string    `json:"updated_by"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (r *FeeRule) valid() bool {
+	if !oneOf(r.AccountType, AccountTypePersonal, AccountTypeBusiness, AccountTypeSavings) {
+		return false
+	}
+	if !oneOf(r.Event, FeeTransferOut, FeeOverdraft, FeeMonthlyMaintenance) {
+		return false
+	}
+	if r.MinFee < 0 || r.MaxFee < 0 || (r.MaxFee > 0 && r.MaxFee < r.MinFee) {
+		return false
+	}
+
+	switch r.Method {
+	case FeeFlat:
+		return r.Amount > 0 && r.Rate == 0 && len(r.Tiers) == 0
+	case FeePercentage:
+		return r.Rate > 0 && r.Rate < 1 && r.Amount == 0 && len(r.Tiers) == 0
+	case FeeTiered:
+		if len(r.Tiers) == 0 || r.Amount != 0 || r.Rate != 0 {
+			return false
+		}
+		for i, tier := range r.Tiers {
+			if tier.MinAmount < 0 || tier.Amount < 0 || tier.Rate < 0 || tier.Rate >= 1 {
+				return false
+			}
+			if i > 0 && tier.MinAmount <= r.Tiers[i-1].MinAmount {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// fee prices the rule for base, the transfer amount, overdrawn amount or
+// balance depending on the event, in the currency's minor unit.
+func (r *FeeRule) fee(base float64, currency string) float64 {
+	var fee float64
+	switch r.Method {
+	case FeeFlat:
+		fee = r.Amount
+	case FeePercentage:
+		fee = base * r.Rate
+	case FeeTiered:
+		for _, tier := range r.Tiers {
+			if base < tier.MinAmount {
+				break
+			}
+			fee = tier.Amount + base*tier.Rate
+		}
+	}
+
+	fee = max(fee, r.MinFee)
+	if r.MaxFee > 0 {
+		fee = min(fee, r.MaxFee)
+	}
+	return roundMinor(fee, currency)
+}
+
+// capFee limits a fee taken by a batch job to what the account can pay,
+// its available balance plus any arranged overdraft, so that fees never
+// push an account into an unarranged overdraft. It returns nil when the
+// account can pay nothing.
+func capFee(fee *FeeCharge, available float64, currency string) *FeeCharge {
+	if fee == nil {
+		return nil
+	}
+	scale := math.Pow10(currencyMinorUnits[currency])
+	available = math.Floor(available*scale+1e-9) / scale
+	if available <= 0 {
+		return nil
+	}
+	fee.Amount = min(fee.Amount, available)
+	return fee
+}
+
+func feeDescription(event string) string {
+	switch event {
+	case FeeTransferOut:
+		return "Transfer fee"
+	case FeeOverdraft:
+		return "Overdraft fee"
+	case FeeMonthlyMaintenance:
+		return "Monthly maintenance fee"
+	}
+	return "Fee"
+}
+
+// FeeCharge is a fee taken from an account and paid to RevenueAccount.
+// Periodic fees carry the Period they were charged for, which keeps them
+// from being charged twice. A waived fee has been refunded.
+type FeeCharge struct {
+	ID             int        `json:"id"`
+	AccountID      int        `json:"account_id"`
+	RuleID         int        `json:"rule_id"`
+	Event          string     `json:"event"`
+	BaseAmount     float64    `json:"base_amount"`
+	Amount         float64    `json:"amount"`
+	Period         *string    `json:"period,omitempty"`
+	RevenueAccount int64      `json:"revenue_account"`
+	WaivedBy       *string    `json:"waived_by,omitempty"`
+	WaiverReason   string     `json:"waiver_reason,omitempty"`
+	WaivedAt       *time.Time `json:"waived_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// FeeRun summarises one pass of the maintenance fee job.
+type FeeRun struct {
+	Period   string  `json:"period"`
+	Accounts int     `json:"accounts"`
+	Amount   float64 `json:"amount"`
+	Failed   int     `json:"failed"`
+}
+
+func (s *APIServer) handleListFeeRules(w http.ResponseWriter, r *http.Request) error {
+	rules, err := s.storageFor(r).listFeeRules(r.Context())
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, rules)
+}
+
+// handleSetFeeRule creates or replaces the rule for an account type and
+// event.
+func (s *APIServer) handleSetFeeRule(w http.ResponseWriter, r *http.Request) error {
+	actor, ok := actorFromRequest(r)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Unknown caller")
+	}
+
+	rule := new(FeeRule)
+	if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	rule.AccountType, rule.Event = mux.Vars(r)["account_type"], mux.Vars(r)["event"]
+	if !rule.valid() {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid fee rule")
+	}
+
+	rule.UpdatedBy = actor
+	if err := s.storageFor(r).setFeeRule(r.Context(), rule); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, rule)
+}
+
+func (s *APIServer) handleDeleteFeeRule(w http.ResponseWriter, r *http.Request) error {
+	vars := mux.Vars(r)
+	if err := s.storageFor(r).deleteFeeRule(r.Context(), vars["account_type"], vars["event"]); err != nil {
+		if err.Error() == "fee rule not found" {
+			return writeAPIError(w, http.StatusNotFound, "Fee rule not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "Fee rule deleted"})
+}
+
+func (s *APIServer) handleListFees(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(w, r)
+	if account == nil {
+		return err
+	}
+
+	fees, err := s.storageFor(r).listFees(r.Context(), account.ID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, fees)
+}
+
+type waiveFeeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// handleWaiveFee refunds a fee to the account it was taken from.
+func (s *APIServer) handleWaiveFee(w http.ResponseWriter, r *http.Request) error {
+	actor, ok := actorFromRequest(r)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Unknown caller")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid fee ID")
+	}
+
+	req := new(waiveFeeRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if req.Reason == "" {
+		return writeAPIError(w, http.StatusBadRequest, "A reason is required")
+	}
+
+	if err := s.storageFor(r).waiveFee(r.Context(), id, actor, req.Reason); err != nil {
+		switch err.Error() {
+		case "fee not found":
+			return writeAPIError(w, http.StatusNotFound, "Fee not found")
+		case "fee already waived":
+			return writeAPIError(w, http.StatusConflict, "The fee has already been waived")
+		case "account is closed":
+			return writeAPIError(w, http.StatusConflict, "The account is closed")
+		case "fee revenue account not found":
+			return writeAPIError(w, http.StatusConflict, "The fee revenue account cannot refund this fee")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	fee, err := s.storageFor(r).getFee(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, fee)
+}
+
+// previousMonth returns the first day of the month before today's.
+func previousMonth(today time.Time) time.Time {
+	return time.Date(today.Year(), today.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// runFeeJob charges the monthly maintenance fee for the previous month
+// every interval until ctx is cancelled. Each account is charged once per
+// month however often it runs.
+func runFeeJob(ctx context.Context, logger *slog.Logger, store Storage, interval time.Duration, cal *Calendar) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := store.chargeMaintenanceFees(ctx, previousMonth(cal.today()))
+		if err != nil {
+			logger.Error("Error charging maintenance fees", "error", err)
+		}
+		if result != nil && result.Accounts > 0 {
+			logger.Info("Charged maintenance fees", "period", result.Period, "accounts", result.Accounts, "amount", result.Amount)
+		}
+	}
+}
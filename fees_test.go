@@ -0,0 +1,105 @@
+package main
+
+import "testing"
+
+func TestFeeRuleFee(t *testing.T) {
+	tiers := []FeeTier{
+		{MinAmount: 0, Amount: 1},
+		{MinAmount: 1000, Rate: 0.002},
+		{MinAmount: 10000, Amount: 5, Rate: 0.001},
+	}
+	tests := []struct {
+		name     string
+		rule     FeeRule
+		base     float64
+		currency string
+		want     float64
+	}{
+		{"flat", FeeRule{Method: FeeFlat, Amount: 2.5}, 100, "GBP", 2.5},
+		{"percentage", FeeRule{Method: FeePercentage, Rate: 0.01}, 123.45, "GBP", 1.23},
+		{"percentage rounds half up", FeeRule{Method: FeePercentage, Rate: 0.01}, 150.5, "GBP", 1.51},
+		{"percentage below the minimum", FeeRule{Method: FeePercentage, Rate: 0.01, MinFee: 2}, 50, "GBP", 2},
+		{"percentage above the maximum", FeeRule{Method: FeePercentage, Rate: 0.01, MaxFee: 10}, 5000, "GBP", 10},
+		{"percentage between the caps", FeeRule{Method: FeePercentage, Rate: 0.01, MinFee: 2, MaxFee: 10}, 500, "GBP", 5},
+		{"percentage in yen", FeeRule{Method: FeePercentage, Rate: 0.015}, 1234, "JPY", 19},
+		{"first tier", FeeRule{Method: FeeTiered, Tiers: tiers}, 500, "GBP", 1},
+		{"second tier from its minimum", FeeRule{Method: FeeTiered, Tiers: tiers}, 1000, "GBP", 2},
+		{"second tier", FeeRule{Method: FeeTiered, Tiers: tiers}, 5000, "GBP", 10},
+		{"third tier", FeeRule{Method: FeeTiered, Tiers: tiers}, 20000, "GBP", 25},
+		{"tier above the maximum", FeeRule{Method: FeeTiered, Tiers: tiers, MaxFee: 20}, 20000, "GBP", 20},
+		{"below the first tier", FeeRule{Method: FeeTiered, Tiers: []FeeTier{{MinAmount: 100, Amount: 3}}}, 50, "GBP", 0},
+		{"below the first tier with a minimum", FeeRule{Method: FeeTiered, Tiers: []FeeTier{{MinAmount: 100, Amount: 3}}, MinFee: 0.5}, 50, "GBP", 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.fee(tt.base, tt.currency); got != tt.want {
+				t.Errorf("fee(%v, %s) = %v, want %v", tt.base, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapFee(t *testing.T) {
+	tests := []struct {
+		name      string
+		fee       float64
+		available float64
+		currency  string
+		want      float64 // 0 means no fee
+	}{
+		{"covered", 5, 10, "GBP", 5},
+		{"exactly covered", 5, 5, "GBP", 5},
+		{"capped to whole pence", 5, 3.456, "GBP", 3.45},
+		{"capped to whole yen", 500, 12.7, "JPY", 12},
+		{"nothing available", 5, 0, "GBP", 0},
+		{"less than a penny available", 5, 0.004, "GBP", 0},
+		{"overdrawn", 5, -20, "GBP", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := capFee(&FeeCharge{Amount: tt.fee}, tt.available, tt.currency)
+			switch {
+			case tt.want == 0 && got != nil:
+				t.Errorf("capFee(%v, %v) = %v, want no fee", tt.fee, tt.available, got.Amount)
+			case tt.want != 0 && (got == nil || got.Amount != tt.want):
+				t.Errorf("capFee(%v, %v) = %v, want %v", tt.fee, tt.available, got, tt.want)
+			}
+		})
+	}
+	if capFee(nil, 10, "GBP") != nil {
+		t.Error("capFee(nil) returned a fee")
+	}
+}
+
+func TestFeeRuleValid(t *testing.T) {
+	base := FeeRule{AccountType: AccountTypePersonal, Event: FeeTransferOut}
+	with := func(change func(*FeeRule)) FeeRule {
+		rule := base
+		change(&rule)
+		return rule
+	}
+	tests := []struct {
+		name string
+		rule FeeRule
+		want bool
+	}{
+		{"flat", with(func(r *FeeRule) { r.Method, r.Amount = FeeFlat, 1 }), true},
+		{"flat without an amount", with(func(r *FeeRule) { r.Method = FeeFlat }), false},
+		{"percentage of 100%", with(func(r *FeeRule) { r.Method, r.Rate = FeePercentage, 1 }), false},
+		{"maximum below minimum", with(func(r *FeeRule) { r.Method, r.Amount, r.MinFee, r.MaxFee = FeeFlat, 1, 5, 2 }), false},
+		{"tiers in order", with(func(r *FeeRule) {
+			r.Method, r.Tiers = FeeTiered, []FeeTier{{MinAmount: 0, Amount: 1}, {MinAmount: 100, Rate: 0.01}}
+		}), true},
+		{"tiers out of order", with(func(r *FeeRule) {
+			r.Method, r.Tiers = FeeTiered, []FeeTier{{MinAmount: 100, Amount: 1}, {MinAmount: 100, Rate: 0.01}}
+		}), false},
+		{"unknown event", with(func(r *FeeRule) { r.Method, r.Amount, r.Event = FeeFlat, 1, "login" }), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.valid(); got != tt.want {
+				t.Errorf("valid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
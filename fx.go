@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Where an FX rate came from.
+const (
+	FXSourceFile  = "file"
+	FXSourceAdmin = "admin"
+)
+
+// FXRate is the mid-market rate for a currency pair: one unit of Base buys
+// Rate units of Quote. The rate also prices the pair the other way round.
+type FXRate struct {
+	Base      string    `json:"base"`
+	Quote     string    `json:"quote"`
+	Rate      float64   `json:"rate"`
+	Source    string    `json:"source"`
+	UpdatedBy *string   `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (r *FXRate) valid() bool {
+	return isCurrency(r.Base) && isCurrency(r.Quote) && r.Base != r.Quote && r.Rate > 0
+}
+
+// loadFXRates reads a rates file: one "BASE QUOTE RATE" per line, e.g.
+// "GBP EUR 1.1650", with blank lines and lines starting with # ignored.
+func loadFXRates(path string) ([]*FXRate, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading fx rates: %w", err)
+	}
+	defer f.Close()
+
+	rates := []*FXRate{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want BASE QUOTE RATE", path, line)
+		}
+		rate := &FXRate{Base: fields[0], Quote: fields[1], Source: FXSourceFile}
+		rate.Rate, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil || !rate.valid() {
+			return nil, fmt.Errorf("%s:%d: invalid rate %q", path, line, text)
+		}
+		rates = append(rates, rate)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("loading fx rates: %w", err)
+	}
+	return rates, nil
+}
+
+// parseCurrencyPair splits a "GBP/EUR" pair into its two currencies.
+func parseCurrencyPair(pair string) (string, string, bool) {
+	from, to, ok := strings.Cut(pair, "/")
+	return from, to, ok && isCurrency(from) && isCurrency(to) && from != to
+}
+
+// spread returns the margin taken off the mid-market rate when converting
+// from one currency to another.
+func (c FXConfig) spread(from, to string) float64 {
+	if value, ok := c.Spreads[from+"/"+to]; ok {
+		if spread, err := strconv.ParseFloat(value, 64); err == nil {
+			return spread
+		}
+	}
+	return c.Spread
+}
+
+// positionAccount returns the number of the bank's position account in
+// currency, or 0 if it has none.
+func (c FXConfig) positionAccount(currency string) int64 {
+	number, _ := strconv.ParseInt(c.PositionAccounts[currency], 10, 64)
+	return number
+}
+
+// roundRate keeps customer rates at the precision they are stored with, so
+// the recorded rate reproduces the converted amount.
+func roundRate(rate float64) float64 {
+	return math.Round(rate*1e8) / 1e8
+}
+
+// FXQuote offers to sell Amount of FromCurrency for ConvertedAmount of
+// ToCurrency. Rate is MidRate less Spread; it holds until ExpiresAt and
+// can be used by one transfer.
+type FXQuote struct {
+	ID              int        `json:"id"`
+	UserID          int        `json:"user_id"`
+	FromCurrency    string     `json:"from_currency"`
+	ToCurrency      string     `json:"to_currency"`
+	Amount          float64    `json:"amount"`
+	MidRate         float64    `json:"mid_rate"`
+	Spread          float64    `json:"spread"`
+	Rate            float64    `json:"rate"`
+	ConvertedAmount float64    `json:"converted_amount"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	UsedAt          *time.Time `json:"used_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+func (s *APIServer) handleListFXRates(w http.ResponseWriter, r *http.Request) error {
+	rates, err := s.storageFor(r).listFXRates(r.Context())
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, rates)
+}
+
+type setFXRateRequest struct {
+	Rate float64 `json:"rate"`
+}
+
+// handleSetFXRate creates or replaces the rate for a currency pair.
+// Outstanding quotes keep the rate they were given.
+func (s *APIServer) handleSetFXRate(w http.ResponseWriter, r *http.Request) error {
+	actor, ok := actorFromRequest(r)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Unknown caller")
+	}
+
+	req := new(setFXRateRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	vars := mux.Vars(r)
+	rate := &FXRate{Base: vars["base"], Quote: vars["quote"], Rate: req.Rate, Source: FXSourceAdmin, UpdatedBy: &actor}
+	if !rate.valid() {
+		return writeAPIError(w, http.StatusBadRequest, "A rate needs two different supported currencies and a positive rate")
+	}
+
+	if err := s.storageFor(r).setFXRates(r.Context(), []*FXRate{rate}); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, rate)
+}
+
+type createFXQuoteRequest struct {
+	FromCurrency string  `json:"from_currency"`
+	ToCurrency   string  `json:"to_currency"`
+	Amount       float64 `json:"amount"`
+}
+
+// handleCreateFXQuote locks in a rate for the caller. The quote is used by
+// passing its ID as quote_id on a transfer with convert set.
+func (s *APIServer) handleCreateFXQuote(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	req := new(createFXQuoteRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if !isCurrency(req.FromCurrency) || !isCurrency(req.ToCurrency) || req.FromCurrency == req.ToCurrency {
+		return writeAPIError(w, http.StatusBadRequest, "from_currency and to_currency must be two different supported currencies")
+	}
+	if req.Amount <= 0 {
+		return writeAPIError(w, http.StatusBadRequest, "Amount must be positive")
+	}
+	if !validAmount(req.Amount, req.FromCurrency) {
+		return writeAPIError(w, http.StatusBadRequest, "Amount has more decimal places than "+req.FromCurrency+" allows")
+	}
+
+	quote := &FXQuote{
+		UserID:       userID,
+		FromCurrency: req.FromCurrency,
+		ToCurrency:   req.ToCurrency,
+		Amount:       req.Amount,
+	}
+	if err := s.storageFor(r).createFXQuote(r.Context(), quote); err != nil {
+		switch err.Error() {
+		case "currency conversion is not available":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "Conversion between these currencies is not available")
+		case "fx rate not found":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "There is no rate for these currencies")
+		case "converted amount is too small":
+			return writeAPIError(w, http.StatusUnprocessableEntity, "The amount is too small to convert")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusCreated, quote)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestFXConfigSpread(t *testing.T) {
+	cfg := FXConfig{
+		Spread:  0.005,
+		Spreads: map[string]string{"GBP/EUR": "0.002", "EUR/GBP": "0.003", "USD/JPY": "not a number"},
+	}
+	tests := []struct {
+		from, to string
+		want     float64
+	}{
+		{"GBP", "EUR", 0.002},
+		{"EUR", "GBP", 0.003},
+		{"GBP", "USD", 0.005},
+		{"JPY", "USD", 0.005},
+		{"USD", "JPY", 0.005},
+	}
+	for _, tt := range tests {
+		if got := cfg.spread(tt.from, tt.to); got != tt.want {
+			t.Errorf("spread(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestParseCurrencyPair(t *testing.T) {
+	tests := []struct {
+		pair     string
+		from, to string
+		ok       bool
+	}{
+		{"GBP/EUR", "GBP", "EUR", true},
+		{"GBP/GBP", "GBP", "GBP", false},
+		{"GBP-EUR", "", "", false},
+		{"GBP/XXX", "GBP", "XXX", false},
+		{"gbp/eur", "gbp", "eur", false},
+	}
+	for _, tt := range tests {
+		from, to, ok := parseCurrencyPair(tt.pair)
+		if ok != tt.ok || (ok && (from != tt.from || to != tt.to)) {
+			t.Errorf("parseCurrencyPair(%q) = %s, %s, %v; want %s, %s, %v", tt.pair, from, to, ok, tt.from, tt.to, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Hold statuses. Only active holds reduce the available balance.
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+// Hold reserves funds on an account until they are captured, released or
+// the hold expires. A hold with a DestinationAccount settles as a transfer
+// to that account when captured.
+type Hold struct {
+	ID                 int       `json:"id"`
+	AccountID          int       `json:"account_id"`
+	Amount             float64   `json:"amount"`
+	CapturedAmount     float64   `json:"captured_amount"`
+	Status             string    `json:"status"`
+	Description        string    `json:"description"`
+	DestinationAccount int64     `json:"destination_account,omitempty"`
+	ExpiresAt          time.Time `json:"expires_at"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+func holdDescription(hold *Hold) string {
+	if hold.Description != "" {
+		return hold.Description
+	}
+	return "Hold " + strconv.Itoa(hold.ID) + " captured"
+}
+
+type placeHoldRequest struct {
+	Amount             float64 `json:"amount"`
+	Description        string  `json:"description"`
+	DestinationAccount int64   `json:"destination_account"`
+	// ExpiresIn is a Go duration such as "72h"; it defaults to
+	// holds.default_expiry.
+	ExpiresIn string `json:"expires_in"`
+}
+
+type captureHoldRequest struct {
+	// Amount defaults to the whole hold.
+	Amount *float64 `json:"amount"`
+}
+
+// writeHoldError maps hold storage errors to API responses.
+func writeHoldError(w http.ResponseWriter, err error) error {
+	switch err.Error() {
+	case "account not found":
+		return writeAPIError(w, http.StatusNotFound, "Account not found")
+	case "hold not found":
+		return writeAPIError(w, http.StatusNotFound, "Hold not found")
+	case "source account cannot be debited":
+		return writeAPIError(w, http.StatusConflict, "The account is not active for outgoing payments")
+	case "insufficient balance in the account":
+		return writeAPIError(w, http.StatusBadRequest, "Insufficient balance in the account")
+	case "hold is not active":
+		return writeAPIError(w, http.StatusConflict, "The hold has already been captured, released or expired")
+	case "hold has expired":
+		return writeAPIError(w, http.StatusConflict, "The hold has expired")
+	case "capture exceeds the held amount":
+		return writeAPIError(w, http.StatusBadRequest, "Capture amount exceeds the held amount")
+	case "destination account not found":
+		return writeAPIError(w, http.StatusNotFound, "Destination account not found")
+	case "destination account cannot be credited":
+		return writeAPIError(w, http.StatusConflict, "The destination account cannot receive transfers")
+	case "accounts are in different currencies":
+		return writeAPIError(w, http.StatusConflict, "The destination account is in a different currency")
+	case "amount is not valid in the account currency":
+		return writeAPIError(w, http.StatusBadRequest, "Amount has more decimal places than the account currency allows")
+	}
+	return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+func (s *APIServer) handlePlaceHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	req := new(placeHoldRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if req.Amount <= 0 {
+		return writeAPIError(w, http.StatusBadRequest, "Amount must be positive")
+	}
+	if req.DestinationAccount != 0 {
+		known, err := s.knownAccountNumber(r, req.DestinationAccount)
+		if err != nil {
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		if !known {
+			return writeAPIError(w, http.StatusBadRequest, "Invalid destination account number")
+		}
+	}
+
+	expiresIn := s.config.Holds.DefaultExpiry
+	if req.ExpiresIn != "" {
+		expiresIn, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 || expiresIn > s.config.Holds.MaxExpiry {
+			return writeAPIError(w, http.StatusBadRequest, "expires_in must be a duration up to "+s.config.Holds.MaxExpiry.String())
+		}
+	}
+
+	hold := &Hold{
+		AccountID:          id,
+		Amount:             req.Amount,
+		Description:        req.Description,
+		DestinationAccount: req.DestinationAccount,
+		ExpiresAt:          time.Now().Add(expiresIn),
+	}
+	if err := s.storageFor(r).placeHold(r.Context(), hold); err != nil {
+		return writeHoldError(w, err)
+	}
+
+	return writeJSON(w, http.StatusCreated, hold)
+}
+
+// handleListHolds shows the caller the holds on one of their own accounts.
+func (s *APIServer) handleListHolds(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(w, r)
+	if account == nil {
+		return err
+	}
+
+	holds, err := s.storageFor(r).listHolds(r.Context(), account.ID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, holds)
+}
+
+func (s *APIServer) handleCaptureHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid hold ID")
+	}
+
+	req := new(captureHoldRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+
+	hold, err := s.storageFor(r).getHold(r.Context(), id)
+	if err != nil {
+		return writeHoldError(w, err)
+	}
+	amount := hold.Amount
+	if req.Amount != nil {
+		if *req.Amount <= 0 {
+			return writeAPIError(w, http.StatusBadRequest, "Amount must be positive")
+		}
+		amount = *req.Amount
+	}
+
+	if err := s.storageFor(r).captureHold(r.Context(), id, amount); err != nil {
+		return writeHoldError(w, err)
+	}
+
+	hold, err = s.storageFor(r).getHold(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, hold)
+}
+
+func (s *APIServer) handleReleaseHold(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid hold ID")
+	}
+
+	if err := s.storageFor(r).releaseHold(r.Context(), id); err != nil {
+		return writeHoldError(w, err)
+	}
+
+	hold, err := s.storageFor(r).getHold(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, hold)
+}
+
+// runHoldExpiryJob releases expired holds every interval until ctx is
+// cancelled.
+func runHoldExpiryJob(ctx context.Context, logger *slog.Logger, store Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired, err := store.expireHolds(ctx)
+		if err != nil {
+			logger.Error("Error expiring holds", "error", err)
+			continue
+		}
+		if expired > 0 {
+			logger.Info("Expired holds", "holds", expired)
+		}
+	}
+}
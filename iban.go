@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ibanLengths is the total IBAN length per country from the ISO 13616
+// registry. It is used both to validate inbound IBANs and to size the BBANs
+// we issue.
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16,
+	"BG": 22, "BH": 22, "BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28,
+	"CZ": 24, "DE": 22, "DK": 18, "DO": 28, "EE": 20, "EG": 29, "ES": 24,
+	"FI": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23, "GL": 18,
+	"GR": 27, "GT": 28, "HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23,
+	"IS": 26, "IT": 27, "JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LC": 32,
+	"LI": 21, "LT": 20, "LU": 20, "LV": 21, "MC": 27, "MD": 24, "ME": 22,
+	"MK": 19, "MR": 27, "MT": 31, "MU": 30, "NL": 18, "NO": 15, "PK": 24,
+	"PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "SA": 24,
+	"SC": 31, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20,
+}
+
+// IBAN is a parsed, validated International Bank Account Number.
+type IBAN struct {
+	CountryCode string
+	CheckDigits string
+	BBAN        string
+}
+
+func (i IBAN) String() string {
+	return i.CountryCode + i.CheckDigits + i.BBAN
+}
+
+// parseIBAN normalises s (dropping spaces, upper-casing) and validates its
+// country, length, character set and mod-97 check digits.
+func parseIBAN(s string) (IBAN, error) {
+	s = strings.ToUpper(strings.ReplaceAll(s, " ", ""))
+	if len(s) < 5 {
+		return IBAN{}, fmt.Errorf("invalid IBAN")
+	}
+
+	length, ok := ibanLengths[s[:2]]
+	if !ok {
+		return IBAN{}, fmt.Errorf("unsupported IBAN country")
+	}
+	if len(s) != length {
+		return IBAN{}, fmt.Errorf("invalid IBAN length")
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') {
+			return IBAN{}, fmt.Errorf("invalid IBAN")
+		}
+	}
+	if ibanMod97(s[4:]+s[:4]) != 1 {
+		return IBAN{}, fmt.Errorf("invalid IBAN check digits")
+	}
+
+	return IBAN{CountryCode: s[:2], CheckDigits: s[2:4], BBAN: s[4:]}, nil
+}
+
+// ibanCheckDigits computes the two ISO 13616 check digits for a BBAN.
+func ibanCheckDigits(countryCode, bban string) string {
+	remainder := ibanMod97(bban + countryCode + "00")
+	return fmt.Sprintf("%02d", 98-remainder)
+}
+
+// ibanMod97 converts letters to numbers (A=10 ... Z=35) and returns the
+// resulting integer modulo 97.
+func ibanMod97(s string) int64 {
+	var digits strings.Builder
+	for _, c := range s {
+		if c >= 'A' && c <= 'Z' {
+			fmt.Fprintf(&digits, "%d", c-'A'+10)
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	if !ok {
+		return -1
+	}
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64()
+}
+
+// IBANIssuer derives the BBAN and IBAN of our own accounts. The BBAN is the
+// configured bank code followed by the account number, zero-padded to the
+// BBAN length of the configured country.
+type IBANIssuer struct {
+	countryCode   string
+	bankCode      string
+	accountDigits int
+}
+
+func newIBANIssuer(countryCode, bankCode string) (*IBANIssuer, error) {
+	countryCode = strings.ToUpper(countryCode)
+	bankCode = strings.ToUpper(bankCode)
+
+	length, ok := ibanLengths[countryCode]
+	if !ok {
+		return nil, fmt.Errorf("unsupported IBAN country %q", countryCode)
+	}
+
+	accountDigits := length - 4 - len(bankCode)
+	if accountDigits <= 0 {
+		return nil, fmt.Errorf("bank code %q is too long for %s IBANs", bankCode, countryCode)
+	}
+
+	return &IBANIssuer{
+		countryCode:   countryCode,
+		bankCode:      bankCode,
+		accountDigits: accountDigits,
+	}, nil
+}
+
+func (i *IBANIssuer) BBAN(accountNumber int64) (string, error) {
+	account := fmt.Sprintf("%0*d", i.accountDigits, accountNumber)
+	if len(account) > i.accountDigits {
+		return "", fmt.Errorf("account number %d does not fit a %s BBAN", accountNumber, i.countryCode)
+	}
+	return i.bankCode + account, nil
+}
+
+func (i *IBANIssuer) IBAN(accountNumber int64) (bban string, iban string, err error) {
+	bban, err = i.BBAN(accountNumber)
+	if err != nil {
+		return "", "", err
+	}
+	return bban, i.countryCode + ibanCheckDigits(i.countryCode, bban) + bban, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestIBANCheckDigits(t *testing.T) {
+	tests := []struct {
+		countryCode, bban string
+		want              string
+	}{
+		{"GB", "WEST12345698765432", "82"},
+		{"DE", "370400440532013000", "89"},
+		{"NL", "ABNA0417164300", "91"},
+		{"BE", "539007547034", "68"},
+		{"FR", "20041010050500013M02606", "14"},
+	}
+	for _, tt := range tests {
+		if got := ibanCheckDigits(tt.countryCode, tt.bban); got != tt.want {
+			t.Errorf("ibanCheckDigits(%q, %q) = %q, want %q", tt.countryCode, tt.bban, got, tt.want)
+		}
+	}
+}
+
+func TestParseIBAN(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{"valid", "GB82WEST12345698765432", "GB82WEST12345698765432", ""},
+		{"spaces and lower case", "gb82 west 1234 5698 7654 32", "GB82WEST12345698765432", ""},
+		{"letters in the BBAN", "FR1420041010050500013M02606", "FR1420041010050500013M02606", ""},
+		{"wrong check digits", "GB83WEST12345698765432", "", "invalid IBAN check digits"},
+		{"single digit typo", "GB82WEST12345698765433", "", "invalid IBAN check digits"},
+		{"wrong length", "GB82WEST1234569876543", "", "invalid IBAN length"},
+		{"unknown country", "ZZ82WEST12345698765432", "", "unsupported IBAN country"},
+		{"punctuation", "GB82-WEST1234569876543", "", "invalid IBAN"},
+		{"too short", "GB8", "", "invalid IBAN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iban, err := parseIBAN(tt.input)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseIBAN(%q) error = %v, want %q", tt.input, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIBAN(%q) error = %v", tt.input, err)
+			}
+			if iban.String() != tt.want {
+				t.Errorf("parseIBAN(%q) = %s, want %s", tt.input, iban, tt.want)
+			}
+		})
+	}
+}
+
+func TestIBANIssuer(t *testing.T) {
+	issuer, err := newIBANIssuer("gb", "west")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bban, iban, err := issuer.IBAN(12345698765432)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bban != "WEST12345698765432" || iban != "GB82WEST12345698765432" {
+		t.Errorf("IBAN(12345698765432) = %s, %s", bban, iban)
+	}
+	if _, err := parseIBAN(iban); err != nil {
+		t.Errorf("issued IBAN %s does not parse: %v", iban, err)
+	}
+
+	bban, _, err = issuer.IBAN(42)
+	if err != nil || bban != "WEST00000000000042" {
+		t.Errorf("IBAN(42) BBAN = %s, %v; want zero padding", bban, err)
+	}
+	if _, _, err := issuer.IBAN(123456987654321); err == nil {
+		t.Error("IBAN accepted an account number too long for the BBAN")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Day-count conventions. ACT/365 earns 1/365 of the annual rate every
+// calendar day; 30/360 treats every month as 30 days, so in a 31-day month
+// the 30th earns nothing (the 30th to the 31st counts as no days), the
+// 31st earns one day, and the last day of February makes up the missing
+// days.
+const (
+	DayCountACT365 = "ACT/365"
+	DayCount30360  = "30/360"
+)
+
+// InterestTier pays Rate a year on the part of the balance from MinBalance
+// up to the next tier's MinBalance.
+type InterestTier struct {
+	MinBalance float64 `json:"min_balance"`
+	Rate       float64 `json:"rate"`
+}
+
+// InterestProduct is a savings rate card. Products are not edited once
+// created; move accounts to a new product to change their rate.
+type InterestProduct struct {
+	ID        int            `json:"id"`
+	Name      string         `json:"name"`
+	DayCount  string         `json:"day_count"`
+	Tiers     []InterestTier `json:"tiers"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// valid reports whether the product has a known day count and tiers in
+// ascending order of balance with sensible rates.
+func (p *InterestProduct) valid() bool {
+	if p.Name == "" || len(p.Tiers) == 0 {
+		return false
+	}
+	if p.DayCount != DayCountACT365 && p.DayCount != DayCount30360 {
+		return false
+	}
+	for i, tier := range p.Tiers {
+		if tier.MinBalance < 0 || tier.Rate < 0 || tier.Rate >= 1 {
+			return false
+		}
+		if i > 0 && tier.MinBalance <= p.Tiers[i-1].MinBalance {
+			return false
+		}
+	}
+	return true
+}
+
+// dailyInterest returns what balance earns on date, unrounded. Each tier's
+// rate applies only to the band of the balance that falls within it.
+func (p *InterestProduct) dailyInterest(balance float64, date time.Time) float64 {
+	var annual float64
+	for i, tier := range p.Tiers {
+		if balance <= tier.MinBalance {
+			break
+		}
+		upper := balance
+		if i+1 < len(p.Tiers) && p.Tiers[i+1].MinBalance < balance {
+			upper = p.Tiers[i+1].MinBalance
+		}
+		annual += (upper - tier.MinBalance) * tier.Rate
+	}
+
+	next := date.AddDate(0, 0, 1)
+	if p.DayCount == DayCount30360 {
+		return roundAccrual(annual * float64(days30360(date, next)) / 360)
+	}
+	return roundAccrual(annual / 365)
+}
+
+// days30360 counts the days between two dates under the 30/360 bond basis.
+func days30360(from, to time.Time) int {
+	d1, d2 := from.Day(), to.Day()
+	if d1 == 31 {
+		d1 = 30
+	}
+	if d2 == 31 && d1 == 30 {
+		d2 = 30
+	}
+	return 360*(to.Year()-from.Year()) + 30*(int(to.Month())-int(from.Month())) + d2 - d1
+}
+
+// roundAccrual keeps accruals at the precision they are stored with, so a
+// re-run reports exactly what was recorded.
+func roundAccrual(amount float64) float64 {
+	return math.Round(amount*1e6) / 1e6
+}
+
+// splitCapitalisation splits the interest owed at a month end into the
+// whole minor units of currency paid now and the remainder carried to the
+// next month end.
+func splitCapitalisation(owed float64, currency string) (paid, carried float64) {
+	scale := math.Pow10(currencyMinorUnits[currency])
+	// owed has six decimal places; the nudge stops 0.3 becoming 0.29
+	paid = math.Floor(roundAccrual(owed)*scale+1e-7) / scale
+	return paid, roundAccrual(owed - paid)
+}
+
+// isMonthEnd reports whether interest is capitalised at the end of date.
+func isMonthEnd(date time.Time) bool {
+	return date.AddDate(0, 0, 1).Day() == 1
+}
+
+// InterestAccrual is one day's interest on one account.
+type InterestAccrual struct {
+	AccrualDate string  `json:"accrual_date"`
+	ProductID   int     `json:"product_id"`
+	Balance     float64 `json:"balance"`
+	Amount      float64 `json:"amount"`
+}
+
+// InterestSummary shows what an account has accrued since interest was
+// last capitalised. Carried is the part of earlier months' interest too
+// small to pay in the account's currency; it is included in Accrued.
+type InterestSummary struct {
+	AccountID          int                `json:"account_id"`
+	Product            *InterestProduct   `json:"product,omitempty"`
+	Accrued            float64            `json:"accrued"`
+	Accruals           []*InterestAccrual `json:"accruals"`
+	Carried            float64            `json:"carried"`
+	LastCapitalisedOn  *string            `json:"last_capitalised_on,omitempty"`
+	LastCapitalisation float64            `json:"last_capitalisation,omitempty"`
+}
+
+// InterestRun summarises one day of the interest batch.
+type InterestRun struct {
+	Date        string  `json:"date"`
+	Accounts    int     `json:"accounts"`
+	Accrued     float64 `json:"accrued"`
+	Capitalised int     `json:"capitalised"`
+	Posted      float64 `json:"posted"`
+	Failed      int     `json:"failed"`
+}
+
+func (s *APIServer) handleCreateInterestProduct(w http.ResponseWriter, r *http.Request) error {
+	product := new(InterestProduct)
+	if err := json.NewDecoder(r.Body).Decode(product); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if product.DayCount == "" {
+		product.DayCount = DayCountACT365
+	}
+	if !product.valid() {
+		return writeAPIError(w, http.StatusBadRequest, "A product needs a name, a day count of ACT/365 or 30/360, and tiers in ascending min_balance with rates between 0 and 1")
+	}
+
+	if err := s.storageFor(r).createInterestProduct(r.Context(), product); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusCreated, product)
+}
+
+func (s *APIServer) handleListInterestProducts(w http.ResponseWriter, r *http.Request) error {
+	products, err := s.storageFor(r).listInterestProducts(r.Context())
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, products)
+}
+
+type setInterestProductRequest struct {
+	// ProductID of zero stops the account earning interest.
+	ProductID int `json:"product_id"`
+}
+
+func (s *APIServer) handleSetInterestProduct(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	req := new(setInterestProductRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+
+	if err := s.storageFor(r).setAccountInterestProduct(r.Context(), id, req.ProductID); err != nil {
+		switch err.Error() {
+		case "account not found":
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		case "interest product not found":
+			return writeAPIError(w, http.StatusNotFound, "Interest product not found")
+		case "account is not a savings account":
+			return writeAPIError(w, http.StatusConflict, "Only savings accounts earn interest")
+		case "account is closed":
+			return writeAPIError(w, http.StatusConflict, "The account is closed")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, account)
+}
+
+func (s *APIServer) handleAccountInterest(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(w, r)
+	if account == nil {
+		return err
+	}
+
+	summary, err := s.storageFor(r).getInterestSummary(r.Context(), account.ID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, summary)
+}
+
+type runInterestRequest struct {
+	Date string `json:"date"`
+}
+
+// handleRunInterest accrues (and at month end capitalises) interest for a
+// past date. Accounts already done for that date are left alone, so it is
+// safe to repeat.
+func (s *APIServer) handleRunInterest(w http.ResponseWriter, r *http.Request) error {
+	req := new(runInterestRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	date, err := time.Parse(executeOnLayout, req.Date)
+	if err != nil || !date.Before(s.calendar.today()) {
+		return writeAPIError(w, http.StatusBadRequest, "date must be a date in YYYY-MM-DD format before today")
+	}
+
+	run, err := s.storageFor(r).runInterest(r.Context(), date)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, run)
+}
+
+// runInterestJob runs the interest batch for the last catchUpDays days,
+// oldest first, every interval until ctx is cancelled. A day only counts
+// once it is over, and days already run are skipped per account.
+func runInterestJob(ctx context.Context, logger *slog.Logger, store Storage, cfg InterestConfig, cal *Calendar) {
+	ticker := time.NewTicker(cfg.RunInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		today := cal.today()
+		for days := cfg.CatchUpDays; days >= 1; days-- {
+			run, err := store.runInterest(ctx, today.AddDate(0, 0, -days))
+			if run != nil && run.Accounts > 0 {
+				logger.Info("Ran interest", "date", run.Date, "accounts", run.Accounts, "accrued", run.Accrued, "capitalised", run.Capitalised, "posted", run.Posted)
+			}
+			if err != nil {
+				logger.Error("Error running interest", "error", err)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDays30360(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int
+	}{
+		{"ordinary day", date(2024, time.March, 14), date(2024, time.March, 15), 1},
+		{"30th to 31st", date(2024, time.January, 30), date(2024, time.January, 31), 0},
+		{"31st to 1st", date(2024, time.January, 31), date(2024, time.February, 1), 1},
+		{"29th to 30th", date(2024, time.January, 29), date(2024, time.January, 30), 1},
+		{"Feb 28 to Mar 1", date(2023, time.February, 28), date(2023, time.March, 1), 3},
+		{"Feb 28 to Feb 29 in a leap year", date(2024, time.February, 28), date(2024, time.February, 29), 1},
+		{"Feb 29 to Mar 1", date(2024, time.February, 29), date(2024, time.March, 1), 2},
+		{"whole month", date(2024, time.January, 1), date(2024, time.February, 1), 30},
+		{"whole year", date(2023, time.July, 31), date(2024, time.July, 31), 360},
+		{"year end", date(2023, time.December, 31), date(2024, time.January, 1), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := days30360(tt.from, tt.to); got != tt.want {
+				t.Errorf("days30360(%s, %s) = %d, want %d", tt.from.Format(executeOnLayout), tt.to.Format(executeOnLayout), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDays30360MonthsAddUpTo30(t *testing.T) {
+	for _, year := range []int{2023, 2024} {
+		for month := time.January; month <= time.December; month++ {
+			total := 0
+			for day := date(year, month, 1); day.Month() == month; day = day.AddDate(0, 0, 1) {
+				total += days30360(day, day.AddDate(0, 0, 1))
+			}
+			if total != 30 {
+				t.Errorf("%d-%02d accrues %d days, want 30", year, month, total)
+			}
+		}
+	}
+}
+
+func TestDailyInterest(t *testing.T) {
+	tiers := []InterestTier{{MinBalance: 0, Rate: 0.01}, {MinBalance: 1000, Rate: 0.02}}
+	act365 := &InterestProduct{DayCount: DayCountACT365, Tiers: tiers}
+	thirty360 := &InterestProduct{DayCount: DayCount30360, Tiers: tiers}
+
+	tests := []struct {
+		name    string
+		product *InterestProduct
+		balance float64
+		date    time.Time
+		want    float64
+	}{
+		{"zero balance", act365, 0, date(2024, time.March, 14), 0},
+		{"overdrawn", act365, -500, date(2024, time.March, 14), 0},
+		{"first band", act365, 500, date(2024, time.March, 14), 0.013699},
+		{"top of first band", act365, 1000, date(2024, time.March, 14), 0.027397},
+		{"across both bands", act365, 1500, date(2024, time.March, 14), 0.054795},
+		{"ACT/365 on the 31st", act365, 1500, date(2024, time.January, 31), 0.054795},
+		{"30/360 ordinary day", thirty360, 1500, date(2024, time.March, 14), 0.055556},
+		{"30/360 on the 30th of a 31-day month", thirty360, 1500, date(2024, time.January, 30), 0},
+		{"30/360 on the 31st", thirty360, 1500, date(2024, time.January, 31), 0.055556},
+		{"30/360 on Feb 28", thirty360, 1500, date(2023, time.February, 28), 0.166667},
+		{"30/360 on Feb 28 in a leap year", thirty360, 1500, date(2024, time.February, 28), 0.055556},
+		{"30/360 on Feb 29", thirty360, 1500, date(2024, time.February, 29), 0.111111},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.product.dailyInterest(tt.balance, tt.date); got != tt.want {
+				t.Errorf("dailyInterest(%v, %s) = %v, want %v", tt.balance, tt.date.Format(executeOnLayout), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitCapitalisation(t *testing.T) {
+	tests := []struct {
+		name          string
+		owed          float64
+		currency      string
+		paid, carried float64
+	}{
+		{"nothing owed", 0, "EUR", 0, 0},
+		{"less than a cent", 0.004999, "EUR", 0, 0.004999},
+		{"whole cents", 0.3, "EUR", 0.3, 0},
+		{"cents and a remainder", 1.678904, "EUR", 1.67, 0.008904},
+		{"just under the next cent", 2.999999, "EUR", 2.99, 0.009999},
+		{"whole yen", 12.345678, "JPY", 12, 0.345678},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paid, carried := splitCapitalisation(tt.owed, tt.currency)
+			if paid != tt.paid || carried != tt.carried {
+				t.Errorf("splitCapitalisation(%v, %s) = %v, %v, want %v, %v", tt.owed, tt.currency, paid, carried, tt.paid, tt.carried)
+			}
+		})
+	}
+}
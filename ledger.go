@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Ledger entry types. Amounts are signed: credits are positive, debits are
+// negative.
+const (
+	EntryDeposit     = "deposit"
+	EntryTransferIn  = "transfer_in"
+	EntryTransferOut = "transfer_out"
+	EntryAdjustment  = "adjustment"
+
+	EntryOverdraftInterest = "overdraft_interest"
+	EntryOverdraftFee      = "overdraft_fee"
+	EntryHoldCapture       = "hold_capture"
+	EntryInterest          = "interest"
+	EntryFee               = "fee"
+	EntryFeeRefund         = "fee_refund"
+	EntryFXConversion      = "fx_conversion"
+)
+
+type LedgerEntry struct {
+	ID                  int     `json:"id"`
+	AccountID           int     `json:"account_id"`
+	EntryType           string  `json:"entry_type"`
+	Amount              float64 `json:"amount"`
+	BalanceAfter        float64 `json:"balance_after"`
+	CounterpartyAccount int64   `json:"counterparty_account,omitempty"`
+	Description         string  `json:"description"`
+	// ValueDate is the business day the entry settles on.
+	ValueDate string    `json:"value_date"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Statement struct {
+	AccountID      int            `json:"account_id"`
+	AccountNumber  int64          `json:"account_number"`
+	IBAN           string         `json:"iban"`
+	Status         string         `json:"status"`
+	Currency       string         `json:"currency"`
+	OpeningBalance float64        `json:"opening_balance"`
+	ClosingBalance float64        `json:"closing_balance"`
+	Entries        []*LedgerEntry `json:"entries"`
+	GeneratedAt    time.Time      `json:"generated_at"`
+}
+
+func (s *APIServer) handleAccountStatement(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		if err.Error() == "account not found" {
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if account.UserID != userID {
+		return writeAPIError(w, http.StatusNotFound, "Account not found")
+	}
+
+	statement, err := s.storageFor(r).getStatement(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, statement)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	AccountPending = "pending"
+	AccountActive  = "active"
+	AccountFrozen  = "frozen"
+	AccountDormant = "dormant"
+	AccountClosed  = "closed"
+)
+
+// accountTransitions lists, for every status, the statuses an account may
+// move to next. Closed is terminal.
+var accountTransitions = map[string][]string{
+	AccountPending: {AccountActive, AccountClosed},
+	AccountActive:  {AccountFrozen, AccountDormant, AccountClosed},
+	AccountFrozen:  {AccountActive},
+	AccountDormant: {AccountActive, AccountFrozen, AccountClosed},
+	AccountClosed:  {},
+}
+
+func canTransition(from, to string) bool {
+	for _, next := range accountTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// activatePendingAccounts activates the accounts that were opened pending
+// while there was no way to activate them. It goes through the ordinary
+// status change so that each one gets a history row and an audit event.
+func activatePendingAccounts(ctx context.Context, logger *slog.Logger, store Storage) error {
+	ids, err := store.getPendingAccountIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := store.changeAccountStatus(ctx, id, AccountActive, "opened pending before accounts were activated on opening", "system:migration"); err != nil {
+			return fmt.Errorf("activating account %d: %w", id, err)
+		}
+	}
+	if len(ids) > 0 {
+		logger.Info("Activated pending accounts", "accounts", len(ids))
+	}
+	return nil
+}
+
+// canDebit reports whether money may leave an account in this status.
+// Frozen and dormant accounts keep receiving credits but cannot be debited.
+func canDebit(status string) bool {
+	return status == AccountActive
+}
+
+func canCredit(status string) bool {
+	return status == AccountActive || status == AccountFrozen || status == AccountDormant
+}
+
+type AccountStatusChange struct {
+	ID         int       `json:"id"`
+	AccountID  int       `json:"account_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason"`
+	ChangedBy  string    `json:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+type changeAccountStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type closeAccountResponse struct {
+	Account        *Account   `json:"account"`
+	FinalStatement *Statement `json:"final_statement"`
+}
+
+// writeStatusChangeError maps the errors returned by changeAccountStatus to
+// API responses.
+func writeStatusChangeError(w http.ResponseWriter, err error) error {
+	switch err.Error() {
+	case "account not found":
+		return writeAPIError(w, http.StatusNotFound, "Account not found")
+	case "invalid status transition":
+		return writeAPIError(w, http.StatusConflict, "Account cannot move to the requested status")
+	case "account balance must be zero to close":
+		return writeAPIError(w, http.StatusConflict, "Account balance must be zero to close")
+	case "account has active holds":
+		return writeAPIError(w, http.StatusConflict, "Account has active holds")
+	}
+	return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+// handleChangeAccountStatus lets operators activate, freeze, unfreeze, mark
+// dormant or close an account.
+func (s *APIServer) handleChangeAccountStatus(w http.ResponseWriter, r *http.Request) error {
+	actor, ok := actorFromRequest(r)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Unknown caller")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	req := new(changeAccountStatusRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if _, known := accountTransitions[req.Status]; !known {
+		return writeAPIError(w, http.StatusBadRequest, "Unknown account status")
+	}
+	if req.Reason == "" {
+		return writeAPIError(w, http.StatusBadRequest, "A reason is required")
+	}
+
+	if err := s.storageFor(r).changeAccountStatus(r.Context(), id, req.Status, req.Reason, actor); err != nil {
+		return writeStatusChangeError(w, err)
+	}
+
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, account)
+}
+
+// handleCloseAccount closes one of the caller's own accounts and returns its
+// final statement.
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		if err.Error() == "account not found" {
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if account.UserID != userID {
+		return writeAPIError(w, http.StatusNotFound, "Account not found")
+	}
+
+	if err := s.storageFor(r).changeAccountStatus(r.Context(), id, AccountClosed, "closed by customer", userActor(userID)); err != nil {
+		return writeStatusChangeError(w, err)
+	}
+
+	statement, err := s.storageFor(r).getStatement(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	account.Status = AccountClosed
+
+	return writeJSON(w, http.StatusOK, closeAccountResponse{Account: account, FinalStatement: statement})
+}
+
+func (s *APIServer) handleAccountStatusHistory(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	history, err := s.storageFor(r).getAccountStatusHistory(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, history)
+}
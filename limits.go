@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// TransferLimits caps outgoing transfers from an account. A zero value
+// leaves that limit off.
+type TransferLimits struct {
+	SingleMax     float64 `json:"single_max" yaml:"single_max"`
+	DailyAmount   float64 `json:"daily_amount" yaml:"daily_amount"`
+	MonthlyAmount float64 `json:"monthly_amount" yaml:"monthly_amount"`
+	DailyCount    int     `json:"daily_count" yaml:"daily_count"`
+}
+
+func (l TransferLimits) valid() bool {
+	return l.SingleMax >= 0 && l.DailyAmount >= 0 && l.MonthlyAmount >= 0 && l.DailyCount >= 0
+}
+
+// scaled converts limits set in the default currency to currency, where
+// one unit of the default is worth scale.
+func (l TransferLimits) scaled(scale float64, currency string) TransferLimits {
+	l.SingleMax = roundMinor(l.SingleMax*scale, currency)
+	l.DailyAmount = roundMinor(l.DailyAmount*scale, currency)
+	l.MonthlyAmount = roundMinor(l.MonthlyAmount*scale, currency)
+	return l
+}
+
+// TransferUsage is what an account has already sent today and this month
+// (calendar days and months in the database's time zone).
+type TransferUsage struct {
+	AmountToday     float64 `json:"amount_today"`
+	AmountThisMonth float64 `json:"amount_this_month"`
+	CountToday      int     `json:"count_today"`
+}
+
+// check reports the first limit that sending amount on top of used would
+// break.
+func (l TransferLimits) check(amount float64, used TransferUsage) error {
+	if l.SingleMax > 0 && amount > l.SingleMax {
+		return fmt.Errorf("transfer exceeds the single transaction limit")
+	}
+	if l.DailyCount > 0 && used.CountToday >= l.DailyCount {
+		return fmt.Errorf("daily transfer count exceeded")
+	}
+	if l.DailyAmount > 0 && used.AmountToday+amount > l.DailyAmount {
+		return fmt.Errorf("transfer exceeds the daily limit")
+	}
+	if l.MonthlyAmount > 0 && used.AmountThisMonth+amount > l.MonthlyAmount {
+		return fmt.Errorf("transfer exceeds the monthly limit")
+	}
+	return nil
+}
+
+// TransferRemaining is what is left of each limit; null means unlimited.
+// MaxTransfer is the largest single transfer the limits allow right now.
+type TransferRemaining struct {
+	DailyAmount   *float64 `json:"daily_amount"`
+	MonthlyAmount *float64 `json:"monthly_amount"`
+	DailyCount    *int     `json:"daily_count"`
+	MaxTransfer   *float64 `json:"max_transfer"`
+}
+
+func (l TransferLimits) remaining(used TransferUsage) TransferRemaining {
+	var r TransferRemaining
+	largest := math.Inf(1)
+	capAt := func(limit, spent float64) *float64 {
+		left := math.Max(0, limit-spent)
+		largest = math.Min(largest, left)
+		return &left
+	}
+
+	if l.DailyAmount > 0 {
+		r.DailyAmount = capAt(l.DailyAmount, used.AmountToday)
+	}
+	if l.MonthlyAmount > 0 {
+		r.MonthlyAmount = capAt(l.MonthlyAmount, used.AmountThisMonth)
+	}
+	if l.DailyCount > 0 {
+		left := l.DailyCount - used.CountToday
+		if left < 0 {
+			left = 0
+		}
+		r.DailyCount = &left
+		if left == 0 {
+			largest = 0
+		}
+	}
+	if l.SingleMax > 0 {
+		largest = math.Min(largest, l.SingleMax)
+	}
+	if !math.IsInf(largest, 1) {
+		r.MaxTransfer = &largest
+	}
+	return r
+}
+
+// TransferLimitOverride replaces some or all of the account-type defaults
+// for one user; nil fields keep the default. Amounts are in the default
+// currency, like the defaults they replace.
+type TransferLimitOverride struct {
+	UserID        int       `json:"user_id"`
+	SingleMax     *float64  `json:"single_max"`
+	DailyAmount   *float64  `json:"daily_amount"`
+	MonthlyAmount *float64  `json:"monthly_amount"`
+	DailyCount    *int      `json:"daily_count"`
+	Reason        string    `json:"reason"`
+	UpdatedBy     string    `json:"updated_by"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func (o *TransferLimitOverride) apply(l TransferLimits) TransferLimits {
+	if o.SingleMax != nil {
+		l.SingleMax = *o.SingleMax
+	}
+	if o.DailyAmount != nil {
+		l.DailyAmount = *o.DailyAmount
+	}
+	if o.MonthlyAmount != nil {
+		l.MonthlyAmount = *o.MonthlyAmount
+	}
+	if o.DailyCount != nil {
+		l.DailyCount = *o.DailyCount
+	}
+	return l
+}
+
+type TransferLimitStatus struct {
+	AccountID   int               `json:"account_id"`
+	AccountType string            `json:"account_type"`
+	Limits      TransferLimits    `json:"limits"`
+	Overridden  bool              `json:"overridden"`
+	Used        TransferUsage     `json:"used"`
+	Remaining   TransferRemaining `json:"remaining"`
+}
+
+func (s *APIServer) handleTransferLimits(w http.ResponseWriter, r *http.Request) error {
+	account, err := s.ownAccount(w, r)
+	if account == nil {
+		return err
+	}
+
+	status, err := s.storageFor(r).getTransferLimitStatus(r.Context(), account.ID)
+	if err != nil {
+		if err.Error() == "no transfer limits for this currency" {
+			return writeAPIError(w, http.StatusUnprocessableEntity, "Transfers are not available in this account's currency")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, status)
+}
+
+func (s *APIServer) handleGetTransferLimitOverride(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	override, err := s.storageFor(r).getTransferLimitOverride(r.Context(), id)
+	if err != nil {
+		if err.Error() == "transfer limit override not found" {
+			return writeAPIError(w, http.StatusNotFound, "This user has no transfer limit override")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, override)
+}
+
+func (s *APIServer) handleSetTransferLimitOverride(w http.ResponseWriter, r *http.Request) error {
+	actor, ok := actorFromRequest(r)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Unknown caller")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	override := new(TransferLimitOverride)
+	if err := json.NewDecoder(r.Body).Decode(override); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	for _, v := range []*float64{override.SingleMax, override.DailyAmount, override.MonthlyAmount} {
+		if v != nil && *v < 0 {
+			return writeAPIError(w, http.StatusBadRequest, "Limits must not be negative")
+		}
+	}
+	if override.DailyCount != nil && *override.DailyCount < 0 {
+		return writeAPIError(w, http.StatusBadRequest, "Limits must not be negative")
+	}
+	if override.Reason == "" {
+		return writeAPIError(w, http.StatusBadRequest, "A reason is required")
+	}
+
+	user, err := s.storageFor(r).getUserById(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if user == nil {
+		return writeAPIError(w, http.StatusNotFound, "User not found")
+	}
+
+	override.UserID = id
+	override.UpdatedBy = actor
+	if err := s.storageFor(r).setTransferLimitOverride(r.Context(), override); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, override)
+}
+
+func (s *APIServer) handleDeleteTransferLimitOverride(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if err := s.storageFor(r).deleteTransferLimitOverride(r.Context(), id); err != nil {
+		if err.Error() == "transfer limit override not found" {
+			return writeAPIError(w, http.StatusNotFound, "This user has no transfer limit override")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "Transfer limit override removed"})
+}
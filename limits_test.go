@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestTransferLimitsScaled(t *testing.T) {
+	limits := TransferLimits{SingleMax: 5000, DailyAmount: 10000.5, MonthlyAmount: 0, DailyCount: 20}
+	tests := []struct {
+		currency string
+		scale    float64
+		want     TransferLimits
+	}{
+		{"GBP", 1, limits},
+		{"EUR", 1.15, TransferLimits{SingleMax: 5750, DailyAmount: 11500.58, DailyCount: 20}},
+		{"JPY", 190.3, TransferLimits{SingleMax: 951500, DailyAmount: 1903095, DailyCount: 20}},
+	}
+	for _, tt := range tests {
+		if got := limits.scaled(tt.scale, tt.currency); got != tt.want {
+			t.Errorf("scaled(%v, %s) = %+v, want %+v", tt.scale, tt.currency, got, tt.want)
+		}
+	}
+}
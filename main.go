@@ -1,21 +1,190 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 func main() {
-	store, err := newPostgesStore()
+	cfg, args, err := loadConfig(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// `config print` must work even when the configuration is invalid
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(runConfigCommand(cfg, args[1:], os.Stdout, os.Stderr))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "configuration is invalid:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	logger, err := newLogger(os.Stdout, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		slog.Error("Invalid logging configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing.Exporter)
+	if err != nil {
+		fatal(logger, "Invalid tracing configuration", err)
+	}
+
+	accountNumbers := newLuhnAccountNumberScheme(12)
+
+	ibans, err := newIBANIssuer(cfg.IBAN.Country, cfg.IBAN.BankCode)
+	if err != nil {
+		fatal(logger, "Invalid IBAN configuration", err)
+	}
+
+	calendar, err := loadCalendar(cfg.Calendar)
+	if err != nil {
+		fatal(logger, "Invalid calendar configuration", err)
+	}
+
+	retention := time.Duration(cfg.Limits.DeletedRetentionDays) * 24 * time.Hour
+	store, err := newPostgesStore(logger, cfg.Database, accountNumbers, ibans, retention, cfg.TransferLimits, cfg.Overdraft, calendar, cfg.Fees, cfg.Currency, cfg.FX)
+	if err != nil {
+		fatal(logger, "Error connecting to database", err)
+	}
+
+	// verify-audit only reads, so it must not migrate or load anything first
+	if len(args) > 0 && args[0] == "verify-audit" {
+		os.Exit(runVerifyAuditCommand(logger, store))
 	}
 
 	if err := store.Init(); err != nil {
-		log.Fatal(err)
+		fatal(logger, "Error initialising database", err)
+	}
+	registerDBMetrics(store.db)
+
+	migrationStore := newAuditedStorage(store, logger, auditMeta{Actor: "system:migration"})
+	if err := activatePendingAccounts(context.Background(), logger, migrationStore); err != nil {
+		fatal(logger, "Error activating pending accounts", err)
+	}
+
+	if cfg.FX.RatesFile != "" {
+		rates, err := loadFXRates(cfg.FX.RatesFile)
+		if err != nil {
+			fatal(logger, "Invalid FX configuration", err)
+		}
+		fxStore := newAuditedStorage(store, logger, auditMeta{Actor: "system:fx"})
+		if err := fxStore.setFXRates(context.Background(), rates); err != nil {
+			fatal(logger, "Error loading FX rates", err)
+		}
+		logger.Info("Loaded FX rates", "file", cfg.FX.RatesFile, "rates", len(rates))
+	}
+
+	// SIGINT or SIGTERM cancels ctx, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// jobs tracks the background jobs so the store outlives their last tick
+	var jobs sync.WaitGroup
+	startJob := func(job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			job()
+		}()
+	}
+	if cfg.Features.PurgeJob {
+		startJob(func() {
+			runPurgeJob(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:purge"}), cfg.Limits.PurgeInterval)
+		})
+	}
+	if cfg.Features.OverdraftJob {
+		startJob(func() {
+			runOverdraftJob(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:overdraft"}), cfg.Overdraft.ChargeInterval)
+		})
+	}
+	if cfg.Features.HoldExpiryJob {
+		startJob(func() {
+			runHoldExpiryJob(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:holds"}), cfg.Holds.ExpiryInterval)
+		})
+	}
+	if cfg.Features.Scheduler {
+		startJob(func() {
+			runTransferScheduler(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:scheduler"}), cfg.Scheduler, calendar)
+		})
+	}
+	if cfg.Features.InterestJob {
+		startJob(func() {
+			runInterestJob(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:interest"}), cfg.Interest, calendar)
+		})
+	}
+	if cfg.Features.FeeJob {
+		startJob(func() {
+			runFeeJob(ctx, logger, newAuditedStorage(store, logger, auditMeta{Actor: "system:fees"}), cfg.Fees.MaintenanceInterval, calendar)
+		})
+	}
+
+	rateLimits, err := newRateLimitStore(cfg.RateLimit.Store)
+	if err != nil {
+		fatal(logger, "Invalid rate limit configuration", err)
 	}
 
 	// fmt.Printf("%+v\n", store)
-	server := newAPIServer(":8080", store)
-	server.setupRoutes()
-	server.run()
+	// run registers the routes itself
+	server := newAPIServer(logger, cfg, store, accountNumbers, rateLimits, calendar)
+	runErr := server.run(ctx)
+	if runErr != nil {
+		logger.Error("HTTP server error", "error", runErr)
+	}
+
+	// Stop the jobs too if the server failed on its own, and let a tick in
+	// progress finish before the pool goes away
+	stop()
+	if !waitTimeout(&jobs, cfg.Server.ShutdownTimeout) {
+		logger.Error("Background jobs did not stop in time", "timeout", cfg.Server.ShutdownTimeout)
+	}
+
+	// The server has drained and the jobs have stopped, so nothing uses the
+	// pool any more
+	if err := store.Close(); err != nil {
+		logger.Error("Error closing database", "error", err)
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Error("Error flushing traces", "error", err)
+	}
+
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
+
+// fatal logs err and exits the process.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// waitTimeout waits for wg for at most timeout and reports whether it
+// finished.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
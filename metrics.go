@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every metric exposed on /metrics. It is separate
+// from the Prometheus default registry so only our own metrics (plus the
+// standard Go and process collectors) are published.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gobank_http_requests_total",
+		Help: "HTTP requests processed, by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.With(metricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gobank_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route template and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	transfersTotal = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "gobank_transfers_total",
+		Help: "Transfers that completed successfully.",
+	})
+
+	transferVolume = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gobank_transfer_volume_total",
+		Help: "Total amount moved by successful transfers, by the currency it was sent in.",
+	}, []string{"currency"})
+
+	transferFailures = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gobank_transfer_failures_total",
+		Help: "Transfers that were rejected or failed, by reason.",
+	}, []string{"reason"})
+
+	loginAttempts = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gobank_login_attempts_total",
+		Help: "Login attempts, by result (success or failure).",
+	}, []string{"result"})
+
+	auditWriteFailures = promauto.With(metricsRegistry).NewCounter(prometheus.CounterOpts{
+		Name: "gobank_audit_write_failures_total",
+		Help: "Committed changes whose audit event could not be written. Alert on any increase.",
+	})
+
+	rateLimited = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gobank_rate_limited_total",
+		Help: "Requests rejected with 429, by rate limit policy.",
+	}, []string{"policy"})
+)
+
+// transferFailureReasons maps transferBalance errors to bounded label
+// values; anything else is reported as "internal".
+var transferFailureReasons = map[string]string{
+	"insufficient balance in the account":           "insufficient_funds",
+	"one or both accounts not found":                "account_not_found",
+	"cannot transfer to the same account":           "same_account",
+	"source account cannot be debited":              "source_not_active",
+	"destination account cannot be credited":        "destination_not_active",
+	"transfer exceeds the single transaction limit": "limit_exceeded",
+	"daily transfer count exceeded":                 "limit_exceeded",
+	"transfer exceeds the daily limit":              "limit_exceeded",
+	"transfer exceeds the monthly limit":            "limit_exceeded",
+	"accounts are in different currencies":          "currency_mismatch",
+	"no transfer limits for this currency":          "currency_unsupported",
+	"fx quote not found":                            "fx_quote_invalid",
+	"fx quote does not match the transfer":          "fx_quote_invalid",
+	"fx quote already used":                         "fx_quote_used",
+	"fx quote has expired":                          "fx_quote_expired",
+	"context canceled":                              "cancelled",
+	"context deadline exceeded":                     "timeout",
+}
+
+func observeTransfer(amount float64, currency string, err error) {
+	if err == nil {
+		transfersTotal.Inc()
+		transferVolume.WithLabelValues(currency).Add(amount)
+		return
+	}
+
+	reason, ok := transferFailureReasons[err.Error()]
+	if !ok {
+		reason = "internal"
+	}
+	transferFailures.WithLabelValues(reason).Inc()
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// registerDBMetrics exposes the connection pool statistics of db.
+func registerDBMetrics(db *sql.DB) {
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(db, "gobank"))
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// withMetrics records the count and latency of every request under its
+// route template.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeTemplate(r)
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Notification kinds.
+const (
+	NotificationTransferFailed = "transfer_failed"
+)
+
+// Notification is an in-app message to a customer about something that
+// happened on their accounts without them.
+type Notification struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Kind      string     `json:"kind"`
+	Message   string     `json:"message"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (s *APIServer) handleListNotifications(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	notifications, err := s.storageFor(r).listNotifications(r.Context(), userID, r.URL.Query().Get("unread") == "true")
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, notifications)
+}
+
+func (s *APIServer) handleReadNotification(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid notification ID")
+	}
+
+	if err := s.storageFor(r).markNotificationRead(r.Context(), id, userID); err != nil {
+		if err.Error() == "notification not found" {
+			return writeAPIError(w, http.StatusNotFound, "Notification not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "Notification marked as read"})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// OverdraftCharge is what one overdrawn account pays for one day.
+type OverdraftCharge struct {
+	Interest float64 `json:"interest"`
+	Fee      float64 `json:"fee"`
+}
+
+// OverdraftRun summarises one pass of the overdraft job.
+type OverdraftRun struct {
+	Accounts int     `json:"accounts"`
+	Interest float64 `json:"interest"`
+	Fees     float64 `json:"fees"`
+	Failed   int     `json:"failed"`
+}
+
+// charge returns a day's interest on balance and, when the account is
+// beyond its arranged limit, the unarranged-overdraft fee. It returns nil
+// for an account that owes nothing. Amounts are in the account's currency,
+// where one unit of the default currency is worth scale.
+func (c OverdraftConfig) charge(balance, limit, scale float64, currency string) *OverdraftCharge {
+	if balance >= 0 {
+		return nil
+	}
+	overdrawn := -balance
+
+	charge := &OverdraftCharge{Interest: roundMinor(overdrawn*c.InterestRate/365, currency)}
+	if overdrawn > limit {
+		charge.Fee = roundMinor(c.UnarrangedFee*scale, currency)
+	}
+	if charge.Interest == 0 && charge.Fee == 0 {
+		return nil
+	}
+	return charge
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+type setOverdraftRequest struct {
+	Limit float64 `json:"limit"`
+}
+
+// handleSetOverdraft arranges, changes or (with a zero limit) removes an
+// account's overdraft.
+func (s *APIServer) handleSetOverdraft(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	req := new(setOverdraftRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+
+	account, err := s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		if err.Error() == "account not found" {
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	scale, ok := s.config.Currency.amountScale(account.Currency)
+	if !ok {
+		return writeAPIError(w, http.StatusUnprocessableEntity, "Overdrafts are not available in "+account.Currency)
+	}
+	maxLimit := roundMinor(s.config.Overdraft.MaxLimit*scale, account.Currency)
+	if req.Limit < 0 || req.Limit > maxLimit {
+		return writeAPIError(w, http.StatusBadRequest, "Overdraft limit must be between 0 and "+strconv.FormatFloat(maxLimit, 'f', -1, 64))
+	}
+	if !validAmount(req.Limit, account.Currency) {
+		return writeAPIError(w, http.StatusBadRequest, "Overdraft limit has more decimal places than "+account.Currency+" allows")
+	}
+
+	if err := s.storageFor(r).setOverdraftLimit(r.Context(), id, req.Limit); err != nil {
+		switch err.Error() {
+		case "account not found":
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		case "account is closed":
+			return writeAPIError(w, http.StatusConflict, "The account is closed")
+		case "overdraft limit below overdrawn balance":
+			return writeAPIError(w, http.StatusConflict, "The account is overdrawn by more than the new limit")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	account, err = s.storageFor(r).getAccountById(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, account)
+}
+
+// runOverdraftJob charges overdraft interest and fees every interval until
+// ctx is cancelled. Accounts are charged once per day however often it runs.
+func runOverdraftJob(ctx context.Context, logger *slog.Logger, store Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := store.chargeOverdrafts(ctx)
+		if err != nil {
+			logger.Error("Error charging overdrafts", "error", err)
+		}
+		if result != nil && result.Accounts > 0 {
+			logger.Info("Charged overdrafts", "accounts", result.Accounts, "interest", result.Interest, "fees", result.Fees)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const dateOfBirthLayout = "2006-01-02"
+
+type CustomerProfile struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	FirstName    string     `json:"firstName"`
+	LastName     string     `json:"lastName"`
+	DateOfBirth  *time.Time `json:"dateOfBirth"`
+	AddressLine1 string     `json:"addressLine1"`
+	AddressLine2 string     `json:"addressLine2"`
+	City         string     `json:"city"`
+	PostalCode   string     `json:"postalCode"`
+	Country      string     `json:"country"`
+	Email        string     `json:"email"`
+	Phone        string     `json:"phone"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// profileRequest is used for both creating and patching a profile. On a
+// patch, empty fields leave the stored value untouched.
+type profileRequest struct {
+	FirstName    string `json:"firstName"`
+	LastName     string `json:"lastName"`
+	DateOfBirth  string `json:"dateOfBirth"`
+	AddressLine1 string `json:"addressLine1"`
+	AddressLine2 string `json:"addressLine2"`
+	City         string `json:"city"`
+	PostalCode   string `json:"postalCode"`
+	Country      string `json:"country"`
+	Email        string `json:"email"`
+	Phone        string `json:"phone"`
+}
+
+// ProfileHistoryEntry is a snapshot of a profile as it was before a change.
+type ProfileHistoryEntry struct {
+	ID        int             `json:"id"`
+	ProfileID int             `json:"profile_id"`
+	ChangedBy int             `json:"changed_by"`
+	ChangedAt time.Time       `json:"changed_at"`
+	Snapshot  json.RawMessage `json:"snapshot"`
+}
+
+func (p *CustomerProfile) apply(req *profileRequest) error {
+	if req.FirstName != "" {
+		p.FirstName = req.FirstName
+	}
+	if req.LastName != "" {
+		p.LastName = req.LastName
+	}
+	if req.DateOfBirth != "" {
+		dob, err := time.Parse(dateOfBirthLayout, req.DateOfBirth)
+		if err != nil {
+			return err
+		}
+		p.DateOfBirth = &dob
+	}
+	if req.AddressLine1 != "" {
+		p.AddressLine1 = req.AddressLine1
+	}
+	if req.AddressLine2 != "" {
+		p.AddressLine2 = req.AddressLine2
+	}
+	if req.City != "" {
+		p.City = req.City
+	}
+	if req.PostalCode != "" {
+		p.PostalCode = req.PostalCode
+	}
+	if req.Country != "" {
+		p.Country = req.Country
+	}
+	if req.Email != "" {
+		p.Email = req.Email
+	}
+	if req.Phone != "" {
+		p.Phone = req.Phone
+	}
+	return nil
+}
+
+func (s *APIServer) handleCreateProfile(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	req := new(profileRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+
+	// Legal name and date of birth are mandatory for a new customer
+	if req.FirstName == "" || req.LastName == "" || req.DateOfBirth == "" {
+		return writeAPIError(w, http.StatusBadRequest, "firstName, lastName and dateOfBirth are required")
+	}
+
+	profile := &CustomerProfile{UserID: userID}
+	if err := profile.apply(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "dateOfBirth must be formatted as YYYY-MM-DD")
+	}
+
+	if err := s.storageFor(r).createProfile(r.Context(), profile); err != nil {
+		if err.Error() == "profile already exists" {
+			return writeAPIError(w, http.StatusConflict, "A profile already exists for this user")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusCreated, profile)
+}
+
+func (s *APIServer) handleGetProfile(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	profile, err := s.storageFor(r).getProfileByUserId(r.Context(), userID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return writeAPIError(w, http.StatusNotFound, "Profile not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, profile)
+}
+
+func (s *APIServer) handleUpdateProfile(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	profile, err := s.storageFor(r).getProfileByUserId(r.Context(), userID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return writeAPIError(w, http.StatusNotFound, "Profile not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	req := new(profileRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if err := profile.apply(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "dateOfBirth must be formatted as YYYY-MM-DD")
+	}
+
+	// The storage layer snapshots the previous version into the history table
+	if err := s.storageFor(r).updateProfile(r.Context(), profile, userID); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, profile)
+}
+
+func (s *APIServer) handleProfileHistory(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	profile, err := s.storageFor(r).getProfileByUserId(r.Context(), userID)
+	if err != nil {
+		if err.Error() == "profile not found" {
+			return writeAPIError(w, http.StatusNotFound, "Profile not found")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	history, err := s.storageFor(r).getProfileHistory(r.Context(), profile.ID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, history)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit keys: what a policy counts requests against.
+const (
+	RateLimitByIP     = "ip"
+	RateLimitByUser   = "user"
+	RateLimitByAPIKey = "api_key"
+)
+
+// RateLimitStore holds token buckets. The in-memory store suits a single
+// instance; a shared store lets several instances enforce one budget.
+type RateLimitStore interface {
+	// take removes one token from the bucket named key, refilling it at
+	// rule's rate first, and reports whether the request may proceed.
+	take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (rateLimitResult, error)
+}
+
+type rateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until the next token; Reset is how long
+	// until the bucket is full again.
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+func newRateLimitStore(kind string) (RateLimitStore, error) {
+	switch kind {
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	}
+	return nil, fmt.Errorf("unknown rate limit store %q", kind)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}}
+}
+
+// idleBucketTTL is how long an untouched bucket is kept. Any bucket idle
+// this long has refilled under every sensible rule, so dropping it changes
+// nothing.
+const idleBucketTTL = 10 * time.Minute
+
+func (m *memoryRateLimitStore) take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (rateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, b := range m.buckets {
+			if now.Sub(b.last) > idleBucketTTL {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	rate := rule.perSecond()
+	burst := float64(rule.Burst)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	result := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((burst - b.tokens) / rate)
+	return result, nil
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func (r RateLimitRule) perSecond() float64 {
+	return float64(r.PerMinute) / 60
+}
+
+// rateLimitExempt routes skip the default policy so that probes and scrapes
+// never compete with client traffic.
+var rateLimitExempt = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// withDefaultRateLimit applies the default policy to every route. It runs
+// before authentication, so a "user" key falls back to the client IP.
+func (s *APIServer) withDefaultRateLimit(next http.Handler) http.Handler {
+	limited := s.rateLimit("default", s.config.RateLimit.Default, next.ServeHTTP)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt[routeTemplate(r)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited(w, r)
+	})
+}
+
+// rateLimit enforces rule on handlerFunc under the named policy. Wrapped
+// inside withJWTAuth, a "user" rule counts per authenticated user.
+func (s *APIServer) rateLimit(policy string, rule RateLimitRule, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.config.RateLimit.Enabled {
+			handlerFunc(w, r)
+			return
+		}
+
+		key := policy + ":" + s.rateLimitKey(r, rule.Key)
+		result, err := s.rateLimits.take(r.Context(), key, rule, time.Now())
+		if err != nil {
+			// Fail open: a broken limiter must not take the API down
+			s.logger.Error("Error checking rate limit", "policy", policy, "error", err)
+			handlerFunc(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=60;burst=%d;policy=%q", rule.PerMinute, rule.Burst, policy))
+		h.Set("RateLimit-Limit", strconv.Itoa(rule.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+		if !result.Allowed {
+			rateLimited.WithLabelValues(policy).Inc()
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			writeAPIError(w, http.StatusTooManyRequests, "Too many requests, retry later")
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateLimitKey identifies the caller a rule counts against, falling back to
+// the client IP when the preferred identity is absent.
+func (s *APIServer) rateLimitKey(r *http.Request, keyBy string) string {
+	switch keyBy {
+	case RateLimitByUser:
+		if userID, ok := r.Context().Value("user_id").(int); ok {
+			return "user:" + strconv.Itoa(userID)
+		}
+		if service, ok := serviceIdentityFromContext(r.Context()); ok {
+			return "service:" + service.Name
+		}
+	case RateLimitByAPIKey:
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+			return "api_key:" + apiKey
+		}
+	}
+	return "ip:" + s.clientIP(r)
+}
+
+// clientIP returns the caller's address. Behind a trusted proxy it walks
+// X-Forwarded-For from the right past the addresses of trusted proxies:
+// entries further left were sent by the client and may be forged.
+func (s *APIServer) clientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !s.config.RateLimit.TrustForwardedFor {
+		return remote
+	}
+
+	entries := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	client := remote
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+		client = entry
+		if !trustedProxy(entry, s.config.RateLimit.TrustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// trustedProxy reports whether ip falls in one of the proxies' CIDRs.
+func trustedProxy(ip string, proxies []string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, cidr := range proxies {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
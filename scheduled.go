@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scheduled transfer statuses. A transfer is processing while the scheduler
+// is executing it; one left processing after a crash needs checking by hand
+// because it may already have been applied.
+const (
+	ScheduledPending    = "pending"
+	ScheduledProcessing = "processing"
+	ScheduledCompleted  = "completed"
+	ScheduledFailed     = "failed"
+	ScheduledCancelled  = "cancelled"
+	// ScheduledSkipped marks a standing order occurrence the customer
+	// chose to skip; it is never executed.
+	ScheduledSkipped = "skipped"
+)
+
+// executeOnLayout is the format of ScheduledTransfer.ExecuteOn.
+const executeOnLayout = "2006-01-02"
+
+// ScheduledTransfer is a transfer requested for a future date. The
+// scheduler executes it through transferBalance once the date arrives.
+type ScheduledTransfer struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	FromAccount   int64      `json:"from_account"`
+	ToAccount     int64      `json:"to_account"`
+	Amount        float64    `json:"amount"`
+	Currency      string     `json:"currency"`
+	ExecuteOn     string     `json:"execute_on"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ExecutedAt    *time.Time `json:"executed_at,omitempty"`
+	// StandingOrderID is set on transfers generated by a standing order.
+	StandingOrderID *int      `json:"standing_order_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// isTransientTransferError reports whether a failed transfer may succeed
+// if tried again unchanged. Business rule rejections are final.
+func isTransientTransferError(err error) bool {
+	reason, known := transferFailureReasons[err.Error()]
+	return !known || reason == "timeout" || reason == "cancelled"
+}
+
+// scheduleTransfer stores a transfer for executeOn instead of executing it.
+func (s *APIServer) scheduleTransfer(w http.ResponseWriter, r *http.Request, userID int, from int64, req transferRequest, executeOn time.Time) error {
+	maxDate := s.calendar.today().AddDate(0, 0, s.config.Scheduler.MaxDaysAhead)
+	if executeOn.After(maxDate) {
+		return writeAPIError(w, http.StatusBadRequest, "execute_on must be within "+strconv.Itoa(s.config.Scheduler.MaxDaysAhead)+" days")
+	}
+
+	transfer := &ScheduledTransfer{
+		UserID:      userID,
+		FromAccount: from,
+		ToAccount:   req.ToAccountID,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		ExecuteOn:   executeOn.Format(executeOnLayout),
+	}
+	if transfer.FromAccount == transfer.ToAccount {
+		return writeAPIError(w, http.StatusBadRequest, "Cannot transfer to the same account")
+	}
+	if err := s.storageFor(r).createScheduledTransfer(r.Context(), transfer); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusCreated, transfer)
+}
+
+func (s *APIServer) handleListScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	transfers, err := s.storageFor(r).listScheduledTransfers(r.Context(), userID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, transfers)
+}
+
+func (s *APIServer) handleCancelScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid scheduled transfer ID")
+	}
+
+	if err := s.storageFor(r).cancelScheduledTransfer(r.Context(), id, userID); err != nil {
+		switch err.Error() {
+		case "scheduled transfer not found":
+			return writeAPIError(w, http.StatusNotFound, "Scheduled transfer not found")
+		case "scheduled transfer is not pending":
+			return writeAPIError(w, http.StatusConflict, "Only pending transfers can be cancelled")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	transfer, err := s.storageFor(r).getScheduledTransfer(r.Context(), id)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, transfer)
+}
+
+// runTransferScheduler generates the transfers due from standing orders
+// and executes due scheduled transfers every cfg.Interval until ctx is
+// cancelled.
+func runTransferScheduler(ctx context.Context, logger *slog.Logger, store Storage, cfg SchedulerConfig, cal *Calendar) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		generated, err := store.generateStandingOrderTransfers(ctx, cal.today())
+		if err != nil {
+			logger.Error("Error generating standing order transfers", "error", err)
+		}
+		if generated > 0 {
+			logger.Info("Generated standing order transfers", "transfers", generated)
+		}
+
+		due, err := store.claimDueTransfers(ctx, cfg.BatchSize)
+		if err != nil {
+			logger.Error("Error claiming scheduled transfers", "error", err)
+			continue
+		}
+		for _, transfer := range due {
+			executeScheduledTransfer(ctx, logger, store, cfg, transfer)
+		}
+	}
+}
+
+// executeScheduledTransfer runs one claimed transfer and records the
+// outcome. Transient failures are retried with exponential backoff until
+// cfg.MaxAttempts is reached.
+func executeScheduledTransfer(ctx context.Context, logger *slog.Logger, store Storage, cfg SchedulerConfig, transfer *ScheduledTransfer) {
+	execCtx, cancel := context.WithTimeout(ctx, cfg.ExecutionTimeout)
+	err := store.transferBalance(execCtx, transfer.FromAccount, transfer.ToAccount, transfer.Amount)
+	cancel()
+
+	transfer.Attempts++
+	switch {
+	case err == nil:
+		now := time.Now()
+		transfer.Status = ScheduledCompleted
+		transfer.ExecutedAt = &now
+		transfer.LastError = ""
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		// Shutting down: put it back without using up an attempt
+		transfer.Attempts--
+		transfer.Status = ScheduledPending
+	case isTransientTransferError(err) && transfer.Attempts < cfg.MaxAttempts:
+		transfer.Status = ScheduledPending
+		transfer.LastError = err.Error()
+		transfer.NextAttemptAt = time.Now().Add(cfg.RetryBackoff << (transfer.Attempts - 1))
+	default:
+		transfer.Status = ScheduledFailed
+		transfer.LastError = err.Error()
+	}
+
+	logger.Info("Executed scheduled transfer",
+		"scheduled_transfer_id", transfer.ID,
+		"status", transfer.Status,
+		"attempts", transfer.Attempts,
+		"error", transfer.LastError,
+	)
+
+	// Record the outcome even if we are shutting down, so that a completed
+	// transfer is never left looking like it still needs running
+	if err := store.finishScheduledTransfer(context.WithoutCancel(ctx), transfer); err != nil {
+		logger.Error("Error recording scheduled transfer outcome", "scheduled_transfer_id", transfer.ID, "error", err)
+	}
+
+	if transfer.Status == ScheduledFailed && transfer.LastError == "insufficient balance in the account" {
+		notification := &Notification{
+			UserID:  transfer.UserID,
+			Kind:    NotificationTransferFailed,
+			Message: insufficientFundsMessage(transfer),
+		}
+		if err := store.createNotification(context.WithoutCancel(ctx), notification); err != nil {
+			logger.Error("Error notifying failed transfer", "scheduled_transfer_id", transfer.ID, "error", err)
+		}
+	}
+}
+
+func insufficientFundsMessage(transfer *ScheduledTransfer) string {
+	what := "Your scheduled transfer"
+	if transfer.StandingOrderID != nil {
+		what = "Your standing order #" + strconv.Itoa(*transfer.StandingOrderID)
+	}
+	return fmt.Sprintf("%s of %.2f to account %d due on %s was not paid because of insufficient funds.",
+		what, transfer.Amount, transfer.ToAccount, transfer.ExecuteOn)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeletedRecords lists the soft-deleted users and accounts that can still be
+// restored.
+type DeletedRecords struct {
+	Users    []*User    `json:"users"`
+	Accounts []*Account `json:"accounts"`
+}
+
+type PurgeResult struct {
+	Users    int64 `json:"users"`
+	Accounts int64 `json:"accounts"`
+}
+
+func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if err := s.storageFor(r).softDeleteUser(r.Context(), id); err != nil {
+		switch err.Error() {
+		case "user not found":
+			return writeAPIError(w, http.StatusNotFound, "User not found")
+		case "user has open accounts":
+			return writeAPIError(w, http.StatusConflict, "Close all of the user's accounts first")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "User deleted successfully"})
+}
+
+func (s *APIServer) handleSoftDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	if err := s.storageFor(r).softDeleteAccount(r.Context(), id); err != nil {
+		switch err.Error() {
+		case "account not found":
+			return writeAPIError(w, http.StatusNotFound, "Account not found")
+		case "account must be closed before deletion":
+			return writeAPIError(w, http.StatusConflict, "Account must be closed before deletion")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "Account deleted successfully"})
+}
+
+func (s *APIServer) handleListDeleted(w http.ResponseWriter, r *http.Request) error {
+	records, err := s.storageFor(r).listDeleted(r.Context())
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, records)
+}
+
+func (s *APIServer) handleRestoreUser(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid user ID")
+	}
+
+	if err := s.storageFor(r).restoreUser(r.Context(), id); err != nil {
+		switch err.Error() {
+		case "deleted user not found":
+			return writeAPIError(w, http.StatusNotFound, "No restorable user with this ID")
+		case "username already taken":
+			return writeAPIError(w, http.StatusConflict, "The username has been taken by another user")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "User restored successfully"})
+}
+
+func (s *APIServer) handleRestoreAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid account ID")
+	}
+
+	if err := s.storageFor(r).restoreAccount(r.Context(), id); err != nil {
+		if err.Error() == "deleted account not found" {
+			return writeAPIError(w, http.StatusNotFound, "No restorable account with this ID")
+		}
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]string{"message": "Account restored successfully"})
+}
+
+// runPurgeJob permanently removes soft-deleted records past their
+// retention window every interval until ctx is cancelled.
+func runPurgeJob(ctx context.Context, logger *slog.Logger, store Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result, err := store.purgeDeleted(ctx)
+		if err != nil {
+			logger.Error("Error purging deleted records", "error", err)
+			continue
+		}
+		if result.Users > 0 || result.Accounts > 0 {
+			logger.Info("Purged deleted records", "users", result.Users, "accounts", result.Accounts)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Standing order statuses. Only active orders generate transfers.
+const (
+	StandingOrderActive    = "active"
+	StandingOrderPaused    = "paused"
+	StandingOrderCompleted = "completed"
+	StandingOrderCancelled = "cancelled"
+)
+
+// Standing order frequencies.
+const (
+	FrequencyDaily   = "daily"
+	FrequencyWeekly  = "weekly"
+	FrequencyMonthly = "monthly"
+)
+
+// ScheduleRule describes when a standing order runs: every Interval days,
+// weeks or months counted from the start date. Monthly orders run on
+// DayOfMonth (clamped to the month's length, defaulting to the start
+// date's day) or, with LastBusinessDay, on the month's last business day.
+type ScheduleRule struct {
+	Frequency       string `json:"frequency"`
+	Interval        int    `json:"interval"`
+	DayOfMonth      int    `json:"day_of_month,omitempty"`
+	LastBusinessDay bool   `json:"last_business_day,omitempty"`
+}
+
+func (r ScheduleRule) valid() bool {
+	switch r.Frequency {
+	case FrequencyDaily, FrequencyWeekly:
+		return r.Interval >= 1 && r.DayOfMonth == 0 && !r.LastBusinessDay
+	case FrequencyMonthly:
+		return r.Interval >= 1 && r.DayOfMonth >= 0 && r.DayOfMonth <= 31 && !(r.LastBusinessDay && r.DayOfMonth != 0)
+	}
+	return false
+}
+
+// occurrence returns the k-th date of the rule counted from start. It may
+// fall before start for monthly rules with an earlier DayOfMonth.
+func (r ScheduleRule) occurrence(cal *Calendar, start time.Time, k int) time.Time {
+	switch r.Frequency {
+	case FrequencyDaily:
+		return start.AddDate(0, 0, k*r.Interval)
+	case FrequencyWeekly:
+		return start.AddDate(0, 0, 7*k*r.Interval)
+	}
+
+	month := time.Date(start.Year(), start.Month()+time.Month(k*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+	last := month.AddDate(0, 1, -1)
+	if r.LastBusinessDay {
+		return cal.lastBusinessDayOfMonth(month.Year(), month.Month())
+	}
+	day := r.DayOfMonth
+	if day == 0 {
+		day = start.Day()
+	}
+	return time.Date(month.Year(), month.Month(), min(day, last.Day()), 0, 0, 0, 0, time.UTC)
+}
+
+// StandingOrder is a recurring transfer. Sequence is the index of the next
+// occurrence of Rule; Occurrences counts those already executed or skipped.
+type StandingOrder struct {
+	ID             int          `json:"id"`
+	UserID         int          `json:"user_id"`
+	FromAccount    int64        `json:"from_account"`
+	ToAccount      int64        `json:"to_account"`
+	Amount         float64      `json:"amount"`
+	Currency       string       `json:"currency"`
+	Description    string       `json:"description"`
+	Rule           ScheduleRule `json:"rule"`
+	StartDate      string       `json:"start_date"`
+	EndDate        *string      `json:"end_date,omitempty"`
+	MaxOccurrences *int         `json:"max_occurrences,omitempty"`
+	Occurrences    int          `json:"occurrences"`
+	Sequence       int          `json:"-"`
+	NextRunOn      *string      `json:"next_run_on"`
+	Status         string       `json:"status"`
+	CreatedAt      time.Time    `json:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+// maxScheduleSearch bounds the search for the next occurrence so that a
+// rule that can never match again cannot loop forever.
+const maxScheduleSearch = 100000
+
+// scheduleFrom moves the order to its first occurrence on or after from,
+// never going back before Sequence, and completes it if that falls past
+// its end.
+func (o *StandingOrder) scheduleFrom(cal *Calendar, from time.Time) {
+	start, _ := time.Parse(executeOnLayout, o.StartDate)
+	for k := o.Sequence; k < o.Sequence+maxScheduleSearch; k++ {
+		date := o.Rule.occurrence(cal, start, k)
+		if date.Before(from) || date.Before(start) {
+			continue
+		}
+		o.Sequence = k
+		if o.finishedBy(date) {
+			break
+		}
+		next := date.Format(executeOnLayout)
+		o.NextRunOn = &next
+		return
+	}
+	o.NextRunOn = nil
+	o.Status = StandingOrderCompleted
+}
+
+func (o *StandingOrder) finishedBy(date time.Time) bool {
+	if o.MaxOccurrences != nil && o.Occurrences >= *o.MaxOccurrences {
+		return true
+	}
+	if o.EndDate != nil {
+		end, _ := time.Parse(executeOnLayout, *o.EndDate)
+		return date.After(end)
+	}
+	return false
+}
+
+// advance records that the current occurrence has been dealt with and
+// moves on to the next one.
+func (o *StandingOrder) advance(cal *Calendar) {
+	current, _ := time.Parse(executeOnLayout, *o.NextRunOn)
+	o.Occurrences++
+	o.Sequence++
+	o.scheduleFrom(cal, current.AddDate(0, 0, 1))
+}
+
+type createStandingOrderRequest struct {
+	// FromAccountID defaults to the caller's oldest account.
+	FromAccountID  int64        `json:"from_account_id"`
+	ToAccountID    int64        `json:"to_account_id"`
+	ToIBAN         string       `json:"to_iban"`
+	Amount         float64      `json:"amount"`
+	Currency       string       `json:"currency"`
+	Description    string       `json:"description"`
+	Rule           ScheduleRule `json:"rule"`
+	StartDate      string       `json:"start_date"`
+	EndDate        string       `json:"end_date"`
+	MaxOccurrences *int         `json:"max_occurrences"`
+}
+
+func (s *APIServer) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	req := new(createStandingOrderRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid request data")
+	}
+	if req.Amount <= 0 {
+		return writeAPIError(w, http.StatusBadRequest, "Amount must be positive")
+	}
+	if !req.Rule.valid() {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid schedule rule")
+	}
+	if req.MaxOccurrences != nil && *req.MaxOccurrences <= 0 {
+		return writeAPIError(w, http.StatusBadRequest, "max_occurrences must be positive")
+	}
+
+	start := s.calendar.today()
+	if req.StartDate != "" {
+		date, err := time.Parse(executeOnLayout, req.StartDate)
+		if err != nil || date.Before(start) {
+			return writeAPIError(w, http.StatusBadRequest, "start_date must be a date in YYYY-MM-DD format, today or later")
+		}
+		start = date
+	}
+
+	order := &StandingOrder{
+		UserID:         userID,
+		Amount:         roundCents(req.Amount),
+		Description:    req.Description,
+		Rule:           req.Rule,
+		StartDate:      start.Format(executeOnLayout),
+		MaxOccurrences: req.MaxOccurrences,
+		Status:         StandingOrderActive,
+	}
+	if req.EndDate != "" {
+		end, err := time.Parse(executeOnLayout, req.EndDate)
+		if err != nil || end.Before(start) {
+			return writeAPIError(w, http.StatusBadRequest, "end_date must be a date in YYYY-MM-DD format, not before start_date")
+		}
+		order.EndDate = &req.EndDate
+	}
+	order.scheduleFrom(s.calendar, start)
+	if order.NextRunOn == nil {
+		return writeAPIError(w, http.StatusBadRequest, "The schedule has no occurrences before its end")
+	}
+
+	user, err := s.storageFor(r).getUserDetails(r.Context(), userID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Error fetching user details")
+	}
+	if len(user.Accounts) == 0 {
+		return writeAPIError(w, http.StatusBadRequest, "You have no account to transfer from")
+	}
+	fromAccount, ok := user.sourceAccount(req.FromAccountID)
+	if !ok {
+		return writeAPIError(w, http.StatusBadRequest, "from_account_id is not one of your accounts")
+	}
+	if !validAmount(req.Amount, fromAccount.Currency) {
+		return writeAPIError(w, http.StatusBadRequest, "Amount has more decimal places than "+fromAccount.Currency+" allows")
+	}
+	order.FromAccount = fromAccount.ACCOUNT
+	order.Currency = fromAccount.Currency
+
+	order.ToAccount = req.ToAccountID
+	if req.ToIBAN != "" {
+		iban, err := parseIBAN(req.ToIBAN)
+		if err != nil {
+			return writeAPIError(w, http.StatusBadRequest, "Invalid destination IBAN")
+		}
+		toAccount, err := s.storageFor(r).getAccountByIBAN(r.Context(), iban.String())
+		if err != nil {
+			if err.Error() == "account not found" {
+				return writeAPIError(w, http.StatusNotFound, "Destination account not found")
+			}
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+		order.ToAccount = toAccount.ACCOUNT
+	}
+	known, err := s.knownAccountNumber(r, order.ToAccount)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if !known {
+		return writeAPIError(w, http.StatusBadRequest, "Invalid destination account number")
+	}
+	if order.ToAccount == order.FromAccount {
+		return writeAPIError(w, http.StatusBadRequest, "Cannot transfer to the same account")
+	}
+
+	if err := s.storageFor(r).createStandingOrder(r.Context(), order); err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusCreated, order)
+}
+
+func (s *APIServer) handleListStandingOrders(w http.ResponseWriter, r *http.Request) error {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	orders, err := s.storageFor(r).listStandingOrders(r.Context(), userID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, orders)
+}
+
+// ownStandingOrder loads the standing order named in the URL if it belongs
+// to the caller, writing the error response otherwise.
+func (s *APIServer) ownStandingOrder(w http.ResponseWriter, r *http.Request) (*StandingOrder, error) {
+	userID, ok := r.Context().Value("user_id").(int)
+	if !ok {
+		return nil, writeAPIError(w, http.StatusUnauthorized, "Invalid user ID in request context")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, writeAPIError(w, http.StatusBadRequest, "Invalid standing order ID")
+	}
+
+	order, err := s.storageFor(r).getStandingOrder(r.Context(), id)
+	if err != nil {
+		if err.Error() == "standing order not found" {
+			return nil, writeAPIError(w, http.StatusNotFound, "Standing order not found")
+		}
+		return nil, writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+	if order.UserID != userID {
+		return nil, writeAPIError(w, http.StatusNotFound, "Standing order not found")
+	}
+	return order, nil
+}
+
+func (s *APIServer) handleStandingOrderHistory(w http.ResponseWriter, r *http.Request) error {
+	order, err := s.ownStandingOrder(w, r)
+	if order == nil {
+		return err
+	}
+
+	history, err := s.storageFor(r).getStandingOrderHistory(r.Context(), order.ID)
+	if err != nil {
+		return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+	}
+
+	return writeJSON(w, http.StatusOK, history)
+}
+
+// handleStandingOrderAction returns a handler that pauses, resumes, skips
+// the next occurrence of, or cancels the caller's standing order.
+func (s *APIServer) handleStandingOrderAction(action string) apiFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		order, err := s.ownStandingOrder(w, r)
+		if order == nil {
+			return err
+		}
+
+		if err := s.storageFor(r).changeStandingOrder(r.Context(), order.ID, action); err != nil {
+			switch err.Error() {
+			case "standing order not found":
+				return writeAPIError(w, http.StatusNotFound, "Standing order not found")
+			case "invalid standing order action":
+				return writeAPIError(w, http.StatusConflict, "The standing order cannot be "+standingOrderActionPast[action]+" in its current status")
+			}
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+
+		order, err = s.storageFor(r).getStandingOrder(r.Context(), order.ID)
+		if err != nil {
+			return writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+		}
+
+		return writeJSON(w, http.StatusOK, order)
+	}
+}
+
+// Standing order actions and the statuses they may be applied in.
+const (
+	StandingOrderPause  = "pause"
+	StandingOrderResume = "resume"
+	StandingOrderSkip   = "skip"
+	StandingOrderCancel = "cancel"
+)
+
+var standingOrderActionFrom = map[string][]string{
+	StandingOrderPause:  {StandingOrderActive},
+	StandingOrderResume: {StandingOrderPaused},
+	StandingOrderSkip:   {StandingOrderActive, StandingOrderPaused},
+	StandingOrderCancel: {StandingOrderActive, StandingOrderPaused},
+}
+
+var standingOrderActionPast = map[string]string{
+	StandingOrderPause:  "paused",
+	StandingOrderResume: "resumed",
+	StandingOrderSkip:   "skipped",
+	StandingOrderCancel: "cancelled",
+}
+
+// apply performs action on the order as of today, reporting false if the
+// order's status does not allow it.
+func (o *StandingOrder) apply(cal *Calendar, action string, today time.Time) bool {
+	allowed := false
+	for _, status := range standingOrderActionFrom[action] {
+		allowed = allowed || o.Status == status
+	}
+	if !allowed {
+		return false
+	}
+
+	switch action {
+	case StandingOrderPause:
+		o.Status = StandingOrderPaused
+	case StandingOrderResume:
+		// Occurrences missed while paused are not made up
+		o.Status = StandingOrderActive
+		o.scheduleFrom(cal, today)
+	case StandingOrderSkip:
+		o.advance(cal)
+	case StandingOrderCancel:
+		o.Status = StandingOrderCancelled
+		o.NextRunOn = nil
+	}
+	return true
+}
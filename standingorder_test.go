@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestScheduleRuleOccurrence(t *testing.T) {
+	cal := testCalendar(t)
+	tests := []struct {
+		name  string
+		rule  ScheduleRule
+		start time.Time
+		k     int
+		want  time.Time
+	}{
+		{"daily", ScheduleRule{Frequency: FrequencyDaily, Interval: 3}, date(2024, time.February, 27), 1, date(2024, time.March, 1)},
+		{"fortnightly", ScheduleRule{Frequency: FrequencyWeekly, Interval: 2}, date(2024, time.January, 5), 3, date(2024, time.February, 16)},
+		{"31st in January", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}, date(2024, time.January, 31), 0, date(2024, time.January, 31)},
+		{"31st in a leap February", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}, date(2024, time.January, 31), 1, date(2024, time.February, 29)},
+		{"31st in February", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}, date(2023, time.January, 31), 1, date(2023, time.February, 28)},
+		{"31st in March after February", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}, date(2024, time.January, 31), 2, date(2024, time.March, 31)},
+		{"31st in April", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}, date(2024, time.January, 31), 3, date(2024, time.April, 30)},
+		{"start day by default", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1}, date(2024, time.January, 31), 3, date(2024, time.April, 30)},
+		{"quarterly across a year end", ScheduleRule{Frequency: FrequencyMonthly, Interval: 3}, date(2024, time.November, 30), 1, date(2025, time.February, 28)},
+		{"earlier day of month", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 5}, date(2024, time.January, 20), 0, date(2024, time.January, 5)},
+		{"last business day on a Friday", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, LastBusinessDay: true}, date(2024, time.May, 1), 0, date(2024, time.May, 31)},
+		{"last business day before a weekend", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, LastBusinessDay: true}, date(2024, time.May, 1), 3, date(2024, time.August, 30)},
+		{"last business day before Easter", ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, LastBusinessDay: true}, date(2024, time.January, 15), 2, date(2024, time.March, 28)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.occurrence(cal, tt.start, tt.k); !got.Equal(tt.want) {
+				t.Errorf("occurrence(%s, %d) = %s, want %s", tt.start.Format(executeOnLayout), tt.k, got.Format(executeOnLayout), tt.want.Format(executeOnLayout))
+			}
+		})
+	}
+}
+
+func TestStandingOrderSchedule(t *testing.T) {
+	cal := testCalendar(t)
+	monthly31 := ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 31}
+	endDate := "2024-04-15"
+	three := 3
+
+	tests := []struct {
+		name  string
+		order StandingOrder
+		from  time.Time
+		want  []string
+		ends  bool
+	}{
+		{
+			name:  "31st of every month",
+			order: StandingOrder{Rule: monthly31, StartDate: "2024-01-31"},
+			from:  date(2024, time.January, 1),
+			want:  []string{"2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30", "2024-05-31"},
+		},
+		{
+			name:  "stops at the end date",
+			order: StandingOrder{Rule: monthly31, StartDate: "2024-01-31", EndDate: &endDate},
+			from:  date(2024, time.January, 1),
+			want:  []string{"2024-01-31", "2024-02-29", "2024-03-31"},
+			ends:  true,
+		},
+		{
+			name:  "stops after max occurrences",
+			order: StandingOrder{Rule: monthly31, StartDate: "2024-01-31", MaxOccurrences: &three},
+			from:  date(2024, time.January, 1),
+			want:  []string{"2024-01-31", "2024-02-29", "2024-03-31"},
+			ends:  true,
+		},
+		{
+			name:  "skips an earlier day in the first month",
+			order: StandingOrder{Rule: ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, DayOfMonth: 5}, StartDate: "2024-01-20"},
+			from:  date(2024, time.January, 20),
+			want:  []string{"2024-02-05", "2024-03-05", "2024-04-05"},
+		},
+		{
+			name:  "starts from a later date",
+			order: StandingOrder{Rule: monthly31, StartDate: "2024-01-31"},
+			from:  date(2024, time.March, 10),
+			want:  []string{"2024-03-31", "2024-04-30"},
+		},
+		{
+			name:  "last business day",
+			order: StandingOrder{Rule: ScheduleRule{Frequency: FrequencyMonthly, Interval: 1, LastBusinessDay: true}, StartDate: "2024-02-01"},
+			from:  date(2024, time.February, 1),
+			want:  []string{"2024-02-29", "2024-03-28", "2024-04-30", "2024-05-31"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order := tt.order
+			order.Status = StandingOrderActive
+			order.scheduleFrom(cal, tt.from)
+
+			var got []string
+			for order.Status == StandingOrderActive && len(got) < len(tt.want)+1 {
+				got = append(got, *order.NextRunOn)
+				order.advance(cal)
+			}
+			if !tt.ends && len(got) > len(tt.want) {
+				got = got[:len(tt.want)]
+			}
+			if tt.ends && (order.Status != StandingOrderCompleted || order.NextRunOn != nil) {
+				t.Errorf("order is %s with next run %v after its last occurrence", order.Status, order.NextRunOn)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("occurrences = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("occurrences = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
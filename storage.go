@@ -1,570 +1,4602 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Storage interface {
-	createAccount(*Account) error
-	deleteAccount(int) error
-	updateAccount(*Account) error
-	getAccountById(int) (*Account, error)
-	allAccounts(int) ([]*Account, error)
-	transferBalance(int64, int64, float64) error
-	getUserByUsername(string) (*User, error)
-	createUser(*User) error
-	authenticateUser(string, string) (*User, error)
-	getUserDetails(int) (getUserDetailsRequest, error)
+	createAccount(context.Context, *Account) error
+	updateAccount(context.Context, *Account) error
+	getAccountById(context.Context, int) (*Account, error)
+	getAccountByIBAN(context.Context, string) (*Account, error)
+	getAccountByNumber(context.Context, int64) (*Account, error)
+	allAccounts(context.Context, int) ([]*Account, error)
+	transferBalance(context.Context, int64, int64, float64) error
+	getUserByUsername(context.Context, string) (*User, error)
+	createUser(context.Context, *User) error
+	authenticateUser(context.Context, string, string) (*User, error)
+	getUserDetails(context.Context, int) (getUserDetailsRequest, error)
+	createProfile(context.Context, *CustomerProfile) error
+	getProfileByUserId(context.Context, int) (*CustomerProfile, error)
+	updateProfile(context.Context, *CustomerProfile, int) error
+	getProfileHistory(context.Context, int) ([]*ProfileHistoryEntry, error)
+	getUserById(context.Context, int) (*User, error)
+	changeAccountStatus(context.Context, int, string, string, string) error
+	getAccountStatusHistory(context.Context, int) ([]*AccountStatusChange, error)
+	getPendingAccountIDs(context.Context) ([]int, error)
+	getStatement(context.Context, int) (*Statement, error)
+	softDeleteUser(context.Context, int) error
+	softDeleteAccount(context.Context, int) error
+	listDeleted(context.Context) (*DeletedRecords, error)
+	restoreUser(context.Context, int) error
+	restoreAccount(context.Context, int) error
+	purgeDeleted(context.Context) (*PurgeResult, error)
+	appendAudit(context.Context, *AuditEvent) error
+	queryAudit(context.Context, AuditFilter) ([]*AuditEvent, error)
+	verifyAuditChain(context.Context) (*AuditVerification, error)
+	ping(context.Context) error
+	getSchemaVersion(context.Context) (int, error)
+	getTransferLimitStatus(context.Context, int) (*TransferLimitStatus, error)
+	getTransferLimitOverride(context.Context, int) (*TransferLimitOverride, error)
+	setTransferLimitOverride(context.Context, *TransferLimitOverride) error
+	deleteTransferLimitOverride(context.Context, int) error
+	setOverdraftLimit(context.Context, int, float64) error
+	chargeOverdrafts(context.Context) (*OverdraftRun, error)
+	placeHold(context.Context, *Hold) error
+	getHold(context.Context, int) (*Hold, error)
+	listHolds(context.Context, int) ([]*Hold, error)
+	captureHold(context.Context, int, float64) error
+	releaseHold(context.Context, int) error
+	expireHolds(context.Context) (int64, error)
+	createScheduledTransfer(context.Context, *ScheduledTransfer) error
+	getScheduledTransfer(context.Context, int) (*ScheduledTransfer, error)
+	listScheduledTransfers(context.Context, int) ([]*ScheduledTransfer, error)
+	cancelScheduledTransfer(context.Context, int, int) error
+	claimDueTransfers(context.Context, int) ([]*ScheduledTransfer, error)
+	finishScheduledTransfer(context.Context, *ScheduledTransfer) error
+	createStandingOrder(context.Context, *StandingOrder) error
+	getStandingOrder(context.Context, int) (*StandingOrder, error)
+	listStandingOrders(context.Context, int) ([]*StandingOrder, error)
+	changeStandingOrder(context.Context, int, string) error
+	getStandingOrderHistory(context.Context, int) ([]*ScheduledTransfer, error)
+	generateStandingOrderTransfers(context.Context, time.Time) (int, error)
+	createNotification(context.Context, *Notification) error
+	listNotifications(context.Context, int, bool) ([]*Notification, error)
+	markNotificationRead(context.Context, int, int) error
+	createInterestProduct(context.Context, *InterestProduct) error
+	listInterestProducts(context.Context) ([]*InterestProduct, error)
+	setAccountInterestProduct(context.Context, int, int) error
+	getInterestSummary(context.Context, int) (*InterestSummary, error)
+	runInterest(context.Context, time.Time) (*InterestRun, error)
+	listFeeRules(context.Context) ([]*FeeRule, error)
+	setFeeRule(context.Context, *FeeRule) error
+	deleteFeeRule(context.Context, string, string) error
+	listFees(context.Context, int) ([]*FeeCharge, error)
+	getFee(context.Context, int) (*FeeCharge, error)
+	waiveFee(context.Context, int, string, string) error
+	chargeMaintenanceFees(context.Context, time.Time) (*FeeRun, error)
+	listFXRates(context.Context) ([]*FXRate, error)
+	setFXRates(context.Context, []*FXRate) error
+	createFXQuote(context.Context, *FXQuote) error
+	convertBalance(context.Context, int64, int64, float64, int) error
 }
 
 type PostgresStore struct {
-	db *sql.DB
+	db             *sql.DB
+	logger         *slog.Logger
+	accountNumbers AccountNumberScheme
+	ibans          *IBANIssuer
+	// retention is how long soft-deleted users and accounts can be
+	// restored before the purge job removes them for good.
+	retention time.Duration
+	// transferLimits are the default limits per account type.
+	transferLimits TransferLimitsConfig
+	overdraft      OverdraftConfig
+	// calendar gives every ledger entry its value date.
+	calendar *Calendar
+	fees     FeesConfig
+	// currency is given to accounts opened before currencies existed.
+	currency CurrencyConfig
+	fx       FXConfig
 }
 
-func newPostgesStore() (*PostgresStore, error) {
+// maxAccountNumberAttempts bounds how often createAccount draws a new number
+// after hitting the unique constraint on account_number.
+const maxAccountNumberAttempts = 5
 
-	password := os.Getenv("PASSWORD")
-	connStr := fmt.Sprintf("user=postgres dbname=goLearning_db password=%s sslmode=disable", password)
+// schemaVersion is the schema this build expects. Bump it whenever Init
+// changes a table so that /readyz can tell a stale database apart.
+const schemaVersion = 15
 
-	db, err := sql.Open("postgres", connStr)
+func newPostgesStore(logger *slog.Logger, cfg DatabaseConfig, accountNumbers AccountNumberScheme, ibans *IBANIssuer, retention time.Duration, transferLimits TransferLimitsConfig, overdraft OverdraftConfig, calendar *Calendar, fees FeesConfig, currency CurrencyConfig, fx FXConfig) (*PostgresStore, error) {
+	// Every statement gets its own span under the caller's trace
+	db, err := otelsql.Open("postgres", cfg.DSN(), otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
 	return &PostgresStore{
-		db: db,
+		db:             db,
+		logger:         logger,
+		accountNumbers: accountNumbers,
+		ibans:          ibans,
+		retention:      retention,
+		transferLimits: transferLimits,
+		overdraft:      overdraft,
+		calendar:       calendar,
+		fees:           fees,
+		currency:       currency,
+		fx:             fx,
 	}, nil
 }
 
 func (s *PostgresStore) Init() error {
-	err := s.createAccountTable()
+	// Tables are created in dependency order: accounts reference both
+	// users and customer profiles.
+	err := s.createUserTable()
 	if err != nil {
 		return err
 	}
 
-	// You can add more initialization steps here
+	err = s.createProfileTables()
+	if err != nil {
+		return err
+	}
 
-	err = s.createUserTable()
+	err = s.createAccountTable()
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = s.createLedgerTables()
+	if err != nil {
+		return err
+	}
 
-func (s *PostgresStore) createAccountTable() error {
-	query := `
-        CREATE TABLE IF NOT EXISTS accounts (
-            id SERIAL PRIMARY KEY,
-            user_id INT NOT NULL,
-            first_name VARCHAR(255) NOT NULL,
-            last_name VARCHAR(255) NOT NULL,
-            hobby VARCHAR(255),
-            age INT,
-            account_number BIGINT NOT NULL,
-            balance DECIMAL(15, 2) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-        )
-    `
+	err = s.createInterestTables()
+	if err != nil {
+		return err
+	}
 
-	_, err := s.db.Exec(query)
+	err = s.createFeeTables()
 	if err != nil {
-		log.Printf("Error inserting account: %v", err)
 		return err
 	}
-	return nil
-}
 
-func (s *PostgresStore) createUserTable() error {
-	query := `
-        CREATE TABLE IF NOT EXISTS users (
-            id SERIAL PRIMARY KEY,
-            username VARCHAR(255) NOT NULL,
-            password VARCHAR(255) NOT NULL,
-            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-        )
-    `
+	err = s.createAuditTable()
+	if err != nil {
+		return err
+	}
 
-	_, err := s.db.Exec(query)
+	err = s.createTransferLimitTable()
 	if err != nil {
-		log.Printf("Error creating users table: %v", err)
 		return err
 	}
-	return nil
-}
 
-func (s *PostgresStore) createAccount(account *Account) error {
-	// Check if an account with the same user ID already exists
-	query := `
-        SELECT COUNT(*) FROM accounts WHERE user_id = $1
-    `
-	var count int
-	err := s.db.QueryRow(query, account.UserID).Scan(&count)
+	err = s.createStandingOrderTables()
 	if err != nil {
 		return err
 	}
 
-	if count > 0 {
-		return errors.New("user ID already exists")
+	err = s.createScheduledTransferTable()
+	if err != nil {
+		return err
 	}
 
-	// Proceed to insert the new account
-	insertQuery := `
-        INSERT INTO accounts (user_id, first_name, last_name, hobby, age, account_number, balance)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
-        RETURNING id, user_id, first_name, last_name, hobby, age, account_number, balance, created_at, updated_at
-    `
+	err = s.backfillCurrencies()
+	if err != nil {
+		return err
+	}
 
-	err = s.db.QueryRow(
-		insertQuery,
-		account.UserID,
-		account.FIRST_NAME,
-		account.LAST_NAME,
-		account.HOBBY,
-		account.AGE,
-		account.ACCOUNT,
-		account.BALANCE,
-	).Scan(
-		&account.ID,
-		&account.UserID,
-		&account.FIRST_NAME,
-		&account.LAST_NAME,
-		&account.HOBBY,
-		&account.AGE,
-		&account.ACCOUNT,
-		&account.BALANCE,
-		&account.CREATED_AT,
-		&account.UPDATED_AT,
-	)
+	err = s.createFXTables()
+	if err != nil {
+		return err
+	}
 
+	err = s.migrateActorColumns()
 	if err != nil {
-		log.Printf("Error inserting account: %+v", err)
 		return err
 	}
 
+	// You can add more initialization steps here
+
+	return s.recordSchemaVersion()
+}
+
+// Close releases the connection pool once in-flight queries finish.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+// recordSchemaVersion stores the schema version Init has just brought the
+// database up to. It never moves the version back, so an older binary
+// started during a rollout does not undo what a newer one recorded.
+func (s *PostgresStore) recordSchemaVersion() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+            version INT NOT NULL,
+            applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )
+    `
+	if _, err := s.db.Exec(query); err != nil {
+		s.logger.Error("Error creating schema_version table", "error", err)
+		return err
+	}
+
+	_, err := s.db.Exec(`
+        INSERT INTO schema_version (version) VALUES ($1)
+        ON CONFLICT (id) DO UPDATE SET version = EXCLUDED.version, applied_at = CURRENT_TIMESTAMP
+        WHERE schema_version.version < EXCLUDED.version
+    `, schemaVersion)
+	if err != nil {
+		s.logger.Error("Error recording schema version", "error", err)
+		return err
+	}
 	return nil
 }
 
-func (s *PostgresStore) allAccounts(batchSize int) ([]*Account, error) {
-	var accounts []*Account
-	offset := 0
+func (s *PostgresStore) ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
 
-	for {
-		query := `SELECT * FROM accounts ORDER BY id ASC LIMIT $1 OFFSET $2;`
+func (s *PostgresStore) getSchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := s.db.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("schema version not recorded")
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
 
-		rows, err := s.db.Query(query, batchSize, offset)
-		if err != nil {
-			log.Printf("Error fetching accounts: %v", err)
-			return nil, err
-		}
+func (s *PostgresStore) createAccountTable() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS accounts (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL,
+            profile_id INT NOT NULL,
+            account_number BIGINT NOT NULL,
+            bban VARCHAR(30),
+            iban VARCHAR(34),
+            balance DECIMAL(15, 2) NOT NULL,
+            status VARCHAR(16) NOT NULL DEFAULT 'active',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            deleted_at TIMESTAMP,
+            CONSTRAINT accounts_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT,
+            FOREIGN KEY (profile_id) REFERENCES customer_profiles(id)
+        );
 
-		var batchAccounts []*Account
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS bban VARCHAR(30);
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS iban VARCHAR(34);
+        CREATE UNIQUE INDEX IF NOT EXISTS accounts_iban_key ON accounts (iban);
 
-		for rows.Next() {
-			account := &Account{}
-			err := rows.Scan(
-				&account.ID,
-				&account.UserID,
-				&account.FIRST_NAME,
-				&account.LAST_NAME,
-				&account.HOBBY,
-				&account.AGE,
-				&account.ACCOUNT,
-				&account.BALANCE,
-				&account.CREATED_AT,
-				&account.UPDATED_AT,
-			)
-			if err != nil {
-				log.Printf("Error scanning row: %v", err)
-				return nil, err
-			}
-			batchAccounts = append(batchAccounts, account)
-		}
+        -- Accounts that predate lifecycle states were all in use
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active';
+        ALTER TABLE accounts ALTER COLUMN status SET DEFAULT 'active';
 
-		if err := rows.Err(); err != nil {
-			log.Printf("Error iterating rows: %v", err)
-			return nil, err
-		}
+        -- Deleting a user must never silently remove their accounts
+        ALTER TABLE accounts DROP CONSTRAINT IF EXISTS accounts_user_id_fkey;
+        ALTER TABLE accounts ADD CONSTRAINT accounts_user_id_fkey
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT;
 
-		// If there are no more rows, break the loop
-		if len(batchAccounts) == 0 {
-			break
-		}
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
 
-		accounts = append(accounts, batchAccounts...)
-		offset += batchSize
-	}
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS account_type VARCHAR(16) NOT NULL DEFAULT 'personal';
 
-	return accounts, nil
-}
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS overdraft_limit DECIMAL(15, 2) NOT NULL DEFAULT 0;
 
-func (s *PostgresStore) deleteAccount(id int) error {
-	// Check if the account exists
-	existsQuery := `
-		SELECT id
-		FROM accounts
-		WHERE id = $1;
-	`
+        -- Sum of the account's active holds, kept in step with the holds table
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS held_amount DECIMAL(15, 2) NOT NULL DEFAULT 0;
+
+        -- Filled in by backfillCurrencies
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency CHAR(3)
+    `
 
-	var accountID int
-	err := s.db.QueryRow(existsQuery, id).Scan(&accountID)
+	_, err := s.db.Exec(query)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return fmt.Errorf("account not found")
-		}
-		log.Printf("Error checking account existence: %v", err)
+		s.logger.Error("Error inserting account", "error", err)
 		return err
 	}
 
-	// Account exists, so proceed with deletion
-	deleteQuery := `
-		DELETE FROM accounts
-		WHERE id = $1;
-	`
-
-	_, err = s.db.Exec(deleteQuery, id)
+	// Numbers were not unique before they were generated, so duplicates
+	// have to be moved before the index can be built
+	if err := s.renumberDuplicateAccounts(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS accounts_account_number_key ON accounts (account_number)`)
 	if err != nil {
-		log.Printf("Error deleting account: %v", err)
+		s.logger.Error("Error creating account number index", "error", err)
 		return err
 	}
 
-	return nil
-}
+	if err := s.migrateLegacyAccountColumns(); err != nil {
+		return err
+	}
 
-func (s *PostgresStore) updateAccount(updatedAccount *Account) error {
-	query := `
-        UPDATE accounts
-        SET first_name = $1,
-            last_name = $2,
-            hobby = $3,
-            age = $4,
-            balance = $5,
-            updated_at = CURRENT_TIMESTAMP
-        WHERE id = $6;
-    `
+	return s.backfillIBANs()
+}
 
-	_, err := s.db.Exec(query,
-		updatedAccount.FIRST_NAME,
-		updatedAccount.LAST_NAME,
-		updatedAccount.HOBBY,
-		updatedAccount.AGE,
-		updatedAccount.BALANCE,
-		updatedAccount.ID,
-	)
+// renumberDuplicateAccounts gives a freshly generated number to every
+// account that shares its number with an older account, which keeps it.
+// Each move is logged, as the customer has to be told the new number.
+func (s *PostgresStore) renumberDuplicateAccounts() error {
+	rows, err := s.db.Query(`
+		SELECT a.id, a.account_number FROM accounts a
+		WHERE EXISTS (
+			SELECT 1 FROM accounts b WHERE b.account_number = a.account_number AND b.id < a.id
+		)
+		ORDER BY a.id
+	`)
 	if err != nil {
-		log.Printf("Error updating account: %v", err)
+		s.logger.Error("Error fetching duplicate account numbers", "error", err)
+		return err
+	}
+	type duplicate struct {
+		id            int
+		accountNumber int64
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.accountNumber); err != nil {
+			rows.Close()
+			s.logger.Error("Error scanning row", "error", err)
+			return err
+		}
+		duplicates = append(duplicates, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
 
+	for _, d := range duplicates {
+		renumbered := false
+		for attempt := 1; attempt <= maxAccountNumberAttempts && !renumbered; attempt++ {
+			number, err := s.accountNumbers.Generate()
+			if err != nil {
+				return err
+			}
+			// The IBAN is reissued for the new number by backfillIBANs
+			result, err := s.db.Exec(`
+				UPDATE accounts SET account_number = $1, bban = NULL, iban = NULL, updated_at = CURRENT_TIMESTAMP
+				WHERE id = $2 AND NOT EXISTS (SELECT 1 FROM accounts WHERE account_number = $1)
+			`, number, d.id)
+			if err != nil {
+				s.logger.Error("Error renumbering account", "account_id", d.id, "error", err)
+				return err
+			}
+			if n, _ := result.RowsAffected(); n == 1 {
+				s.logger.Warn("Renumbered account with a duplicate number", "account_id", d.id, "old_number", d.accountNumber, "new_number", number)
+				renumbered = true
+			}
+		}
+		if !renumbered {
+			return fmt.Errorf("could not find a free account number for account %d", d.id)
+		}
+	}
 	return nil
 }
 
-func (s *PostgresStore) getAccountById(id int) (*Account, error) {
-	query := `
-		SELECT *
-		FROM accounts
-		WHERE id = $1;
-	`
-
-	account := &Account{}
-
-	err := s.db.QueryRow(query, id).Scan(
-		&account.ID,
-		&account.FIRST_NAME,
-		&account.LAST_NAME,
-		&account.HOBBY,
-		&account.AGE,
-		&account.ACCOUNT,
-		&account.BALANCE,
-		&account.CREATED_AT,
-		&account.UPDATED_AT,
-	)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("account not found")
+// backfillCurrencies gives accounts from before currencies existed the
+// default currency, and everything recorded against an account the
+// account's currency.
+func (s *PostgresStore) backfillCurrencies() error {
+	statements := []string{
+		`UPDATE accounts SET currency = $1 WHERE currency IS NULL`,
+		`ALTER TABLE accounts ALTER COLUMN currency SET NOT NULL`,
+		`UPDATE ledger_entries l SET currency = a.currency FROM accounts a WHERE a.id = l.account_id AND l.currency IS NULL`,
+		`ALTER TABLE ledger_entries ALTER COLUMN currency SET NOT NULL`,
+		`UPDATE standing_orders o SET currency = COALESCE(
+			(SELECT a.currency FROM accounts a WHERE a.account_number = o.from_account), $1
+		) WHERE o.currency IS NULL`,
+		`ALTER TABLE standing_orders ALTER COLUMN currency SET NOT NULL`,
+		`UPDATE scheduled_transfers t SET currency = COALESCE(
+			(SELECT a.currency FROM accounts a WHERE a.account_number = t.from_account), $1
+		) WHERE t.currency IS NULL`,
+		`ALTER TABLE scheduled_transfers ALTER COLUMN currency SET NOT NULL`,
+	}
+	for _, stmt := range statements {
+		var args []interface{}
+		if strings.Contains(stmt, "$1") {
+			args = append(args, s.currency.Default)
+		}
+		if _, err := s.db.Exec(stmt, args...); err != nil {
+			s.logger.Error("Error backfilling currencies", "error", err)
+			return err
 		}
-		log.Printf("Error fetching account by ID: %v", err)
-		return nil, err
 	}
-
-	return account, nil
+	return nil
 }
 
-func (s *PostgresStore) transferBalance(fromAccountNumber, toAccountNumber int64, amount float64) error {
-	// Begin a new database transaction
-	tx, err := s.db.Begin()
-	if err != nil {
-		log.Printf("Error starting transaction: %v", err)
-		return err
+// migrateActorColumns turns the user ID columns that record who made a
+// change into actor names like "user:12", so that changes made by internal
+// services can be recorded as well.
+func (s *PostgresStore) migrateActorColumns() error {
+	columns := []struct{ table, column string }{
+		{"account_status_history", "changed_by"},
+		{"transfer_limit_overrides", "updated_by"},
+		{"fee_rules", "updated_by"},
+		{"fee_charges", "waived_by"},
+		{"fx_rates", "updated_by"},
 	}
-	defer tx.Rollback() // Rollback the transaction if it's not committed
+	for _, c := range columns {
+		var dataType string
+		err := s.db.QueryRow(`
+			SELECT data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+		`, c.table, c.column).Scan(&dataType)
+		if err != nil {
+			s.logger.Error("Error inspecting actor column", "table", c.table, "error", err)
+			return err
+		}
+		if dataType != "integer" {
+			continue
+		}
 
-	// Check if both accounts exist
-	existsQuery := `
-		SELECT account_number
-		FROM accounts
-		WHERE account_number IN ($1, $2);
-	`
+		_, err = s.db.Exec(`ALTER TABLE ` + c.table + ` ALTER COLUMN ` + c.column +
+			` TYPE VARCHAR(64) USING 'user:' || ` + c.column)
+		if err != nil {
+			s.logger.Error("Error migrating actor column", "table", c.table, "error", err)
+			return err
+		}
+	}
+	return nil
+}
 
-	var accountNumbers []int64
-	rows, err := tx.Query(existsQuery, fromAccountNumber, toAccountNumber)
+// backfillIBANs assigns a BBAN and IBAN to accounts created before they were
+// issued.
+func (s *PostgresStore) backfillIBANs() error {
+	rows, err := s.db.Query(`SELECT id, account_number FROM accounts WHERE iban IS NULL`)
 	if err != nil {
-		log.Printf("Error checking account existence: %v", err)
+		s.logger.Error("Error fetching accounts without IBAN", "error", err)
 		return err
 	}
 	defer rows.Close()
 
+	ids := map[int]int64{}
 	for rows.Next() {
+		var id int
 		var accountNumber int64
-		if err := rows.Scan(&accountNumber); err != nil {
-			log.Printf("Error scanning row: %v", err)
+		if err := rows.Scan(&id, &accountNumber); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
 			return err
 		}
-		accountNumbers = append(accountNumbers, accountNumber)
+		ids[id] = accountNumber
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	if len(accountNumbers) != 2 {
-		return fmt.Errorf("one or both accounts not found")
+	for id, accountNumber := range ids {
+		bban, iban, err := s.ibans.IBAN(accountNumber)
+		if err != nil {
+			// Legacy numbers may be too long for the configured country
+			s.logger.Warn("Skipping IBAN for account", "account_id", id, "error", err)
+			continue
+		}
+		if _, err := s.db.Exec(`UPDATE accounts SET bban = $1, iban = $2 WHERE id = $3`, bban, iban, id); err != nil {
+			s.logger.Error("Error backfilling IBAN", "error", err)
+			return err
+		}
 	}
 
-	// Fetch the current balance of the 'from' account
-	fromAccountQuery := `
-		SELECT balance
-		FROM accounts
-		WHERE account_number = $1;
-	`
+	return nil
+}
 
-	var fromBalance float64
-	err = tx.QueryRow(fromAccountQuery, fromAccountNumber).Scan(&fromBalance)
+// migrateLegacyAccountColumns moves the personal details that older
+// databases stored on every account row into customer profiles, links the
+// accounts to them and drops the old columns.
+func (s *PostgresStore) migrateLegacyAccountColumns() error {
+	var legacy bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'accounts' AND column_name = 'first_name'
+		)
+	`).Scan(&legacy)
 	if err != nil {
-		log.Printf("Error fetching balance: %v", err)
+		s.logger.Error("Error inspecting accounts table", "error", err)
 		return err
 	}
-
-	// Check if the 'from' account has enough balance
-	if fromBalance < amount {
-		return fmt.Errorf("insufficient balance in the 'from' account")
+	if !legacy {
+		return nil
 	}
 
-	// Update the balance of the 'from' account
-	updateFromBalanceQuery := `
-		UPDATE accounts
-		SET balance = balance - $1,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE account_number = $2;
-	`
-
-	_, err = tx.Exec(updateFromBalanceQuery, amount, fromAccountNumber)
+	tx, err := s.db.Begin()
 	if err != nil {
-		log.Printf("Error updating 'from' account balance: %v", err)
+		s.logger.Error("Error starting transaction", "error", err)
 		return err
 	}
+	defer tx.Rollback()
 
-	// Update the balance of the 'to' account
-	updateToBalanceQuery := `
-		UPDATE accounts
-		SET balance = balance + $1,
-			updated_at = CURRENT_TIMESTAMP
-		WHERE account_number = $2;
-	`
-
-	_, err = tx.Exec(updateToBalanceQuery, amount, toAccountNumber)
-	if err != nil {
-		log.Printf("Error updating 'to' account balance: %v", err)
-		return err
+	statements := []string{
+		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS profile_id INT REFERENCES customer_profiles(id)`,
+		`INSERT INTO customer_profiles (user_id, first_name, last_name)
+		 SELECT DISTINCT ON (a.user_id) a.user_id, a.first_name, a.last_name
+		 FROM accounts a
+		 WHERE NOT EXISTS (SELECT 1 FROM customer_profiles p WHERE p.user_id = a.user_id)
+		 ORDER BY a.user_id, a.id`,
+		`UPDATE accounts a SET profile_id = p.id FROM customer_profiles p WHERE p.user_id = a.user_id`,
+		`ALTER TABLE accounts ALTER COLUMN profile_id SET NOT NULL`,
+		`ALTER TABLE accounts DROP COLUMN first_name, DROP COLUMN last_name, DROP COLUMN hobby, DROP COLUMN age`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			s.logger.Error("Error migrating accounts table", "error", err)
+			return err
+		}
 	}
 
-	// Commit the transaction
-	err = tx.Commit()
+	return tx.Commit()
+}
+
+func (s *PostgresStore) createProfileTables() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS customer_profiles (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL UNIQUE,
+            first_name VARCHAR(255) NOT NULL,
+            last_name VARCHAR(255) NOT NULL,
+            date_of_birth DATE,
+            address_line1 VARCHAR(255) NOT NULL DEFAULT '',
+            address_line2 VARCHAR(255) NOT NULL DEFAULT '',
+            city VARCHAR(255) NOT NULL DEFAULT '',
+            postal_code VARCHAR(32) NOT NULL DEFAULT '',
+            country VARCHAR(2) NOT NULL DEFAULT '',
+            email VARCHAR(255) NOT NULL DEFAULT '',
+            phone VARCHAR(32) NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+        );
+
+        CREATE TABLE IF NOT EXISTS customer_profile_history (
+            id SERIAL PRIMARY KEY,
+            profile_id INT NOT NULL REFERENCES customer_profiles(id) ON DELETE CASCADE,
+            changed_by INT NOT NULL,
+            changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            snapshot JSONB NOT NULL
+        )
+    `
+
+	_, err := s.db.Exec(query)
 	if err != nil {
-		log.Printf("Error committing transaction: %v", err)
+		s.logger.Error("Error creating customer profile tables", "error", err)
 		return err
 	}
-
 	return nil
 }
 
-func (s *PostgresStore) getUserByUsername(username string) (*User, error) {
+func (s *PostgresStore) createLedgerTables() error {
 	query := `
-		SELECT *
-		FROM users
-		WHERE username = $1;
-	`
+        CREATE TABLE IF NOT EXISTS ledger_entries (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id),
+            entry_type VARCHAR(32) NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL,
+            balance_after DECIMAL(15, 2) NOT NULL,
+            counterparty_account BIGINT,
+            description VARCHAR(255) NOT NULL DEFAULT '',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
 
-	user := &User{}
+        CREATE INDEX IF NOT EXISTS ledger_entries_account_id_idx ON ledger_entries (account_id, id);
 
-	err := s.db.QueryRow(query, username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Password,
-		&user.CreatedAt,
+        -- Entries posted before value dates existed settled the day they were made
+        ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS value_date DATE;
+        UPDATE ledger_entries SET value_date = created_at::date WHERE value_date IS NULL;
+        ALTER TABLE ledger_entries ALTER COLUMN value_date SET NOT NULL;
+
+        ALTER TABLE ledger_entries ADD COLUMN IF NOT EXISTS currency CHAR(3);
+
+        CREATE TABLE IF NOT EXISTS account_status_history (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id),
+            from_status VARCHAR(16) NOT NULL,
+            to_status VARCHAR(16) NOT NULL,
+            reason VARCHAR(255) NOT NULL,
+            changed_by VARCHAR(64) NOT NULL,
+            changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        -- One row per account and day keeps overdraft charges from being
+        -- applied twice, however often the job runs
+        CREATE TABLE IF NOT EXISTS overdraft_charges (
+            account_id INT NOT NULL REFERENCES accounts(id),
+            charge_date DATE NOT NULL,
+            balance DECIMAL(15, 2) NOT NULL,
+            interest DECIMAL(15, 2) NOT NULL,
+            fee DECIMAL(15, 2) NOT NULL,
+            PRIMARY KEY (account_id, charge_date)
+        );
+
+        CREATE TABLE IF NOT EXISTS holds (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id),
+            amount DECIMAL(15, 2) NOT NULL,
+            captured_amount DECIMAL(15, 2) NOT NULL DEFAULT 0,
+            status VARCHAR(16) NOT NULL DEFAULT 'active',
+            description VARCHAR(255) NOT NULL DEFAULT '',
+            destination_account BIGINT,
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS holds_account_id_idx ON holds (account_id, id);
+        CREATE INDEX IF NOT EXISTS holds_active_expiry_idx ON holds (expires_at) WHERE status = 'active'
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating ledger tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createInterestTables() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS interest_products (
+            id SERIAL PRIMARY KEY,
+            name VARCHAR(100) NOT NULL,
+            day_count VARCHAR(8) NOT NULL,
+            tiers JSONB NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS interest_product_id INT REFERENCES interest_products(id);
+
+        -- Interest smaller than the currency's minor unit waits here for the
+        -- next month end instead of being rounded away
+        ALTER TABLE accounts ADD COLUMN IF NOT EXISTS interest_carried DECIMAL(15, 6) NOT NULL DEFAULT 0;
+
+        -- One row per account and day keeps a re-run from accruing twice;
+        -- capitalised_on is the month end the accrual was paid in
+        CREATE TABLE IF NOT EXISTS interest_accruals (
+            account_id INT NOT NULL REFERENCES accounts(id),
+            accrual_date DATE NOT NULL,
+            product_id INT NOT NULL REFERENCES interest_products(id),
+            balance DECIMAL(15, 2) NOT NULL,
+            amount DECIMAL(15, 6) NOT NULL,
+            capitalised_on DATE,
+            PRIMARY KEY (account_id, accrual_date)
+        );
+
+        CREATE INDEX IF NOT EXISTS interest_accruals_uncapitalised_idx ON interest_accruals (account_id)
+            WHERE capitalised_on IS NULL
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating interest tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createFeeTables() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS fee_rules (
+            id SERIAL PRIMARY KEY,
+            account_type VARCHAR(16) NOT NULL,
+            event VARCHAR(32) NOT NULL,
+            method VARCHAR(16) NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL DEFAULT 0,
+            rate DECIMAL(9, 6) NOT NULL DEFAULT 0,
+            tiers JSONB NOT NULL DEFAULT '[]',
+            min_fee DECIMAL(15, 2) NOT NULL DEFAULT 0,
+            max_fee DECIMAL(15, 2) NOT NULL DEFAULT 0,
+            updated_by VARCHAR(64) NOT NULL,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            UNIQUE (account_type, event)
+        );
+
+        ALTER TABLE fee_rules ADD COLUMN IF NOT EXISTS charge_inactive BOOLEAN NOT NULL DEFAULT FALSE;
+
+        -- rule_id is kept for reference only; rules may be deleted later
+        CREATE TABLE IF NOT EXISTS fee_charges (
+            id SERIAL PRIMARY KEY,
+            account_id INT NOT NULL REFERENCES accounts(id),
+            rule_id INT NOT NULL,
+            event VARCHAR(32) NOT NULL,
+            base_amount DECIMAL(15, 2) NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL,
+            period DATE,
+            revenue_account BIGINT NOT NULL,
+            waived_by VARCHAR(64),
+            waiver_reason VARCHAR(255),
+            waived_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS fee_charges_account_id_idx ON fee_charges (account_id, id);
+
+        -- A periodic fee is charged once per account and period
+        CREATE UNIQUE INDEX IF NOT EXISTS fee_charges_period_key ON fee_charges (account_id, event, period)
+            WHERE period IS NOT NULL
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating fee tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createFXTables() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS fx_rates (
+            base CHAR(3) NOT NULL,
+            quote CHAR(3) NOT NULL,
+            rate DECIMAL(18, 8) NOT NULL,
+            source VARCHAR(16) NOT NULL,
+            updated_by VARCHAR(64),
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (base, quote)
+        );
+
+        CREATE TABLE IF NOT EXISTS fx_quotes (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            from_currency CHAR(3) NOT NULL,
+            to_currency CHAR(3) NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL,
+            mid_rate DECIMAL(18, 8) NOT NULL,
+            spread DECIMAL(9, 6) NOT NULL,
+            rate DECIMAL(18, 8) NOT NULL,
+            converted_amount DECIMAL(15, 2) NOT NULL,
+            expires_at TIMESTAMP NOT NULL,
+            used_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating fx tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createTransferLimitTable() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS transfer_limit_overrides (
+            user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+            single_max DECIMAL(15, 2),
+            daily_amount DECIMAL(15, 2),
+            monthly_amount DECIMAL(15, 2),
+            daily_count INT,
+            reason VARCHAR(255) NOT NULL,
+            updated_by VARCHAR(64) NOT NULL,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating transfer limit table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createStandingOrderTables() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS standing_orders (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            from_account BIGINT NOT NULL,
+            to_account BIGINT NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL,
+            description VARCHAR(255) NOT NULL DEFAULT '',
+            frequency VARCHAR(16) NOT NULL,
+            interval_count INT NOT NULL,
+            day_of_month INT NOT NULL DEFAULT 0,
+            last_business_day BOOLEAN NOT NULL DEFAULT FALSE,
+            start_date DATE NOT NULL,
+            end_date DATE,
+            max_occurrences INT,
+            occurrences INT NOT NULL DEFAULT 0,
+            sequence INT NOT NULL DEFAULT 0,
+            next_run_on DATE,
+            status VARCHAR(16) NOT NULL DEFAULT 'active',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS standing_orders_user_id_idx ON standing_orders (user_id, id);
+        ALTER TABLE standing_orders ADD COLUMN IF NOT EXISTS currency CHAR(3);
+        CREATE INDEX IF NOT EXISTS standing_orders_due_idx ON standing_orders (next_run_on) WHERE status = 'active';
+
+        CREATE TABLE IF NOT EXISTS notifications (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            kind VARCHAR(32) NOT NULL,
+            message VARCHAR(500) NOT NULL,
+            read_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id)
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating standing order tables", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createScheduledTransferTable() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS scheduled_transfers (
+            id SERIAL PRIMARY KEY,
+            user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            from_account BIGINT NOT NULL,
+            to_account BIGINT NOT NULL,
+            amount DECIMAL(15, 2) NOT NULL,
+            execute_on DATE NOT NULL,
+            status VARCHAR(16) NOT NULL DEFAULT 'pending',
+            attempts INT NOT NULL DEFAULT 0,
+            last_error VARCHAR(255) NOT NULL DEFAULT '',
+            next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            executed_at TIMESTAMP,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS scheduled_transfers_user_id_idx ON scheduled_transfers (user_id, id);
+        ALTER TABLE scheduled_transfers ADD COLUMN IF NOT EXISTS currency CHAR(3);
+
+        ALTER TABLE scheduled_transfers ADD COLUMN IF NOT EXISTS standing_order_id INT
+            REFERENCES standing_orders(id) ON DELETE CASCADE;
+        CREATE INDEX IF NOT EXISTS scheduled_transfers_standing_order_id_idx ON scheduled_transfers (standing_order_id, id);
+        CREATE INDEX IF NOT EXISTS scheduled_transfers_due_idx ON scheduled_transfers (execute_on, next_attempt_at)
+            WHERE status = 'pending'
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating scheduled transfer table", "error", err)
+		return err
+	}
+	return nil
+}
+
+// createAuditTable creates the audit log and a trigger that rejects any
+// UPDATE or DELETE on it, so rows can only ever be appended.
+func (s *PostgresStore) createAuditTable() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS audit_log (
+            id BIGSERIAL PRIMARY KEY,
+            occurred_at TIMESTAMPTZ NOT NULL,
+            actor VARCHAR(64) NOT NULL,
+            action VARCHAR(64) NOT NULL,
+            target_type VARCHAR(32) NOT NULL,
+            target_id VARCHAR(64) NOT NULL,
+            before JSON NOT NULL,
+            after JSON NOT NULL,
+            ip VARCHAR(64) NOT NULL,
+            request_id VARCHAR(64) NOT NULL,
+            prev_hash CHAR(64) NOT NULL,
+            hash CHAR(64) NOT NULL
+        );
+
+        CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id);
+
+        CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+        BEGIN
+            RAISE EXCEPTION 'audit_log is append-only';
+        END;
+        $$ LANGUAGE plpgsql;
+
+        DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+        CREATE TRIGGER audit_log_append_only
+            BEFORE UPDATE OR DELETE ON audit_log
+            FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating audit table", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createUserTable() error {
+	query := `
+        CREATE TABLE IF NOT EXISTS users (
+            id SERIAL PRIMARY KEY,
+            username VARCHAR(255) NOT NULL,
+            password VARCHAR(255) NOT NULL,
+            role VARCHAR(32) NOT NULL DEFAULT 'customer',
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            deleted_at TIMESTAMP
+        );
+
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'customer';
+        ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP
+    `
+
+	_, err := s.db.Exec(query)
+	if err != nil {
+		s.logger.Error("Error creating users table", "error", err)
+		return err
+	}
+	return nil
+}
+
+const accountColumns = `
+	id, user_id, profile_id, account_number, COALESCE(bban, ''), COALESCE(iban, ''),
+	account_type, currency, balance, held_amount, overdraft_limit, interest_product_id, status,
+	created_at, updated_at, deleted_at
+`
+
+func scanAccount(row interface{ Scan(...interface{}) error }, account *Account) error {
+	var held float64
+	err := row.Scan(
+		&account.ID,
+		&account.UserID,
+		&account.ProfileID,
+		&account.ACCOUNT,
+		&account.BBAN,
+		&account.IBAN,
+		&account.Type,
+		&account.Currency,
+		&account.BALANCE,
+		&held,
+		&account.OverdraftLimit,
+		&account.InterestProductID,
+		&account.Status,
+		&account.CREATED_AT,
+		&account.UPDATED_AT,
+		&account.DeletedAt,
+	)
+	account.LedgerBalance = account.BALANCE
+	account.AvailableBalance = account.BALANCE - held
+	return err
+}
+
+func (s *PostgresStore) createAccount(ctx context.Context, account *Account) error {
+	// A user holds at most one account per currency
+	query := `
+        SELECT COUNT(*) FROM accounts WHERE user_id = $1 AND currency = $2 AND deleted_at IS NULL
+    `
+	var count int
+	err := s.db.QueryRowContext(ctx, query, account.UserID, account.Currency).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return errors.New("user already has an account in this currency")
+	}
+
+	// Proceed to insert the new account, posting any opening deposit to the
+	// ledger in the same statement
+	insertQuery := `
+        WITH inserted AS (
+            INSERT INTO accounts (user_id, profile_id, account_number, bban, iban, account_type, balance, currency)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $9)
+            RETURNING *
+        ), opening AS (
+            INSERT INTO ledger_entries (account_id, entry_type, amount, balance_after, description, value_date, currency)
+            SELECT id, '` + EntryDeposit + `', balance, balance, 'Opening deposit', $8, currency
+            FROM inserted WHERE balance > 0
+        )
+        SELECT ` + accountColumns + ` FROM inserted`
+
+	for attempt := 1; attempt <= maxAccountNumberAttempts; attempt++ {
+		account.ACCOUNT, err = s.accountNumbers.Generate()
+		if err != nil {
+			return err
+		}
+		account.BBAN, account.IBAN, err = s.ibans.IBAN(account.ACCOUNT)
+		if err != nil {
+			return err
+		}
+
+		err = scanAccount(s.db.QueryRowContext(ctx,
+			insertQuery,
+			account.UserID,
+			account.ProfileID,
+			account.ACCOUNT,
+			account.BBAN,
+			account.IBAN,
+			account.Type,
+			account.BALANCE,
+			s.calendar.valueDate(time.Now()).Format(executeOnLayout),
+			account.Currency,
+		), account)
+		if err == nil {
+			return nil
+		}
+
+		// Draw a fresh number if this one is already taken
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" && pqErr.Constraint == "accounts_account_number_key" {
+			s.logger.Warn("Account number collision, retrying", "attempt", attempt)
+			continue
+		}
+
+		s.logger.Error("Error inserting account", "error", err)
+		return err
+	}
+
+	return fmt.Errorf("could not allocate a unique account number")
+}
+
+func (s *PostgresStore) allAccounts(ctx context.Context, batchSize int) ([]*Account, error) {
+	var accounts []*Account
+	offset := 0
+
+	for {
+		query := `
+			SELECT ` + accountColumns + ` FROM accounts
+			WHERE deleted_at IS NULL
+			ORDER BY id ASC LIMIT $1 OFFSET $2;
+		`
+
+		rows, err := s.db.QueryContext(ctx, query, batchSize, offset)
+		if err != nil {
+			s.logger.Error("Error fetching accounts", "error", err)
+			return nil, err
+		}
+
+		var batchAccounts []*Account
+
+		for rows.Next() {
+			account := &Account{}
+			err := scanAccount(rows, account)
+			if err != nil {
+				s.logger.Error("Error scanning row", "error", err)
+				return nil, err
+			}
+			batchAccounts = append(batchAccounts, account)
+		}
+
+		if err := rows.Err(); err != nil {
+			s.logger.Error("Error iterating rows", "error", err)
+			return nil, err
+		}
+
+		// If there are no more rows, break the loop
+		if len(batchAccounts) == 0 {
+			break
+		}
+
+		accounts = append(accounts, batchAccounts...)
+		offset += batchSize
+	}
+
+	return accounts, nil
+}
+
+// updateAccount stores the account's new balance and posts the difference
+// to the ledger as an adjustment.
+func (s *PostgresStore) updateAccount(ctx context.Context, updatedAccount *Account) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var previousBalance, held, overdraftLimit float64
+	var status, currency string
+	err = tx.QueryRowContext(ctx, `
+		SELECT balance, held_amount, overdraft_limit, status, currency
+		FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+	`, updatedAccount.ID).Scan(&previousBalance, &held, &overdraftLimit, &status, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching balance", "error", err)
+		return err
+	}
+
+	// An adjustment is held to the same rules as any other posting
+	delta := updatedAccount.BALANCE - previousBalance
+	if !validAmount(updatedAccount.BALANCE, currency) {
+		return fmt.Errorf("amount is not valid in the account currency")
+	}
+	if delta < 0 && !canDebit(status) {
+		return fmt.Errorf("source account cannot be debited")
+	}
+	if delta > 0 && !canCredit(status) {
+		return fmt.Errorf("destination account cannot be credited")
+	}
+	if delta < 0 && updatedAccount.BALANCE-held < -overdraftLimit {
+		return fmt.Errorf("insufficient balance in the account")
+	}
+
+	query := `
+        UPDATE accounts
+        SET balance = $1,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = $2;
+    `
+
+	_, err = tx.ExecContext(ctx, query,
+		updatedAccount.BALANCE,
+		updatedAccount.ID,
+	)
+	if err != nil {
+		s.logger.Error("Error updating account", "error", err)
+		return err
+	}
+
+	if delta != 0 {
+		err = s.postLedgerEntry(ctx, tx, updatedAccount.ID, EntryAdjustment, delta, updatedAccount.BALANCE, 0, "Balance adjustment")
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) getAccountById(ctx context.Context, id int) (*Account, error) {
+	query := `
+		SELECT ` + accountColumns + `
+		FROM accounts
+		WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	account := &Account{}
+
+	err := scanAccount(s.db.QueryRowContext(ctx, query, id), account)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account by ID", "error", err)
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *PostgresStore) getAccountByNumber(ctx context.Context, accountNumber int64) (*Account, error) {
+	query := `
+		SELECT ` + accountColumns + `
+		FROM accounts
+		WHERE account_number = $1 AND deleted_at IS NULL;
+	`
+
+	account := &Account{}
+
+	err := scanAccount(s.db.QueryRowContext(ctx, query, accountNumber), account)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account by number", "error", err)
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *PostgresStore) getAccountByIBAN(ctx context.Context, iban string) (*Account, error) {
+	query := `
+		SELECT ` + accountColumns + `
+		FROM accounts
+		WHERE iban = $1 AND deleted_at IS NULL;
+	`
+
+	account := &Account{}
+
+	err := scanAccount(s.db.QueryRowContext(ctx, query, iban), account)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account by IBAN", "error", err)
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (s *PostgresStore) transferBalance(ctx context.Context, fromAccountNumber, toAccountNumber int64, amount float64) error {
+	return s.transfer(ctx, fromAccountNumber, toAccountNumber, amount, 0)
+}
+
+// convertBalance pays amount to an account in another currency at the rate
+// held by the caller's quote, using the quote up.
+func (s *PostgresStore) convertBalance(ctx context.Context, fromAccountNumber, toAccountNumber int64, amount float64, quoteID int) error {
+	return s.transfer(ctx, fromAccountNumber, toAccountNumber, amount, quoteID)
+}
+
+// transfer moves amount between two accounts, converting it with the FX
+// quote quoteID unless that is zero.
+func (s *PostgresStore) transfer(ctx context.Context, fromAccountNumber, toAccountNumber int64, amount float64, quoteID int) (err error) {
+	var currency string
+	defer func() {
+		// A cancelled or expired request surfaces as a driver error; report
+		// the cause instead. The deferred Rollback has already undone any
+		// partial work.
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		observeTransfer(amount, currency, err)
+	}()
+
+	if fromAccountNumber == toAccountNumber {
+		return fmt.Errorf("cannot transfer to the same account")
+	}
+
+	// Begin a new database transaction
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback() // Rollback the transaction if it's not committed
+
+	// Lock every account the transfer may touch, the bank's own included,
+	// in one go and in account number order, so that no two transfers can
+	// take the same locks in a different order and deadlock
+	lockAccounts, err := s.transferLockAccounts(ctx, tx, fromAccountNumber, toAccountNumber, quoteID)
+	if err != nil {
+		return err
+	}
+	lockQuery := `
+		SELECT id, user_id, account_number, account_type, currency, balance, held_amount, overdraft_limit, status
+		FROM accounts
+		WHERE account_number = ANY($1) AND deleted_at IS NULL
+		ORDER BY account_number
+		FOR UPDATE;
+	`
+
+	rows, err := tx.QueryContext(ctx, lockQuery, pq.Array(lockAccounts))
+	if err != nil {
+		s.logger.Error("Error checking account existence", "error", err)
+		return err
+	}
+
+	type lockedAccount struct {
+		id             int
+		userID         int
+		accountType    string
+		currency       string
+		balance        float64
+		held           float64
+		overdraftLimit float64
+		status         string
+	}
+	locked := map[int64]*lockedAccount{}
+	for rows.Next() {
+		var accountNumber int64
+		account := &lockedAccount{}
+		if err := rows.Scan(&account.id, &account.userID, &accountNumber, &account.accountType, &account.currency, &account.balance, &account.held, &account.overdraftLimit, &account.status); err != nil {
+			rows.Close()
+			s.logger.Error("Error scanning row", "error", err)
+			return err
+		}
+		locked[accountNumber] = account
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	from, to := locked[fromAccountNumber], locked[toAccountNumber]
+	if from == nil || to == nil {
+		return fmt.Errorf("one or both accounts not found")
+	}
+	currency = from.currency
+
+	if !canDebit(from.status) {
+		return fmt.Errorf("source account cannot be debited")
+	}
+	if !canCredit(to.status) {
+		return fmt.Errorf("destination account cannot be credited")
+	}
+
+	// A conversion credits what its quote says; any other transfer must
+	// stay in one currency
+	credit := amount
+	var quote *FXQuote
+	if quoteID != 0 {
+		quote, err = s.useFXQuote(ctx, tx, quoteID, from.userID)
+		if err != nil {
+			return err
+		}
+		if quote.FromCurrency != from.currency || quote.ToCurrency != to.currency || quote.Amount != amount {
+			return fmt.Errorf("fx quote does not match the transfer")
+		}
+		credit = quote.ConvertedAmount
+	} else if from.currency != to.currency {
+		return fmt.Errorf("accounts are in different currencies")
+	}
+
+	// The source row lock serialises transfers from this account, so the
+	// usage read here cannot go stale before commit
+	limits, _, err := s.effectiveTransferLimits(ctx, tx, from.userID, from.accountType, from.currency)
+	if err != nil {
+		return err
+	}
+	used, err := s.transferUsage(ctx, tx, from.id)
+	if err != nil {
+		return err
+	}
+	if err := limits.check(amount, used); err != nil {
+		return err
+	}
+
+	fee, err := s.quoteFee(ctx, tx, from.id, fromAccountNumber, from.accountType, from.currency, from.status, FeeTransferOut, amount)
+	if err != nil {
+		return err
+	}
+	var feeAmount float64
+	if fee != nil {
+		feeAmount = fee.Amount
+	}
+
+	// Check if the 'from' account has enough available balance for the
+	// amount and any fee, counting any arranged overdraft
+	if from.balance-from.held-amount-feeAmount < -from.overdraftLimit {
+		return fmt.Errorf("insufficient balance in the account")
+	}
+
+	// Update both balances and post the matching ledger entries
+	updateBalanceQuery := `
+		UPDATE accounts
+		SET balance = balance + $1,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+		RETURNING balance;
+	`
+
+	var fromBalance, toBalance float64
+	if err := tx.QueryRowContext(ctx, updateBalanceQuery, -amount, from.id).Scan(&fromBalance); err != nil {
+		s.logger.Error("Error updating 'from' account balance", "error", err)
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, updateBalanceQuery, credit, to.id).Scan(&toBalance); err != nil {
+		s.logger.Error("Error updating 'to' account balance", "error", err)
+		return err
+	}
+
+	outDescription, inDescription := "Transfer out", "Transfer in"
+	if quote != nil {
+		outDescription = fmt.Sprintf("Transfer out, converted to %s at %s", quote.ToCurrency, strconv.FormatFloat(quote.Rate, 'f', -1, 64))
+		inDescription = "Transfer in, converted from " + quote.FromCurrency
+	}
+	if err := s.postLedgerEntry(ctx, tx, from.id, EntryTransferOut, -amount, fromBalance, toAccountNumber, outDescription); err != nil {
+		return err
+	}
+	if err := s.postLedgerEntry(ctx, tx, to.id, EntryTransferIn, credit, toBalance, fromAccountNumber, inDescription); err != nil {
+		return err
+	}
+	if quote != nil {
+		if err := s.postFXPositions(ctx, tx, quote, fromAccountNumber, toAccountNumber); err != nil {
+			return err
+		}
+	}
+	if fee != nil {
+		if _, err := s.postFee(ctx, tx, fee, fromAccountNumber); err != nil {
+			return err
+		}
+	}
+
+	// Commit the transaction
+	err = tx.Commit()
+	if err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// transferLockAccounts lists the accounts a transfer may update: both
+// customer accounts, the fee revenue account and, for a conversion, the FX
+// position accounts of the quote's currencies. The quote is checked
+// properly once it is locked; here it only says which positions to lock.
+func (s *PostgresStore) transferLockAccounts(ctx context.Context, tx *sql.Tx, fromAccountNumber, toAccountNumber int64, quoteID int) ([]int64, error) {
+	accounts := []int64{fromAccountNumber, toAccountNumber}
+	if s.fees.RevenueAccount != 0 {
+		accounts = append(accounts, s.fees.RevenueAccount)
+	}
+	if quoteID != 0 {
+		var fromCurrency, toCurrency string
+		err := tx.QueryRowContext(ctx, `SELECT from_currency, to_currency FROM fx_quotes WHERE id = $1`, quoteID).Scan(&fromCurrency, &toCurrency)
+		if err != nil && err != sql.ErrNoRows {
+			s.logger.Error("Error fetching fx quote", "error", err)
+			return nil, err
+		}
+		if err == nil {
+			accounts = append(accounts, s.fx.positionAccount(fromCurrency), s.fx.positionAccount(toCurrency))
+		}
+	}
+	return accounts, nil
+}
+
+// execer and queryRower are satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *PostgresStore) postLedgerEntry(ctx context.Context, db execer, accountID int, entryType string, amount, balanceAfter float64, counterparty int64, description string) error {
+	query := `
+		INSERT INTO ledger_entries (account_id, entry_type, amount, balance_after, counterparty_account, description, value_date, currency)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7, (SELECT currency FROM accounts WHERE id = $1));
+	`
+
+	valueDate := s.calendar.valueDate(time.Now()).Format(executeOnLayout)
+	_, err := db.ExecContext(ctx, query, accountID, entryType, amount, balanceAfter, counterparty, description, valueDate)
+	if err != nil {
+		s.logger.Error("Error posting ledger entry", "error", err)
+		return err
+	}
+	return nil
+}
+
+// changeAccountStatus moves an account to a new lifecycle status if the
+// transition is allowed, and records it in account_status_history.
+func (s *PostgresStore) changeAccountStatus(ctx context.Context, accountID int, status, reason, changedBy string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	var balance, held float64
+	err = tx.QueryRowContext(ctx, `SELECT status, balance, held_amount FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, accountID).Scan(&current, &balance, &held)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account status", "error", err)
+		return err
+	}
+
+	if !canTransition(current, status) {
+		return fmt.Errorf("invalid status transition")
+	}
+	if status == AccountClosed && balance != 0 {
+		return fmt.Errorf("account balance must be zero to close")
+	}
+	if status == AccountClosed && held != 0 {
+		return fmt.Errorf("account has active holds")
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, status, accountID)
+	if err != nil {
+		s.logger.Error("Error updating account status", "error", err)
+		return err
+	}
+
+	historyQuery := `
+		INSERT INTO account_status_history (account_id, from_status, to_status, reason, changed_by)
+		VALUES ($1, $2, $3, $4, $5);
+	`
+	if _, err := tx.ExecContext(ctx, historyQuery, accountID, current, status, reason, changedBy); err != nil {
+		s.logger.Error("Error recording account status change", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getPendingAccountIDs lists the accounts still waiting to be activated,
+// oldest first.
+func (s *PostgresStore) getPendingAccountIDs(ctx context.Context) ([]int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM accounts WHERE status = $1 AND deleted_at IS NULL ORDER BY id`, AccountPending)
+	if err != nil {
+		s.logger.Error("Error fetching pending accounts", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *PostgresStore) getAccountStatusHistory(ctx context.Context, accountID int) ([]*AccountStatusChange, error) {
+	query := `
+		SELECT id, account_id, from_status, to_status, reason, changed_by, changed_at
+		FROM account_status_history
+		WHERE account_id = $1
+		ORDER BY id ASC;
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, accountID)
+	if err != nil {
+		s.logger.Error("Error fetching account status history", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*AccountStatusChange{}
+	for rows.Next() {
+		change := &AccountStatusChange{}
+		err := rows.Scan(
+			&change.ID,
+			&change.AccountID,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.Reason,
+			&change.ChangedBy,
+			&change.ChangedAt,
+		)
+		if err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// getStatement returns every ledger entry of an account together with its
+// current balance.
+func (s *PostgresStore) getStatement(ctx context.Context, accountID int) (*Statement, error) {
+	account, err := s.getAccountById(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, account_id, entry_type, amount, balance_after,
+			COALESCE(counterparty_account, 0), description, to_char(value_date, 'YYYY-MM-DD'), currency, created_at
+		FROM ledger_entries
+		WHERE account_id = $1
+		ORDER BY id ASC;
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, accountID)
+	if err != nil {
+		s.logger.Error("Error fetching ledger entries", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	statement := &Statement{
+		AccountID:      account.ID,
+		AccountNumber:  account.ACCOUNT,
+		IBAN:           account.IBAN,
+		Status:         account.Status,
+		Currency:       account.Currency,
+		ClosingBalance: account.BALANCE,
+		Entries:        []*LedgerEntry{},
+		GeneratedAt:    time.Now().UTC(),
+	}
+	for rows.Next() {
+		entry := &LedgerEntry{}
+		err := rows.Scan(
+			&entry.ID,
+			&entry.AccountID,
+			&entry.EntryType,
+			&entry.Amount,
+			&entry.BalanceAfter,
+			&entry.CounterpartyAccount,
+			&entry.Description,
+			&entry.ValueDate,
+			&entry.Currency,
+			&entry.CreatedAt,
+		)
+		if err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Accounts from before the ledger existed may carry a balance that no
+	// entry explains; report it as the opening balance.
+	var posted float64
+	for _, entry := range statement.Entries {
+		posted += entry.Amount
+	}
+	statement.OpeningBalance = statement.ClosingBalance - posted
+
+	return statement, nil
+}
+
+const userColumns = `id, username, password, role, created_at, updated_at, deleted_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }, user *User) error {
+	return row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Password,
+		&user.Role,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.DeletedAt,
+	)
+}
+
+func (s *PostgresStore) getUserByUsername(ctx context.Context, username string) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE username = $1 AND deleted_at IS NULL;
+	`
+
+	user := &User{}
+
+	err := scanUser(s.db.QueryRowContext(ctx, query, username), user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Return nil and no error if user not found
+		}
+		s.logger.Error("Error fetching user by username", "error", err)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) getUserById(ctx context.Context, id int) (*User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	user := &User{}
+
+	err := scanUser(s.db.QueryRowContext(ctx, query, id), user)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil // Return nil and no error if user not found
+		}
+		s.logger.Error("Error fetching user by ID", "error", err)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) createUser(ctx context.Context, user *User) error {
+	query := `
+		INSERT INTO users (username, password)
+		VALUES ($1, $2)
+		RETURNING id, role, created_at, updated_at;
+	`
+
+	err := s.db.QueryRowContext(ctx,
+		query,
+		user.Username,
+		user.Password,
+	).Scan(
+		&user.ID,
+		&user.Role,
+		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil // Return nil and no error if user not found
-		}
-		log.Printf("Error fetching user by username: %v", err)
+		s.logger.Error("Error inserting user", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) getUserDetails(ctx context.Context, id int) (getUserDetailsRequest, error) {
+	// Initialize an empty getUserDetailsRequest struct to store the result
+	var user getUserDetailsRequest
+
+	query := `
+		SELECT
+			u.id,
+			u.username,
+			COALESCE(a.id, 0) AS account_id,
+			COALESCE(a.account_number, 0) AS bank_account,
+			COALESCE(a.iban, '') AS account_iban,
+			COALESCE(a.currency, '') AS account_currency,
+			COALESCE(a.balance, 0) AS account_balance,
+			COALESCE(a.status, '') AS account_status
+
+		FROM
+			users u
+		LEFT JOIN
+			accounts a
+		ON
+			u.id = a.user_id AND a.deleted_at IS NULL
+		WHERE
+			u.id = $1 AND u.deleted_at IS NULL
+		ORDER BY
+			a.id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	//fmt.Println(rows)
+	if err != nil {
+		s.logger.Error("Error retrieving user and accounts", "error", err)
+		return user, err
+	}
+	defer rows.Close()
+
+	// Map to store user and associated accounts
+	userAccountsMap := make(map[int]getUserDetailsRequest)
+
+	// Iterate through the rows and populate the user and accounts map
+	for rows.Next() {
+		var userID int
+		var username string
+		var accountID int
+		var accountAccount int64
+		var accountIBAN string
+		var accountCurrency string
+		var accountBalance float64
+		var accountStatus string
+
+		err := rows.Scan(
+			&userID,
+			&username,
+			&accountID,
+			&accountAccount,
+			&accountIBAN,
+			&accountCurrency,
+			&accountBalance,
+			&accountStatus,
+		)
+
+		if err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return user, err
+		}
+
+		// Check if the user is already in the map, if not, create a new user
+		if _, ok := userAccountsMap[userID]; !ok {
+			user = getUserDetailsRequest{
+				ID:       userID,
+				Username: username,
+				Balances: map[string]float64{},
+			}
+			userAccountsMap[userID] = user
+		}
+
+		// Create a temporary user variable to update the Accounts field
+		tempUser := userAccountsMap[userID]
+
+		// If there is an associated account, add it to the user's accounts slice
+		if accountID != 0 {
+			account := AccountsRequest{
+				ID:       accountID,
+				ACCOUNT:  accountAccount,
+				IBAN:     accountIBAN,
+				Currency: accountCurrency,
+				BALANCE:  accountBalance,
+				Status:   accountStatus,
+			}
+			tempUser.Accounts = append(tempUser.Accounts, account)
+			tempUser.Balances[accountCurrency] = roundMinor(tempUser.Balances[accountCurrency]+accountBalance, accountCurrency)
+		}
+
+		// Update the user in the map with the temporary user
+		userAccountsMap[userID] = tempUser
+	}
+
+	// Check if the user exists, and return it along with associated accounts
+	if user, ok := userAccountsMap[id]; ok {
+		profile, err := s.getProfileByUserId(ctx, id)
+		if err != nil && err.Error() != "profile not found" {
+			return user, err
+		}
+		user.Profile = profile
+		return user, nil
+	}
+
+	return user, fmt.Errorf("User not found")
+}
+
+func (s *PostgresStore) authenticateUser(ctx context.Context, username, password string) (*User, error) {
+	user, err := s.getUserByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil // User not found
+	}
+
+	// Compare the hashed password with the provided password
+	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		// Return a custom error message here
+		return nil, fmt.Errorf("invalid password") //password don't match
+	}
+
+	return user, nil
+}
+
+const profileColumns = `
+	id, user_id, first_name, last_name, date_of_birth, address_line1, address_line2,
+	city, postal_code, country, email, phone, created_at, updated_at
+`
+
+func scanProfile(row interface{ Scan(...interface{}) error }, profile *CustomerProfile) error {
+	return row.Scan(
+		&profile.ID,
+		&profile.UserID,
+		&profile.FirstName,
+		&profile.LastName,
+		&profile.DateOfBirth,
+		&profile.AddressLine1,
+		&profile.AddressLine2,
+		&profile.City,
+		&profile.PostalCode,
+		&profile.Country,
+		&profile.Email,
+		&profile.Phone,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+}
+
+func (s *PostgresStore) createProfile(ctx context.Context, profile *CustomerProfile) error {
+	query := `
+		INSERT INTO customer_profiles (user_id, first_name, last_name, date_of_birth, address_line1,
+			address_line2, city, postal_code, country, email, phone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (user_id) DO NOTHING
+		RETURNING id, created_at, updated_at;
+	`
+
+	err := s.db.QueryRowContext(ctx,
+		query,
+		profile.UserID,
+		profile.FirstName,
+		profile.LastName,
+		profile.DateOfBirth,
+		profile.AddressLine1,
+		profile.AddressLine2,
+		profile.City,
+		profile.PostalCode,
+		profile.Country,
+		profile.Email,
+		profile.Phone,
+	).Scan(
+		&profile.ID,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("profile already exists")
+		}
+		s.logger.Error("Error inserting customer profile", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) getProfileByUserId(ctx context.Context, userID int) (*CustomerProfile, error) {
+	query := `SELECT ` + profileColumns + ` FROM customer_profiles WHERE user_id = $1;`
+
+	profile := &CustomerProfile{}
+	err := scanProfile(s.db.QueryRowContext(ctx, query, userID), profile)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("profile not found")
+		}
+		s.logger.Error("Error fetching customer profile", "error", err)
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// updateProfile stores the new profile values and records the previous
+// version in customer_profile_history in the same transaction.
+func (s *PostgresStore) updateProfile(ctx context.Context, profile *CustomerProfile, changedBy int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	historyQuery := `
+		INSERT INTO customer_profile_history (profile_id, changed_by, snapshot)
+		SELECT id, $2, to_jsonb(p) FROM customer_profiles p WHERE id = $1;
+	`
+	if _, err := tx.ExecContext(ctx, historyQuery, profile.ID, changedBy); err != nil {
+		s.logger.Error("Error recording customer profile history", "error", err)
+		return err
+	}
+
+	updateQuery := `
+		UPDATE customer_profiles
+		SET first_name = $1,
+			last_name = $2,
+			date_of_birth = $3,
+			address_line1 = $4,
+			address_line2 = $5,
+			city = $6,
+			postal_code = $7,
+			country = $8,
+			email = $9,
+			phone = $10,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $11
+		RETURNING updated_at;
+	`
+	err = tx.QueryRowContext(ctx,
+		updateQuery,
+		profile.FirstName,
+		profile.LastName,
+		profile.DateOfBirth,
+		profile.AddressLine1,
+		profile.AddressLine2,
+		profile.City,
+		profile.PostalCode,
+		profile.Country,
+		profile.Email,
+		profile.Phone,
+		profile.ID,
+	).Scan(&profile.UpdatedAt)
+	if err != nil {
+		s.logger.Error("Error updating customer profile", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) getProfileHistory(ctx context.Context, profileID int) ([]*ProfileHistoryEntry, error) {
+	query := `
+		SELECT id, profile_id, changed_by, changed_at, snapshot
+		FROM customer_profile_history
+		WHERE profile_id = $1
+		ORDER BY id DESC;
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, profileID)
+	if err != nil {
+		s.logger.Error("Error fetching customer profile history", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*ProfileHistoryEntry{}
+	for rows.Next() {
+		entry := &ProfileHistoryEntry{}
+		if err := rows.Scan(&entry.ID, &entry.ProfileID, &entry.ChangedBy, &entry.ChangedAt, &entry.Snapshot); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// softDeleteUser marks a user and all of their accounts as deleted. Users
+// with accounts that are not closed cannot be deleted.
+func (s *PostgresStore) softDeleteUser(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user not found")
+		}
+		s.logger.Error("Error fetching user", "error", err)
+		return err
+	}
+
+	var openAccounts int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM accounts
+		WHERE user_id = $1 AND deleted_at IS NULL AND status <> $2
+	`, id, AccountClosed).Scan(&openAccounts)
+	if err != nil {
+		s.logger.Error("Error counting open accounts", "error", err)
+		return err
+	}
+	if openAccounts > 0 {
+		return fmt.Errorf("user has open accounts")
+	}
+
+	// Accounts deleted together with their user share its timestamp so
+	// that restoring the user brings exactly those accounts back.
+	_, err = tx.ExecContext(ctx, `
+		WITH deleted AS (
+			UPDATE users SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 RETURNING deleted_at
+		)
+		UPDATE accounts SET deleted_at = (SELECT deleted_at FROM deleted)
+		WHERE user_id = $1 AND deleted_at IS NULL
+	`, id)
+	if err != nil {
+		s.logger.Error("Error deleting user", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// softDeleteAccount marks a closed account as deleted.
+func (s *PostgresStore) softDeleteAccount(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account status", "error", err)
+		return err
+	}
+	if status != AccountClosed {
+		return fmt.Errorf("account must be closed before deletion")
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1`, id); err != nil {
+		s.logger.Error("Error deleting account", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// listDeleted returns the users and accounts that are soft-deleted and
+// still within the retention window.
+func (s *PostgresStore) listDeleted(ctx context.Context) (*DeletedRecords, error) {
+	cutoff := time.Now().Add(-s.retention)
+	records := &DeletedRecords{Users: []*User{}, Accounts: []*Account{}}
+
+	userRows, err := s.db.QueryContext(ctx, `
+		SELECT `+userColumns+` FROM users
+		WHERE deleted_at IS NOT NULL AND deleted_at > $1
+		ORDER BY deleted_at DESC
+	`, cutoff)
+	if err != nil {
+		s.logger.Error("Error fetching deleted users", "error", err)
+		return nil, err
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		user := &User{}
+		if err := scanUser(userRows, user); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		records.Users = append(records.Users, user)
+	}
+	if err := userRows.Err(); err != nil {
+		return nil, err
+	}
+
+	accountRows, err := s.db.QueryContext(ctx, `
+		SELECT `+accountColumns+` FROM accounts
+		WHERE deleted_at IS NOT NULL AND deleted_at > $1
+		ORDER BY deleted_at DESC
+	`, cutoff)
+	if err != nil {
+		s.logger.Error("Error fetching deleted accounts", "error", err)
+		return nil, err
+	}
+	defer accountRows.Close()
+	for accountRows.Next() {
+		account := &Account{}
+		if err := scanAccount(accountRows, account); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		records.Accounts = append(records.Accounts, account)
+	}
+
+	return records, accountRows.Err()
+}
+
+// restoreUser undeletes a user together with the accounts that were
+// deleted alongside it.
+func (s *PostgresStore) restoreUser(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	var deletedAt time.Time
+	err = tx.QueryRowContext(ctx, `
+		SELECT username, deleted_at FROM users
+		WHERE id = $1 AND deleted_at IS NOT NULL AND deleted_at > $2
+		FOR UPDATE
+	`, id, time.Now().Add(-s.retention)).Scan(&username, &deletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("deleted user not found")
+		}
+		s.logger.Error("Error fetching deleted user", "error", err)
+		return err
+	}
+
+	// The username may have been taken again while the user was deleted
+	var taken bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1 AND deleted_at IS NULL)`, username).Scan(&taken)
+	if err != nil {
+		s.logger.Error("Error checking username", "error", err)
+		return err
+	}
+	if taken {
+		return fmt.Errorf("username already taken")
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET deleted_at = NULL WHERE id = $1`, id); err != nil {
+		s.logger.Error("Error restoring user", "error", err)
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET deleted_at = NULL WHERE user_id = $1 AND deleted_at = $2`, id, deletedAt); err != nil {
+		s.logger.Error("Error restoring user accounts", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) restoreAccount(ctx context.Context, id int) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE accounts a SET deleted_at = NULL
+		FROM users u
+		WHERE a.id = $1 AND a.user_id = u.id AND u.deleted_at IS NULL
+			AND a.deleted_at IS NOT NULL AND a.deleted_at > $2
+	`, id, time.Now().Add(-s.retention))
+	if err != nil {
+		s.logger.Error("Error restoring account", "error", err)
+		return err
+	}
+
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if restored == 0 {
+		return fmt.Errorf("deleted account not found")
+	}
+
+	return nil
+}
+
+// purgeDeleted permanently removes users and accounts whose retention
+// window has passed, along with the ledger and history rows that reference
+// them.
+func (s *PostgresStore) purgeDeleted(ctx context.Context) (*PurgeResult, error) {
+	cutoff := time.Now().Add(-s.retention)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Accounts of purged users go too, whatever their own deleted_at
+	purgeable := `
+		SELECT id FROM accounts
+		WHERE (deleted_at IS NOT NULL AND deleted_at <= $1)
+			OR user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL AND deleted_at <= $1)
+	`
+	statements := []string{
+		`DELETE FROM ledger_entries WHERE account_id IN (` + purgeable + `)`,
+		`DELETE FROM account_status_history WHERE account_id IN (` + purgeable + `)`,
+		`DELETE FROM overdraft_charges WHERE account_id IN (` + purgeable + `)`,
+		`DELETE FROM holds WHERE account_id IN (` + purgeable + `)`,
+		`DELETE FROM interest_accruals WHERE account_id IN (` + purgeable + `)`,
+		`DELETE FROM fee_charges WHERE account_id IN (` + purgeable + `)`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt, cutoff); err != nil {
+			s.logger.Error("Error purging account history", "error", err)
+			return nil, err
+		}
+	}
+
+	result := &PurgeResult{}
+
+	accounts, err := tx.ExecContext(ctx, `DELETE FROM accounts WHERE id IN (`+purgeable+`)`, cutoff)
+	if err != nil {
+		s.logger.Error("Error purging accounts", "error", err)
+		return nil, err
+	}
+	if result.Accounts, err = accounts.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	users, err := tx.ExecContext(ctx, `DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at <= $1`, cutoff)
+	if err != nil {
+		s.logger.Error("Error purging users", "error", err)
+		return nil, err
+	}
+	if result.Users, err = users.RowsAffected(); err != nil {
+		return nil, err
+	}
+
+	return result, tx.Commit()
+}
+
+// auditChainLock is the advisory lock key that serialises appends to the
+// audit chain.
+const auditChainLock = 31031
+
+const auditColumns = `
+	id, occurred_at, actor, action, target_type, target_id, before, after,
+	ip, request_id, prev_hash, hash
+`
+
+func scanAuditEvent(row interface{ Scan(...interface{}) error }, event *AuditEvent) error {
+	var before, after string
+	err := row.Scan(
+		&event.ID,
+		&event.OccurredAt,
+		&event.Actor,
+		&event.Action,
+		&event.TargetType,
+		&event.TargetID,
+		&before,
+		&after,
+		&event.IP,
+		&event.RequestID,
+		&event.PrevHash,
+		&event.Hash,
+	)
+	event.Before = json.RawMessage(before)
+	event.After = json.RawMessage(after)
+	return err
+}
+
+// appendAudit links the event to the current head of the chain and inserts
+// it. The advisory lock makes concurrent appends take turns so the chain
+// never forks.
+func (s *PostgresStore) appendAudit(ctx context.Context, event *AuditEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, auditChainLock); err != nil {
+		s.logger.Error("Error locking audit chain", "error", err)
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&event.PrevHash)
+	if err == sql.ErrNoRows {
+		event.PrevHash = strings.Repeat("0", 64)
+	} else if err != nil {
+		s.logger.Error("Error reading audit chain head", "error", err)
+		return err
+	}
+
+	// Postgres keeps microseconds; truncate so the stored value hashes the same
+	event.OccurredAt = time.Now().UTC().Truncate(time.Microsecond)
+	event.Hash = event.computeHash()
+
+	query := `
+		INSERT INTO audit_log (occurred_at, actor, action, target_type, target_id, before, after,
+			ip, request_id, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING id;
+	`
+	err = tx.QueryRowContext(ctx,
+		query,
+		event.OccurredAt,
+		event.Actor,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		string(event.Before),
+		string(event.After),
+		event.IP,
+		event.RequestID,
+		event.PrevHash,
+		event.Hash,
+	).Scan(&event.ID)
+	if err != nil {
+		s.logger.Error("Error inserting audit event", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) queryAudit(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	where, args := auditFilterClause(filter)
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT %s FROM audit_log %s ORDER BY id DESC LIMIT $%d`, auditColumns, where, len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.logger.Error("Error querying audit log", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event := &AuditEvent{}
+		if err := scanAuditEvent(rows, event); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// verifyAuditChain recomputes every hash in id order and reports the first
+// entry whose hash or link to its predecessor does not match.
+func (s *PostgresStore) verifyAuditChain(ctx context.Context) (*AuditVerification, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_log ORDER BY id ASC`)
+	if err != nil {
+		s.logger.Error("Error reading audit log", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &AuditVerification{Valid: true}
+	prevHash := strings.Repeat("0", 64)
+	for rows.Next() {
+		event := &AuditEvent{}
+		if err := scanAuditEvent(rows, event); err != nil {
+			s.logger.Error("Error scanning row", "error", err)
+			return nil, err
+		}
+		result.EntriesChecked++
+
+		if event.PrevHash != prevHash {
+			result.Valid, result.FirstBrokenID, result.Reason = false, event.ID, "previous hash does not match"
+			return result, nil
+		}
+		if event.computeHash() != event.Hash {
+			result.Valid, result.FirstBrokenID, result.Reason = false, event.ID, "entry hash does not match its contents"
+			return result, nil
+		}
+		prevHash = event.Hash
+	}
+
+	return result, rows.Err()
+}
+
+func (s *PostgresStore) defaultTransferLimits(accountType string) TransferLimits {
+	if accountType == AccountTypeBusiness {
+		return s.transferLimits.Business
+	}
+	return s.transferLimits.Personal
+}
+
+// effectiveTransferLimits returns the account-type defaults with the user's
+// override applied, in currency, and whether there was an override.
+func (s *PostgresStore) effectiveTransferLimits(ctx context.Context, db queryRower, userID int, accountType, currency string) (TransferLimits, bool, error) {
+	limits := s.defaultTransferLimits(accountType)
+	scale, ok := s.currency.amountScale(currency)
+	if !ok {
+		return limits, false, fmt.Errorf("no transfer limits for this currency")
+	}
+
+	override, err := scanTransferLimitOverride(db.QueryRowContext(ctx,
+		`SELECT `+transferLimitOverrideColumns+` FROM transfer_limit_overrides WHERE user_id = $1`, userID))
+	if err == sql.ErrNoRows {
+		return limits.scaled(scale, currency), false, nil
+	}
+	if err != nil {
+		s.logger.Error("Error fetching transfer limit override", "error", err)
+		return limits, false, err
+	}
+	return override.apply(limits).scaled(scale, currency), true, nil
+}
+
+// transferUsage sums the outgoing transfers of an account for the current
+// day and month.
+func (s *PostgresStore) transferUsage(ctx context.Context, db queryRower, accountID int) (TransferUsage, error) {
+	query := `
+		SELECT
+			COALESCE(-SUM(amount) FILTER (WHERE created_at >= date_trunc('day', now())), 0),
+			COALESCE(-SUM(amount), 0),
+			COUNT(*) FILTER (WHERE created_at >= date_trunc('day', now()))
+		FROM ledger_entries
+		WHERE account_id = $1
+			AND entry_type = '` + EntryTransferOut + `'
+			AND created_at >= date_trunc('month', now())
+	`
+
+	var used TransferUsage
+	err := db.QueryRowContext(ctx, query, accountID).Scan(&used.AmountToday, &used.AmountThisMonth, &used.CountToday)
+	if err != nil {
+		s.logger.Error("Error computing transfer usage", "error", err)
+		return used, err
+	}
+	return used, nil
+}
+
+func (s *PostgresStore) getTransferLimitStatus(ctx context.Context, accountID int) (*TransferLimitStatus, error) {
+	account, err := s.getAccountById(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, overridden, err := s.effectiveTransferLimits(ctx, s.db, account.UserID, account.Type, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+	used, err := s.transferUsage(ctx, s.db, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransferLimitStatus{
+		AccountID:   accountID,
+		AccountType: account.Type,
+		Limits:      limits,
+		Overridden:  overridden,
+		Used:        used,
+		Remaining:   limits.remaining(used),
+	}, nil
+}
+
+const transferLimitOverrideColumns = `
+	user_id, single_max, daily_amount, monthly_amount, daily_count, reason, updated_by, updated_at
+`
+
+func scanTransferLimitOverride(row interface{ Scan(...interface{}) error }) (*TransferLimitOverride, error) {
+	override := &TransferLimitOverride{}
+	var dailyCount sql.NullInt64
+	var singleMax, dailyAmount, monthlyAmount sql.NullFloat64
+	err := row.Scan(
+		&override.UserID,
+		&singleMax,
+		&dailyAmount,
+		&monthlyAmount,
+		&dailyCount,
+		&override.Reason,
+		&override.UpdatedBy,
+		&override.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range []struct {
+		src sql.NullFloat64
+		dst **float64
+	}{{singleMax, &override.SingleMax}, {dailyAmount, &override.DailyAmount}, {monthlyAmount, &override.MonthlyAmount}} {
+		if f.src.Valid {
+			v := f.src.Float64
+			*f.dst = &v
+		}
+	}
+	if dailyCount.Valid {
+		v := int(dailyCount.Int64)
+		override.DailyCount = &v
+	}
+	return override, nil
+}
+
+func (s *PostgresStore) getTransferLimitOverride(ctx context.Context, userID int) (*TransferLimitOverride, error) {
+	override, err := scanTransferLimitOverride(s.db.QueryRowContext(ctx,
+		`SELECT `+transferLimitOverrideColumns+` FROM transfer_limit_overrides WHERE user_id = $1`, userID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("transfer limit override not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching transfer limit override", "error", err)
+		return nil, err
+	}
+	return override, nil
+}
+
+func (s *PostgresStore) setTransferLimitOverride(ctx context.Context, override *TransferLimitOverride) error {
+	query := `
+		INSERT INTO transfer_limit_overrides
+			(user_id, single_max, daily_amount, monthly_amount, daily_count, reason, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (user_id) DO UPDATE SET
+			single_max = EXCLUDED.single_max,
+			daily_amount = EXCLUDED.daily_amount,
+			monthly_amount = EXCLUDED.monthly_amount,
+			daily_count = EXCLUDED.daily_count,
+			reason = EXCLUDED.reason,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING updated_at
+	`
+
+	err := s.db.QueryRowContext(ctx, query,
+		override.UserID,
+		override.SingleMax,
+		override.DailyAmount,
+		override.MonthlyAmount,
+		override.DailyCount,
+		override.Reason,
+		override.UpdatedBy,
+	).Scan(&override.UpdatedAt)
+	if err != nil {
+		s.logger.Error("Error saving transfer limit override", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) deleteTransferLimitOverride(ctx context.Context, userID int) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM transfer_limit_overrides WHERE user_id = $1`, userID)
+	if err != nil {
+		s.logger.Error("Error deleting transfer limit override", "error", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("transfer limit override not found")
+	}
+	return nil
+}
+
+// setOverdraftLimit arranges an overdraft of up to limit on the account. A
+// limit cannot be cut below what the account is already overdrawn by.
+func (s *PostgresStore) setOverdraftLimit(ctx context.Context, accountID int, limit float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var balance float64
+	err = tx.QueryRowContext(ctx, `SELECT status, balance FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, accountID).Scan(&status, &balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account", "error", err)
+		return err
+	}
+
+	if status == AccountClosed {
+		return fmt.Errorf("account is closed")
+	}
+	if balance < -limit {
+		return fmt.Errorf("overdraft limit below overdrawn balance")
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET overdraft_limit = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, limit, accountID)
+	if err != nil {
+		s.logger.Error("Error updating overdraft limit", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// chargeOverdrafts charges a day's interest on every overdrawn account and
+// the unarranged-overdraft fee on those beyond their limit. Each account is
+// charged at most once per day, so the job can run as often as it likes.
+// An account that cannot be charged is counted in Failed and left for the
+// next run; the others are still charged.
+func (s *PostgresStore) chargeOverdrafts(ctx context.Context) (*OverdraftRun, error) {
+	query := `
+		SELECT a.id FROM accounts a
+		WHERE a.balance < 0 AND a.deleted_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM overdraft_charges c
+				WHERE c.account_id = a.id AND c.charge_date = CURRENT_DATE
+			)
+		ORDER BY a.id
+	`
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		s.logger.Error("Error fetching overdrawn accounts", "error", err)
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	run := &OverdraftRun{}
+	for _, id := range ids {
+		charge, err := s.chargeOverdraft(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return run, err
+			}
+			s.logger.Error("Error charging overdraft", "account_id", id, "error", err)
+			run.Failed++
+			continue
+		}
+		if charge == nil {
+			continue
+		}
+		run.Accounts++
+		run.Interest += charge.Interest
+		run.Fees += charge.Fee
+	}
+	if run.Failed > 0 {
+		return run, fmt.Errorf("%d of %d overdrawn accounts could not be charged", run.Failed, len(ids))
+	}
+	return run, nil
+}
+
+// chargeOverdraft charges one account in its own transaction and returns
+// nil if there was nothing to charge.
+func (s *PostgresStore) chargeOverdraft(ctx context.Context, accountID int) (*OverdraftCharge, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.lockWithFeeRevenue(ctx, tx, accountID, s.fees.RevenueAccount); err != nil {
+		return nil, err
+	}
+
+	var balance, held, limit float64
+	var accountNumber int64
+	var accountType, currency, status string
+	err = tx.QueryRowContext(ctx, `
+		SELECT balance, held_amount, overdraft_limit, account_number, account_type, currency, status
+		FROM accounts WHERE id = $1 FOR UPDATE
+	`, accountID).Scan(&balance, &held, &limit, &accountNumber, &accountType, &currency, &status)
+	if err != nil {
+		s.logger.Error("Error fetching overdrawn account", "error", err)
+		return nil, err
+	}
+	overdrawn := -balance
+	scale, ok := s.currency.amountScale(currency)
+	if !ok {
+		s.logger.Error("Overdrawn account is in a currency with no amount scale", "account_id", accountID, "currency", currency)
+		return nil, fmt.Errorf("no overdraft fee for this currency")
+	}
+
+	charge := s.overdraft.charge(balance, limit, scale, currency)
+	if charge == nil {
+		return nil, nil
+	}
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO overdraft_charges (account_id, charge_date, balance, interest, fee)
+		VALUES ($1, CURRENT_DATE, $2, $3, $4)
+		ON CONFLICT DO NOTHING
+	`, accountID, balance, charge.Interest, charge.Fee)
+	if err != nil {
+		s.logger.Error("Error recording overdraft charge", "error", err)
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Another run charged this account today
+		return nil, nil
+	}
+
+	for _, entry := range []struct {
+		entryType   string
+		amount      float64
+		description string
+	}{
+		{EntryOverdraftInterest, charge.Interest, "Overdraft interest"},
+		{EntryOverdraftFee, charge.Fee, "Unarranged overdraft fee"},
+	} {
+		if entry.amount == 0 {
+			continue
+		}
+		err := tx.QueryRowContext(ctx, `
+			UPDATE accounts SET balance = balance - $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2 RETURNING balance
+		`, entry.amount, accountID).Scan(&balance)
+		if err != nil {
+			s.logger.Error("Error charging overdraft", "error", err)
+			return nil, err
+		}
+		if err := s.postLedgerEntry(ctx, tx, accountID, entry.entryType, -entry.amount, balance, 0, entry.description); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any overdraft fee from the fee rules is charged on the same days, as
+	// far as the arranged overdraft still covers it
+	fee, err := s.quoteFee(ctx, tx, accountID, accountNumber, accountType, currency, status, FeeOverdraft, overdrawn)
+	if err != nil {
+		return nil, err
+	}
+	if fee = capFee(fee, balance-held+limit, currency); fee != nil {
+		day := s.calendar.today().Format(executeOnLayout)
+		fee.Period = &day
+		if _, err := s.postFee(ctx, tx, fee, accountNumber); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return nil, err
+	}
+	return charge, nil
+}
+
+const holdColumns = `
+	id, account_id, amount, captured_amount, status, description,
+	COALESCE(destination_account, 0), expires_at, created_at, updated_at
+`
+
+func scanHold(row interface{ Scan(...interface{}) error }) (*Hold, error) {
+	hold := &Hold{}
+	err := row.Scan(
+		&hold.ID,
+		&hold.AccountID,
+		&hold.Amount,
+		&hold.CapturedAmount,
+		&hold.Status,
+		&hold.Description,
+		&hold.DestinationAccount,
+		&hold.ExpiresAt,
+		&hold.CreatedAt,
+		&hold.UpdatedAt,
+	)
+	return hold, err
+}
+
+// placeHold reserves hold.Amount on the account. The funds stay in the
+// ledger balance but are no longer available until the hold is captured,
+// released or expires.
+func (s *PostgresStore) placeHold(ctx context.Context, hold *Hold) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var status, currency string
+	var balance, held, overdraftLimit float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT status, currency, balance, held_amount, overdraft_limit
+		FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+	`, hold.AccountID).Scan(&status, &currency, &balance, &held, &overdraftLimit)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account", "error", err)
+		return err
+	}
+
+	if !canDebit(status) {
+		return fmt.Errorf("source account cannot be debited")
+	}
+	if !validAmount(hold.Amount, currency) {
+		return fmt.Errorf("amount is not valid in the account currency")
+	}
+	if balance-held-hold.Amount < -overdraftLimit {
+		return fmt.Errorf("insufficient balance in the account")
+	}
+
+	query := `
+		INSERT INTO holds (account_id, amount, description, destination_account, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5)
+		RETURNING ` + holdColumns
+
+	inserted, err := scanHold(tx.QueryRowContext(ctx, query, hold.AccountID, hold.Amount, hold.Description, hold.DestinationAccount, hold.ExpiresAt))
+	if err != nil {
+		s.logger.Error("Error placing hold", "error", err)
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET held_amount = held_amount + $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, hold.Amount, hold.AccountID)
+	if err != nil {
+		s.logger.Error("Error updating held amount", "error", err)
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return err
+	}
+	*hold = *inserted
+	return nil
+}
+
+func (s *PostgresStore) getHold(ctx context.Context, id int) (*Hold, error) {
+	hold, err := scanHold(s.db.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("hold not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching hold", "error", err)
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (s *PostgresStore) listHolds(ctx context.Context, accountID int) ([]*Hold, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE account_id = $1 ORDER BY id DESC`, accountID)
+	if err != nil {
+		s.logger.Error("Error fetching holds", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []*Hold{}
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			s.logger.Error("Error scanning hold", "error", err)
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// lockActiveHold locks a hold and its account, in that order, and checks
+// that the hold can still be settled.
+func (s *PostgresStore) lockActiveHold(ctx context.Context, tx *sql.Tx, id int) (*Hold, error) {
+	hold, err := scanHold(tx.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("hold not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching hold", "error", err)
+		return nil, err
+	}
+	if hold.Status != HoldActive {
+		return nil, fmt.Errorf("hold is not active")
+	}
+	if !hold.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("hold has expired")
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM accounts WHERE id = $1 FOR UPDATE`, hold.AccountID); err != nil {
+		s.logger.Error("Error locking account", "error", err)
+		return nil, err
+	}
+	return hold, nil
+}
+
+// captureHold settles amount of an active hold: the account is debited
+// and, for holds with a destination, that account credited. Whatever is
+// left of the hold is released.
+func (s *PostgresStore) captureHold(ctx context.Context, id int, amount float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	hold, err := s.lockActiveHold(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+	if amount > hold.Amount {
+		return fmt.Errorf("capture exceeds the held amount")
+	}
+	var currency string
+	if err := tx.QueryRowContext(ctx, `SELECT currency FROM accounts WHERE id = $1`, hold.AccountID).Scan(&currency); err != nil {
+		s.logger.Error("Error fetching account currency", "error", err)
+		return err
+	}
+	if !validAmount(amount, currency) {
+		return fmt.Errorf("amount is not valid in the account currency")
+	}
+
+	var destination struct {
+		id           int
+		status       string
+		sameCurrency bool
+	}
+	if hold.DestinationAccount != 0 {
+		err := tx.QueryRowContext(ctx, `
+			SELECT d.id, d.status, d.currency = a.currency FROM accounts d, accounts a
+			WHERE d.account_number = $1 AND d.deleted_at IS NULL AND a.id = $2
+			FOR UPDATE OF d
+		`, hold.DestinationAccount, hold.AccountID).Scan(&destination.id, &destination.status, &destination.sameCurrency)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("destination account not found")
+		}
+		if err != nil {
+			s.logger.Error("Error fetching destination account", "error", err)
+			return err
+		}
+		if !canCredit(destination.status) {
+			return fmt.Errorf("destination account cannot be credited")
+		}
+		if !destination.sameCurrency {
+			return fmt.Errorf("accounts are in different currencies")
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE holds SET status = $1, captured_amount = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3
+	`, HoldCaptured, amount, id)
+	if err != nil {
+		s.logger.Error("Error capturing hold", "error", err)
+		return err
+	}
+
+	var balance float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts
+		SET balance = balance - $1, held_amount = held_amount - $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+		RETURNING balance
+	`, amount, hold.Amount, hold.AccountID).Scan(&balance)
+	if err != nil {
+		s.logger.Error("Error debiting held funds", "error", err)
+		return err
+	}
+	if err := s.postLedgerEntry(ctx, tx, hold.AccountID, EntryHoldCapture, -amount, balance, hold.DestinationAccount, holdDescription(hold)); err != nil {
+		return err
+	}
+
+	if hold.DestinationAccount != 0 {
+		var sourceNumber int64
+		if err := tx.QueryRowContext(ctx, `SELECT account_number FROM accounts WHERE id = $1`, hold.AccountID).Scan(&sourceNumber); err != nil {
+			s.logger.Error("Error fetching source account", "error", err)
+			return err
+		}
+		var destinationBalance float64
+		err := tx.QueryRowContext(ctx, `
+			UPDATE accounts SET balance = balance + $1, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $2 RETURNING balance
+		`, amount, destination.id).Scan(&destinationBalance)
+		if err != nil {
+			s.logger.Error("Error crediting destination account", "error", err)
+			return err
+		}
+		if err := s.postLedgerEntry(ctx, tx, destination.id, EntryTransferIn, amount, destinationBalance, sourceNumber, holdDescription(hold)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return err
+	}
+	return nil
+}
+
+// releaseHold cancels an active hold, making its funds available again.
+func (s *PostgresStore) releaseHold(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	hold, err := s.lockActiveHold(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE holds SET status = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, HoldReleased, id)
+	if err != nil {
+		s.logger.Error("Error releasing hold", "error", err)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET held_amount = held_amount - $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2`, hold.Amount, hold.AccountID)
+	if err != nil {
+		s.logger.Error("Error updating held amount", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// expireHolds releases every active hold past its expiry and returns how
+// many there were.
+func (s *PostgresStore) expireHolds(ctx context.Context) (int64, error) {
+	query := `
+		WITH expired AS (
+			UPDATE holds SET status = $1, updated_at = CURRENT_TIMESTAMP
+			WHERE status = $2 AND expires_at <= CURRENT_TIMESTAMP
+			RETURNING account_id, amount
+		), released AS (
+			UPDATE accounts a
+			SET held_amount = a.held_amount - e.total, updated_at = CURRENT_TIMESTAMP
+			FROM (SELECT account_id, SUM(amount) AS total FROM expired GROUP BY account_id) e
+			WHERE a.id = e.account_id
+		)
+		SELECT COUNT(*) FROM expired
+	`
+
+	var count int64
+	if err := s.db.QueryRowContext(ctx, query, HoldExpired, HoldActive).Scan(&count); err != nil {
+		s.logger.Error("Error expiring holds", "error", err)
+		return 0, err
+	}
+	return count, nil
+}
+
+const scheduledTransferColumns = `
+	id, user_id, from_account, to_account, amount, currency, to_char(execute_on, 'YYYY-MM-DD'),
+	status, attempts, last_error, next_attempt_at, executed_at, standing_order_id, created_at, updated_at
+`
+
+func scanScheduledTransfer(row interface{ Scan(...interface{}) error }) (*ScheduledTransfer, error) {
+	transfer := &ScheduledTransfer{}
+	err := row.Scan(
+		&transfer.ID,
+		&transfer.UserID,
+		&transfer.FromAccount,
+		&transfer.ToAccount,
+		&transfer.Amount,
+		&transfer.Currency,
+		&transfer.ExecuteOn,
+		&transfer.Status,
+		&transfer.Attempts,
+		&transfer.LastError,
+		&transfer.NextAttemptAt,
+		&transfer.ExecutedAt,
+		&transfer.StandingOrderID,
+		&transfer.CreatedAt,
+		&transfer.UpdatedAt,
+	)
+	return transfer, err
+}
+
+func (s *PostgresStore) createScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	query := `
+		INSERT INTO scheduled_transfers (user_id, from_account, to_account, amount, currency, execute_on)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING ` + scheduledTransferColumns
+
+	inserted, err := scanScheduledTransfer(s.db.QueryRowContext(ctx, query,
+		transfer.UserID,
+		transfer.FromAccount,
+		transfer.ToAccount,
+		transfer.Amount,
+		transfer.Currency,
+		transfer.ExecuteOn,
+	))
+	if err != nil {
+		s.logger.Error("Error scheduling transfer", "error", err)
+		return err
+	}
+	*transfer = *inserted
+	return nil
+}
+
+func (s *PostgresStore) getScheduledTransfer(ctx context.Context, id int) (*ScheduledTransfer, error) {
+	transfer, err := scanScheduledTransfer(s.db.QueryRowContext(ctx, `SELECT `+scheduledTransferColumns+` FROM scheduled_transfers WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("scheduled transfer not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching scheduled transfer", "error", err)
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func (s *PostgresStore) listScheduledTransfers(ctx context.Context, userID int) ([]*ScheduledTransfer, error) {
+	query := `SELECT ` + scheduledTransferColumns + ` FROM scheduled_transfers WHERE user_id = $1 ORDER BY execute_on, id`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		s.logger.Error("Error fetching scheduled transfers", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*ScheduledTransfer{}
+	for rows.Next() {
+		transfer, err := scanScheduledTransfer(rows)
+		if err != nil {
+			s.logger.Error("Error scanning scheduled transfer", "error", err)
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// cancelScheduledTransfer cancels one of userID's pending transfers.
+func (s *PostgresStore) cancelScheduledTransfer(ctx context.Context, id, userID int) error {
+	var status string
+	err := s.db.QueryRowContext(ctx, `
+		WITH target AS (
+			SELECT id, status FROM scheduled_transfers WHERE id = $1 AND user_id = $2 FOR UPDATE
+		), cancelled AS (
+			UPDATE scheduled_transfers t
+			SET status = $3, updated_at = CURRENT_TIMESTAMP
+			FROM target
+			WHERE t.id = target.id AND target.status = $4
+		)
+		SELECT status FROM target
+	`, id, userID, ScheduledCancelled, ScheduledPending).Scan(&status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("scheduled transfer not found")
+	}
+	if err != nil {
+		s.logger.Error("Error cancelling scheduled transfer", "error", err)
+		return err
+	}
+	if status != ScheduledPending {
+		return fmt.Errorf("scheduled transfer is not pending")
+	}
+	return nil
+}
+
+// claimDueTransfers marks up to limit due transfers as processing and
+// returns them. SKIP LOCKED lets several instances claim side by side
+// without ever handing the same transfer to two of them.
+func (s *PostgresStore) claimDueTransfers(ctx context.Context, limit int) ([]*ScheduledTransfer, error) {
+	query := `
+		UPDATE scheduled_transfers
+		SET status = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id IN (
+			SELECT id FROM scheduled_transfers
+			WHERE status = $2 AND execute_on <= CURRENT_DATE AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY execute_on, id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + scheduledTransferColumns
+
+	rows, err := s.db.QueryContext(ctx, query, ScheduledProcessing, ScheduledPending, limit)
+	if err != nil {
+		s.logger.Error("Error claiming scheduled transfers", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*ScheduledTransfer{}
+	for rows.Next() {
+		transfer, err := scanScheduledTransfer(rows)
+		if err != nil {
+			s.logger.Error("Error scanning scheduled transfer", "error", err)
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// finishScheduledTransfer records the outcome of an execution attempt.
+func (s *PostgresStore) finishScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	query := `
+		UPDATE scheduled_transfers
+		SET status = $1, attempts = $2, last_error = LEFT($3, 255), next_attempt_at = $4,
+			executed_at = $5, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $6
+	`
+
+	_, err := s.db.ExecContext(ctx, query,
+		transfer.Status,
+		transfer.Attempts,
+		transfer.LastError,
+		transfer.NextAttemptAt,
+		transfer.ExecutedAt,
+		transfer.ID,
+	)
+	if err != nil {
+		s.logger.Error("Error updating scheduled transfer", "error", err)
+		return err
+	}
+	return nil
+}
+
+const standingOrderColumns = `
+	id, user_id, from_account, to_account, amount, currency, description,
+	frequency, interval_count, day_of_month, last_business_day,
+	to_char(start_date, 'YYYY-MM-DD'), to_char(end_date, 'YYYY-MM-DD'), max_occurrences,
+	occurrences, sequence, to_char(next_run_on, 'YYYY-MM-DD'), status, created_at, updated_at
+`
+
+func scanStandingOrder(row interface{ Scan(...interface{}) error }) (*StandingOrder, error) {
+	order := &StandingOrder{}
+	err := row.Scan(
+		&order.ID,
+		&order.UserID,
+		&order.FromAccount,
+		&order.ToAccount,
+		&order.Amount,
+		&order.Currency,
+		&order.Description,
+		&order.Rule.Frequency,
+		&order.Rule.Interval,
+		&order.Rule.DayOfMonth,
+		&order.Rule.LastBusinessDay,
+		&order.StartDate,
+		&order.EndDate,
+		&order.MaxOccurrences,
+		&order.Occurrences,
+		&order.Sequence,
+		&order.NextRunOn,
+		&order.Status,
+		&order.CreatedAt,
+		&order.UpdatedAt,
+	)
+	return order, err
+}
+
+func (s *PostgresStore) createStandingOrder(ctx context.Context, order *StandingOrder) error {
+	query := `
+		INSERT INTO standing_orders (
+			user_id, from_account, to_account, amount, currency, description,
+			frequency, interval_count, day_of_month, last_business_day,
+			start_date, end_date, max_occurrences, sequence, next_run_on, status
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		RETURNING ` + standingOrderColumns
+
+	inserted, err := scanStandingOrder(s.db.QueryRowContext(ctx, query,
+		order.UserID,
+		order.FromAccount,
+		order.ToAccount,
+		order.Amount,
+		order.Currency,
+		order.Description,
+		order.Rule.Frequency,
+		order.Rule.Interval,
+		order.Rule.DayOfMonth,
+		order.Rule.LastBusinessDay,
+		order.StartDate,
+		order.EndDate,
+		order.MaxOccurrences,
+		order.Sequence,
+		order.NextRunOn,
+		order.Status,
+	))
+	if err != nil {
+		s.logger.Error("Error creating standing order", "error", err)
+		return err
+	}
+	*order = *inserted
+	return nil
+}
+
+func (s *PostgresStore) getStandingOrder(ctx context.Context, id int) (*StandingOrder, error) {
+	order, err := scanStandingOrder(s.db.QueryRowContext(ctx, `SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("standing order not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching standing order", "error", err)
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *PostgresStore) listStandingOrders(ctx context.Context, userID int) ([]*StandingOrder, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+standingOrderColumns+` FROM standing_orders WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		s.logger.Error("Error fetching standing orders", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*StandingOrder{}
+	for rows.Next() {
+		order, err := scanStandingOrder(rows)
+		if err != nil {
+			s.logger.Error("Error scanning standing order", "error", err)
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+// saveStandingOrderSchedule writes back the fields that change as an order
+// runs.
+func (s *PostgresStore) saveStandingOrderSchedule(ctx context.Context, db execer, order *StandingOrder) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE standing_orders
+		SET status = $1, occurrences = $2, sequence = $3, next_run_on = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $5
+	`, order.Status, order.Occurrences, order.Sequence, order.NextRunOn, order.ID)
+	if err != nil {
+		s.logger.Error("Error updating standing order", "error", err)
+		return err
+	}
+	return nil
+}
+
+// insertStandingOrderTransfer adds the order's current occurrence to
+// scheduled_transfers with the given status.
+func (s *PostgresStore) insertStandingOrderTransfer(ctx context.Context, db execer, order *StandingOrder, status string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO scheduled_transfers (user_id, from_account, to_account, amount, currency, execute_on, status, standing_order_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, order.UserID, order.FromAccount, order.ToAccount, order.Amount, order.Currency, *order.NextRunOn, status, order.ID)
+	if err != nil {
+		s.logger.Error("Error scheduling standing order transfer", "error", err)
+		return err
+	}
+	return nil
+}
+
+// changeStandingOrder pauses, resumes, skips or cancels an order. A skipped
+// occurrence is kept in the order's history.
+func (s *PostgresStore) changeStandingOrder(ctx context.Context, id int, action string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := scanStandingOrder(tx.QueryRowContext(ctx, `SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("standing order not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching standing order", "error", err)
+		return err
+	}
+
+	if action == StandingOrderSkip && order.NextRunOn != nil {
+		if err := s.insertStandingOrderTransfer(ctx, tx, order, ScheduledSkipped); err != nil {
+			return err
+		}
+	}
+	if !order.apply(s.calendar, action, s.calendar.today()) {
+		return fmt.Errorf("invalid standing order action")
+	}
+	if err := s.saveStandingOrderSchedule(ctx, tx, order); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) getStandingOrderHistory(ctx context.Context, id int) ([]*ScheduledTransfer, error) {
+	query := `SELECT ` + scheduledTransferColumns + ` FROM scheduled_transfers WHERE standing_order_id = $1 ORDER BY execute_on DESC, id DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, id)
+	if err != nil {
+		s.logger.Error("Error fetching standing order history", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*ScheduledTransfer{}
+	for rows.Next() {
+		transfer, err := scanScheduledTransfer(rows)
+		if err != nil {
+			s.logger.Error("Error scanning scheduled transfer", "error", err)
+			return nil, err
+		}
+		history = append(history, transfer)
+	}
+	return history, rows.Err()
+}
+
+// generateStandingOrderTransfers turns every occurrence of an active
+// standing order due by today into a scheduled transfer, which the
+// scheduler then executes. It returns how many it created.
+func (s *PostgresStore) generateStandingOrderTransfers(ctx context.Context, today time.Time) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id FROM standing_orders
+		WHERE status = $1 AND next_run_on <= $2
+		ORDER BY id
+	`, StandingOrderActive, today.Format(executeOnLayout))
+	if err != nil {
+		s.logger.Error("Error fetching due standing orders", "error", err)
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, id := range ids {
+		n, err := s.generateStandingOrderTransfer(ctx, id, today)
+		created += n
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+func (s *PostgresStore) generateStandingOrderTransfer(ctx context.Context, id int, today time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	order, err := scanStandingOrder(tx.QueryRowContext(ctx, `SELECT `+standingOrderColumns+` FROM standing_orders WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		s.logger.Error("Error fetching standing order", "error", err)
+		return 0, err
+	}
+
+	// Another instance may have got here first, in which case nothing is due
+	due := today.Format(executeOnLayout)
+	created := 0
+	for order.Status == StandingOrderActive && order.NextRunOn != nil && *order.NextRunOn <= due {
+		if err := s.insertStandingOrderTransfer(ctx, tx, order, ScheduledPending); err != nil {
+			return 0, err
+		}
+		order.advance(s.calendar)
+		created++
+	}
+	if created == 0 {
+		return 0, nil
+	}
+	if err := s.saveStandingOrderSchedule(ctx, tx, order); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return 0, err
+	}
+	return created, nil
+}
+
+func (s *PostgresStore) createNotification(ctx context.Context, notification *Notification) error {
+	query := `
+		INSERT INTO notifications (user_id, kind, message)
+		VALUES ($1, $2, LEFT($3, 500))
+		RETURNING id, created_at
+	`
+
+	err := s.db.QueryRowContext(ctx, query, notification.UserID, notification.Kind, notification.Message).Scan(&notification.ID, &notification.CreatedAt)
+	if err != nil {
+		s.logger.Error("Error creating notification", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) listNotifications(ctx context.Context, userID int, unreadOnly bool) ([]*Notification, error) {
+	query := `
+		SELECT id, user_id, kind, message, read_at, created_at
+		FROM notifications
+		WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+		ORDER BY id DESC
+		LIMIT 100
+	`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, unreadOnly)
+	if err != nil {
+		s.logger.Error("Error fetching notifications", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []*Notification{}
+	for rows.Next() {
+		n := &Notification{}
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.Message, &n.ReadAt, &n.CreatedAt); err != nil {
+			s.logger.Error("Error scanning notification", "error", err)
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *PostgresStore) markNotificationRead(ctx context.Context, id, userID int) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND user_id = $2
+	`, id, userID)
+	if err != nil {
+		s.logger.Error("Error marking notification read", "error", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("notification not found")
+	}
+	return nil
+}
+
+const interestProductColumns = `id, name, day_count, tiers, created_at`
+
+func scanInterestProduct(row interface{ Scan(...interface{}) error }) (*InterestProduct, error) {
+	product := &InterestProduct{}
+	var tiers string
+	if err := row.Scan(&product.ID, &product.Name, &product.DayCount, &tiers, &product.CreatedAt); err != nil {
+		return nil, err
+	}
+	return product, json.Unmarshal([]byte(tiers), &product.Tiers)
+}
+
+func (s *PostgresStore) createInterestProduct(ctx context.Context, product *InterestProduct) error {
+	tiers, err := json.Marshal(product.Tiers)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		INSERT INTO interest_products (name, day_count, tiers)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, product.Name, product.DayCount, string(tiers)).Scan(&product.ID, &product.CreatedAt)
+	if err != nil {
+		s.logger.Error("Error creating interest product", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) interestProduct(ctx context.Context, db queryRower, id int) (*InterestProduct, error) {
+	product, err := scanInterestProduct(db.QueryRowContext(ctx,
+		`SELECT `+interestProductColumns+` FROM interest_products WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("interest product not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching interest product", "error", err)
+		return nil, err
+	}
+	return product, nil
+}
+
+func (s *PostgresStore) listInterestProducts(ctx context.Context) ([]*InterestProduct, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+interestProductColumns+` FROM interest_products ORDER BY id`)
+	if err != nil {
+		s.logger.Error("Error fetching interest products", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []*InterestProduct{}
+	for rows.Next() {
+		product, err := scanInterestProduct(rows)
+		if err != nil {
+			s.logger.Error("Error scanning interest product", "error", err)
+			return nil, err
+		}
+		products = append(products, product)
+	}
+	return products, rows.Err()
+}
+
+// setAccountInterestProduct puts a savings account on a product, or takes
+// it off with productID zero. Interest already accrued is still paid at
+// month end.
+func (s *PostgresStore) setAccountInterestProduct(ctx context.Context, accountID, productID int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+
+	var status, accountType string
+	err = tx.QueryRowContext(ctx, `SELECT status, account_type FROM accounts WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, accountID).Scan(&status, &accountType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("account not found")
+		}
+		s.logger.Error("Error fetching account", "error", err)
+		return err
+	}
+
+	if status == AccountClosed {
+		return fmt.Errorf("account is closed")
+	}
+	if accountType != AccountTypeSavings {
+		return fmt.Errorf("account is not a savings account")
+	}
+	if productID != 0 {
+		if _, err := s.interestProduct(ctx, tx, productID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE accounts SET interest_product_id = NULLIF($1, 0), updated_at = CURRENT_TIMESTAMP WHERE id = $2`, productID, accountID)
+	if err != nil {
+		s.logger.Error("Error updating interest product", "error", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getInterestSummary returns the account's product and the accruals not
+// yet capitalised.
+func (s *PostgresStore) getInterestSummary(ctx context.Context, accountID int) (*InterestSummary, error) {
+	summary := &InterestSummary{AccountID: accountID, Accruals: []*InterestAccrual{}}
+
+	var productID sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `SELECT interest_product_id, interest_carried FROM accounts WHERE id = $1`, accountID).Scan(&productID, &summary.Carried)
+	if err != nil {
+		s.logger.Error("Error fetching account", "error", err)
+		return nil, err
+	}
+	if productID.Valid {
+		if summary.Product, err = s.interestProduct(ctx, s.db, int(productID.Int64)); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT to_char(accrual_date, 'YYYY-MM-DD'), product_id, balance, amount
+		FROM interest_accruals
+		WHERE account_id = $1 AND capitalised_on IS NULL
+		ORDER BY accrual_date
+	`, accountID)
+	if err != nil {
+		s.logger.Error("Error fetching interest accruals", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		accrual := &InterestAccrual{}
+		if err := rows.Scan(&accrual.AccrualDate, &accrual.ProductID, &accrual.Balance, &accrual.Amount); err != nil {
+			s.logger.Error("Error scanning interest accrual", "error", err)
+			return nil, err
+		}
+		summary.Accruals = append(summary.Accruals, accrual)
+		summary.Accrued += accrual.Amount
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	summary.Accrued = roundAccrual(summary.Accrued + summary.Carried)
+
+	// What was paid is on the ledger: the accruals capitalised that day
+	// also include amounts carried into and out of the month
+	var capitalisedOn string
+	err = s.db.QueryRowContext(ctx, `
+		SELECT to_char(i.capitalised_on, 'YYYY-MM-DD'), COALESCE((
+			SELECT l.amount FROM ledger_entries l
+			WHERE l.account_id = i.account_id AND l.entry_type = $2
+			AND l.description = 'Interest to ' || to_char(i.capitalised_on, 'YYYY-MM-DD')
+			ORDER BY l.id DESC LIMIT 1
+		), 0)
+		FROM interest_accruals i
+		WHERE i.account_id = $1 AND i.capitalised_on IS NOT NULL
+		ORDER BY i.capitalised_on DESC
+		LIMIT 1
+	`, accountID, EntryInterest).Scan(&capitalisedOn, &summary.LastCapitalisation)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		s.logger.Error("Error fetching last capitalisation", "error", err)
+		return nil, err
+	default:
+		summary.LastCapitalisedOn = &capitalisedOn
+	}
+
+	return summary, nil
+}
+
+// runInterest accrues a day's interest on every savings account with a
+// product and, if date is a month end, capitalises what each account has
+// accrued. Accounts already accrued for date are skipped, so the run can
+// be repeated for the same date without posting twice. An account that
+// fails is counted in Failed and picked up again by the next run.
+func (s *PostgresStore) runInterest(ctx context.Context, date time.Time) (*InterestRun, error) {
+	query := `
+		SELECT a.id FROM accounts a
+		WHERE a.deleted_at IS NULL AND a.created_at::date <= $1
+			AND (
+				(a.interest_product_id IS NOT NULL AND a.status <> '` + AccountClosed + `'
+					AND NOT EXISTS (
+						SELECT 1 FROM interest_accruals i
+						WHERE i.account_id = a.id AND i.accrual_date = $1
+					))
+				OR ($2 AND EXISTS (
+					SELECT 1 FROM interest_accruals i
+					WHERE i.account_id = a.id AND i.capitalised_on IS NULL AND i.accrual_date <= $1
+				))
+			)
+		ORDER BY a.id
+	`
+
+	run := &InterestRun{Date: date.Format(executeOnLayout)}
+	rows, err := s.db.QueryContext(ctx, query, run.Date, isMonthEnd(date))
+	if err != nil {
+		s.logger.Error("Error fetching interest-bearing accounts", "error", err)
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		accrual, posted, err := s.accrueInterest(ctx, id, date)
+		if err != nil {
+			if ctx.Err() != nil {
+				return run, err
+			}
+			s.logger.Error("Error accruing interest", "account_id", id, "date", run.Date, "error", err)
+			run.Failed++
+			continue
+		}
+		if accrual == nil && posted == 0 {
+			continue
+		}
+		run.Accounts++
+		if accrual != nil {
+			run.Accrued += accrual.Amount
+		}
+		if posted > 0 {
+			run.Capitalised++
+			run.Posted += posted
+		}
+	}
+	run.Accrued = roundAccrual(run.Accrued)
+	run.Posted = roundCents(run.Posted)
+	if run.Failed > 0 {
+		return run, fmt.Errorf("%d of %d accounts could not be accrued for %s", run.Failed, len(ids), run.Date)
+	}
+	return run, nil
+}
+
+// accrueInterest accrues and, at month end, capitalises interest on one
+// account in its own transaction. The accrual is on the balance at the end
+// of date by value date, so it comes out the same whenever the run is made.
+func (s *PostgresStore) accrueInterest(ctx context.Context, accountID int, date time.Time) (*InterestAccrual, float64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	var balance, carried float64
+	var productID sql.NullInt64
+	var status, currency string
+	err = tx.QueryRowContext(ctx, `
+		SELECT balance, interest_carried, interest_product_id, status, currency FROM accounts WHERE id = $1 FOR UPDATE
+	`, accountID).Scan(&balance, &carried, &productID, &status, &currency)
+	if err != nil {
+		s.logger.Error("Error fetching savings account", "error", err)
+		return nil, 0, err
+	}
+
+	day := date.Format(executeOnLayout)
+	var accrual *InterestAccrual
+	if productID.Valid && status != AccountClosed {
+		product, err := s.interestProduct(ctx, tx, int(productID.Int64))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Entries settling after date did not count towards its balance
+		var later float64
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE account_id = $1 AND value_date > $2`, accountID, day).Scan(&later)
+		if err != nil {
+			s.logger.Error("Error fetching value-dated balance", "error", err)
+			return nil, 0, err
+		}
+
+		accrual = &InterestAccrual{AccrualDate: day, ProductID: product.ID, Balance: roundCents(balance - later)}
+		accrual.Amount = product.dailyInterest(accrual.Balance, date)
+
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO interest_accruals (account_id, accrual_date, product_id, balance, amount)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+		`, accountID, day, accrual.ProductID, accrual.Balance, accrual.Amount)
+		if err != nil {
+			s.logger.Error("Error recording interest accrual", "error", err)
+			return nil, 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// Another run accrued this account for date
+			accrual = nil
+		}
+	}
+
+	var posted float64
+	if isMonthEnd(date) {
+		err = tx.QueryRowContext(ctx, `
+			WITH capitalised AS (
+				UPDATE interest_accruals SET capitalised_on = $2
+				WHERE account_id = $1 AND capitalised_on IS NULL AND accrual_date <= $2
+				RETURNING amount
+			)
+			SELECT COALESCE(SUM(amount), 0) FROM capitalised
+		`, accountID, day).Scan(&posted)
+		if err != nil {
+			s.logger.Error("Error capitalising interest", "error", err)
+			return nil, 0, err
+		}
+
+		// Only whole minor units are paid; the rest is carried forward
+		posted, carried = splitCapitalisation(posted+carried, currency)
+		err := tx.QueryRowContext(ctx, `
+			UPDATE accounts SET balance = balance + $1, interest_carried = $2, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $3 RETURNING balance
+		`, posted, carried, accountID).Scan(&balance)
+		if err != nil {
+			s.logger.Error("Error crediting interest", "error", err)
+			return nil, 0, err
+		}
+		if posted > 0 {
+			if err := s.postLedgerEntry(ctx, tx, accountID, EntryInterest, posted, balance, 0, "Interest to "+day); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return nil, 0, err
+	}
+	return accrual, posted, nil
+}
+
+const feeRuleColumns = `
+	id, account_type, event, method, amount, rate, tiers, min_fee, max_fee, charge_inactive,
+	updated_by, updated_at
+`
+
+func scanFeeRule(row interface{ Scan(...interface{}) error }) (*FeeRule, error) {
+	rule := &FeeRule{}
+	var tiers string
+	err := row.Scan(
+		&rule.ID,
+		&rule.AccountType,
+		&rule.Event,
+		&rule.Method,
+		&rule.Amount,
+		&rule.Rate,
+		&tiers,
+		&rule.MinFee,
+		&rule.MaxFee,
+		&rule.ChargeInactive,
+		&rule.UpdatedBy,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return rule, json.Unmarshal([]byte(tiers), &rule.Tiers)
+}
+
+func (s *PostgresStore) listFeeRules(ctx context.Context) ([]*FeeRule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+feeRuleColumns+` FROM fee_rules ORDER BY account_type, event`)
+	if err != nil {
+		s.logger.Error("Error fetching fee rules", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []*FeeRule{}
+	for rows.Next() {
+		rule, err := scanFeeRule(rows)
+		if err != nil {
+			s.logger.Error("Error scanning fee rule", "error", err)
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *PostgresStore) setFeeRule(ctx context.Context, rule *FeeRule) error {
+	tiers, err := json.Marshal(rule.Tiers)
+	if err != nil {
+		return err
+	}
+	if rule.Tiers == nil {
+		tiers = []byte("[]")
+	}
+
+	query := `
+		INSERT INTO fee_rules (account_type, event, method, amount, rate, tiers, min_fee, max_fee, charge_inactive, updated_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (account_type, event) DO UPDATE SET
+			method = EXCLUDED.method,
+			amount = EXCLUDED.amount,
+			rate = EXCLUDED.rate,
+			tiers = EXCLUDED.tiers,
+			min_fee = EXCLUDED.min_fee,
+			max_fee = EXCLUDED.max_fee,
+			charge_inactive = EXCLUDED.charge_inactive,
+			updated_by = EXCLUDED.updated_by,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING id, updated_at
+	`
+	err = s.db.QueryRowContext(ctx, query,
+		rule.AccountType,
+		rule.Event,
+		rule.Method,
+		rule.Amount,
+		rule.Rate,
+		string(tiers),
+		rule.MinFee,
+		rule.MaxFee,
+		rule.ChargeInactive,
+		rule.UpdatedBy,
+	).Scan(&rule.ID, &rule.UpdatedAt)
+	if err != nil {
+		s.logger.Error("Error saving fee rule", "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) deleteFeeRule(ctx context.Context, accountType, event string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM fee_rules WHERE account_type = $1 AND event = $2`, accountType, event)
+	if err != nil {
+		s.logger.Error("Error deleting fee rule", "error", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("fee rule not found")
+	}
+	return nil
+}
+
+// quoteFee prices event for an account without charging it. It returns
+// nil when no rule applies, the fee comes to nothing, no revenue account
+// is configured, or the account is the revenue account itself. Fees are
+// only taken from accounts in the revenue account's currency, and from
+// accounts that are not active only if the rule says so.
+func (s *PostgresStore) quoteFee(ctx context.Context, db queryRower, accountID int, accountNumber int64, accountType, currency, status, event string, base float64) (*FeeCharge, error) {
+	if s.fees.RevenueAccount == 0 || accountNumber == s.fees.RevenueAccount {
+		return nil, nil
+	}
+
+	var revenueCurrency string
+	err := db.QueryRowContext(ctx, `SELECT currency FROM accounts WHERE account_number = $1 AND deleted_at IS NULL`, s.fees.RevenueAccount).Scan(&revenueCurrency)
+	if err == sql.ErrNoRows {
+		s.logger.Error("Fee revenue account does not exist", "account_number", s.fees.RevenueAccount)
+		return nil, fmt.Errorf("fee revenue account not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fee revenue account", "error", err)
 		return nil, err
 	}
+	if revenueCurrency != currency {
+		return nil, nil
+	}
 
-	return user, nil
+	rule, err := scanFeeRule(db.QueryRowContext(ctx,
+		`SELECT `+feeRuleColumns+` FROM fee_rules WHERE account_type = $1 AND event = $2`, accountType, event))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fee rule", "error", err)
+		return nil, err
+	}
+	if status != AccountActive && !rule.ChargeInactive {
+		return nil, nil
+	}
+
+	charge := &FeeCharge{
+		AccountID:      accountID,
+		RuleID:         rule.ID,
+		Event:          event,
+		BaseAmount:     roundCents(base),
+		Amount:         rule.fee(base, currency),
+		RevenueAccount: s.fees.RevenueAccount,
+	}
+	if charge.Amount <= 0 {
+		return nil, nil
+	}
+	return charge, nil
 }
 
-func (s *PostgresStore) createUser(user *User) error {
-	query := `
-		INSERT INTO users (username, password)
-		VALUES ($1, $2)
-		RETURNING id, created_at, updated_at;
-	`
+// lockWithFeeRevenue locks an account that pays or is refunded a fee
+// together with the revenue account, in account number order as transfer
+// does, so that fee postings cannot deadlock with transfers.
+func (s *PostgresStore) lockWithFeeRevenue(ctx context.Context, tx *sql.Tx, accountID int, revenueAccount int64) error {
+	_, err := tx.ExecContext(ctx, `
+		SELECT id FROM accounts WHERE id = $1 OR account_number = $2
+		ORDER BY account_number FOR UPDATE
+	`, accountID, revenueAccount)
+	if err != nil {
+		s.logger.Error("Error locking accounts", "error", err)
+	}
+	return err
+}
 
-	err := s.db.QueryRow(
-		query,
-		user.Username,
-		user.Password,
-	).Scan(
-		&user.ID,
-		&user.CreatedAt,
-		&user.UpdatedAt,
+// postFee moves a quoted fee from the account to the revenue account in
+// tx. It returns false if a periodic fee was already charged for the
+// period.
+func (s *PostgresStore) postFee(ctx context.Context, tx *sql.Tx, charge *FeeCharge, accountNumber int64) (bool, error) {
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO fee_charges (account_id, rule_id, event, base_amount, amount, period, revenue_account)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING
+		RETURNING id, created_at
+	`, charge.AccountID, charge.RuleID, charge.Event, charge.BaseAmount, charge.Amount, charge.Period, charge.RevenueAccount).Scan(&charge.ID, &charge.CreatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		s.logger.Error("Error recording fee", "error", err)
+		return false, err
+	}
+
+	var balance float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts SET balance = balance - $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 RETURNING balance
+	`, charge.Amount, charge.AccountID).Scan(&balance)
+	if err != nil {
+		s.logger.Error("Error charging fee", "error", err)
+		return false, err
+	}
+	if err := s.postLedgerEntry(ctx, tx, charge.AccountID, EntryFee, -charge.Amount, balance, charge.RevenueAccount, feeDescription(charge.Event)); err != nil {
+		return false, err
+	}
+
+	var revenueID int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts SET balance = balance + $1, updated_at = CURRENT_TIMESTAMP
+		WHERE account_number = $2 AND deleted_at IS NULL RETURNING id, balance
+	`, charge.Amount, charge.RevenueAccount).Scan(&revenueID, &balance)
+	if err == sql.ErrNoRows {
+		s.logger.Error("Fee revenue account does not exist", "account_number", charge.RevenueAccount)
+		return false, fmt.Errorf("fee revenue account not found")
+	}
+	if err != nil {
+		s.logger.Error("Error crediting fee revenue", "error", err)
+		return false, err
+	}
+	if err := s.postLedgerEntry(ctx, tx, revenueID, EntryFee, charge.Amount, balance, accountNumber, feeDescription(charge.Event)); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+const feeColumns = `
+	id, account_id, rule_id, event, base_amount, amount, to_char(period, 'YYYY-MM-DD'),
+	revenue_account, waived_by, COALESCE(waiver_reason, ''), waived_at, created_at
+`
+
+func scanFee(row interface{ Scan(...interface{}) error }) (*FeeCharge, error) {
+	fee := &FeeCharge{}
+	err := row.Scan(
+		&fee.ID,
+		&fee.AccountID,
+		&fee.RuleID,
+		&fee.Event,
+		&fee.BaseAmount,
+		&fee.Amount,
+		&fee.Period,
+		&fee.RevenueAccount,
+		&fee.WaivedBy,
+		&fee.WaiverReason,
+		&fee.WaivedAt,
+		&fee.CreatedAt,
 	)
+	return fee, err
+}
+
+func (s *PostgresStore) getFee(ctx context.Context, id int) (*FeeCharge, error) {
+	fee, err := scanFee(s.db.QueryRowContext(ctx, `SELECT `+feeColumns+` FROM fee_charges WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("fee not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fee", "error", err)
+		return nil, err
+	}
+	return fee, nil
+}
+
+func (s *PostgresStore) listFees(ctx context.Context, accountID int) ([]*FeeCharge, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+feeColumns+` FROM fee_charges WHERE account_id = $1 ORDER BY id DESC`, accountID)
+	if err != nil {
+		s.logger.Error("Error fetching fees", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	fees := []*FeeCharge{}
+	for rows.Next() {
+		fee, err := scanFee(rows)
+		if err != nil {
+			s.logger.Error("Error scanning fee", "error", err)
+			return nil, err
+		}
+		fees = append(fees, fee)
+	}
+	return fees, rows.Err()
+}
+
+// waiveFee refunds a fee from the revenue account it was paid to.
+func (s *PostgresStore) waiveFee(ctx context.Context, id int, waivedBy, reason string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("Error inserting user: %v", err)
+		s.logger.Error("Error starting transaction", "error", err)
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	fee, err := scanFee(tx.QueryRowContext(ctx, `SELECT `+feeColumns+` FROM fee_charges WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("fee not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fee", "error", err)
+		return err
+	}
+	if fee.WaivedAt != nil {
+		return fmt.Errorf("fee already waived")
+	}
+
+	if err := s.lockWithFeeRevenue(ctx, tx, fee.AccountID, fee.RevenueAccount); err != nil {
+		return err
+	}
+
+	var status, currency string
+	var accountNumber int64
+	err = tx.QueryRowContext(ctx, `SELECT status, account_number, currency FROM accounts WHERE id = $1 FOR UPDATE`, fee.AccountID).Scan(&status, &accountNumber, &currency)
+	if err != nil {
+		s.logger.Error("Error fetching account", "error", err)
+		return err
+	}
+	if status == AccountClosed {
+		return fmt.Errorf("account is closed")
+	}
+
+	var balance float64
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts SET balance = balance + $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 RETURNING balance
+	`, fee.Amount, fee.AccountID).Scan(&balance)
+	if err != nil {
+		s.logger.Error("Error refunding fee", "error", err)
+		return err
+	}
+	if err := s.postLedgerEntry(ctx, tx, fee.AccountID, EntryFeeRefund, fee.Amount, balance, fee.RevenueAccount, feeDescription(fee.Event)+" waived"); err != nil {
+		return err
+	}
+
+	// As when charging, the revenue account must exist and share the
+	// account's currency
+	var revenueID int
+	err = tx.QueryRowContext(ctx, `
+		UPDATE accounts SET balance = balance - $1, updated_at = CURRENT_TIMESTAMP
+		WHERE account_number = $2 AND deleted_at IS NULL AND currency = $3 RETURNING id, balance
+	`, fee.Amount, fee.RevenueAccount, currency).Scan(&revenueID, &balance)
+	if err == sql.ErrNoRows {
+		s.logger.Error("Fee revenue account does not exist", "account_number", fee.RevenueAccount, "currency", currency)
+		return fmt.Errorf("fee revenue account not found")
+	}
+	if err != nil {
+		s.logger.Error("Error debiting fee revenue", "error", err)
+		return err
+	}
+	if err := s.postLedgerEntry(ctx, tx, revenueID, EntryFeeRefund, -fee.Amount, balance, accountNumber, feeDescription(fee.Event)+" waived"); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE fee_charges SET waived_by = $1, waiver_reason = $2, waived_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, waivedBy, reason, id)
+	if err != nil {
+		s.logger.Error("Error recording fee waiver", "error", err)
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (s *PostgresStore) getUserDetails(id int) (getUserDetailsRequest, error) {
-	// Initialize an empty getUserDetailsRequest struct to store the result
-	var user getUserDetailsRequest
+// chargeMaintenanceFees charges the monthly maintenance fee for the month
+// starting period on every open account that existed during it. Each
+// account is charged at most once per month; one that fails is counted in
+// Failed and tried again by the next run.
+func (s *PostgresStore) chargeMaintenanceFees(ctx context.Context, period time.Time) (*FeeRun, error) {
+	run := &FeeRun{Period: period.Format(executeOnLayout)}
+	if s.fees.RevenueAccount == 0 {
+		return run, nil
+	}
 
 	query := `
-		SELECT
-			u.id,
-			u.username,
-			a.id AS account_id,
-			a.first_name AS account_first_name,
-			a.last_name AS account_last_name,
-			a.hobby AS account_hobby,
-			a.age AS account_age,
-			a.account_number AS bank_account,
-			a.balance AS account_balance
-			
-		FROM
-			users u
-		LEFT JOIN
-			accounts a
-		ON
-			u.id = a.user_id
-		WHERE
-			u.id = $1
+		SELECT a.id FROM accounts a
+		JOIN fee_rules r ON r.account_type = a.account_type AND r.event = '` + FeeMonthlyMaintenance + `'
+		WHERE a.deleted_at IS NULL AND a.status <> '` + AccountClosed + `'
+			AND (a.status = '` + AccountActive + `' OR r.charge_inactive)
+			AND a.account_number <> $2
+			AND a.created_at < $1::date + INTERVAL '1 month'
+			AND NOT EXISTS (
+				SELECT 1 FROM fee_charges f
+				WHERE f.account_id = a.id AND f.event = r.event AND f.period = $1
+			)
+		ORDER BY a.id
 	`
 
-	rows, err := s.db.Query(query, id)
-	//fmt.Println(rows)
+	rows, err := s.db.QueryContext(ctx, query, run.Period, s.fees.RevenueAccount)
 	if err != nil {
-		log.Printf("Error retrieving user and accounts: %v", err)
-		return user, err
+		s.logger.Error("Error fetching accounts due a maintenance fee", "error", err)
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-	defer rows.Close()
 
-	// Map to store user and associated accounts
-	userAccountsMap := make(map[int]getUserDetailsRequest)
+	for _, id := range ids {
+		fee, err := s.chargeMaintenanceFee(ctx, id, run.Period)
+		if err != nil {
+			if ctx.Err() != nil {
+				return run, err
+			}
+			s.logger.Error("Error charging maintenance fee", "account_id", id, "period", run.Period, "error", err)
+			run.Failed++
+			continue
+		}
+		if fee == nil {
+			continue
+		}
+		run.Accounts++
+		run.Amount += fee.Amount
+	}
+	run.Amount = roundCents(run.Amount)
+	if run.Failed > 0 {
+		return run, fmt.Errorf("%d of %d accounts could not be charged a maintenance fee", run.Failed, len(ids))
+	}
+	return run, nil
+}
 
-	// Iterate through the rows and populate the user and accounts map
+// chargeMaintenanceFee charges one account in its own transaction and
+// returns nil if there was nothing to charge. Percentage rules are applied
+// to the current balance, and the fee is capped at what the account can
+// pay.
+func (s *PostgresStore) chargeMaintenanceFee(ctx context.Context, accountID int, period string) (*FeeCharge, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := s.lockWithFeeRevenue(ctx, tx, accountID, s.fees.RevenueAccount); err != nil {
+		return nil, err
+	}
+
+	var accountNumber int64
+	var accountType, currency, status string
+	var balance, held, limit float64
+	err = tx.QueryRowContext(ctx, `
+		SELECT account_number, account_type, currency, status, balance, held_amount, overdraft_limit
+		FROM accounts WHERE id = $1 FOR UPDATE
+	`, accountID).Scan(&accountNumber, &accountType, &currency, &status, &balance, &held, &limit)
+	if err != nil {
+		s.logger.Error("Error fetching account", "error", err)
+		return nil, err
+	}
+
+	fee, err := s.quoteFee(ctx, tx, accountID, accountNumber, accountType, currency, status, FeeMonthlyMaintenance, max(balance, 0))
+	if err != nil {
+		return nil, err
+	}
+	if fee = capFee(fee, balance-held+limit, currency); fee == nil {
+		return nil, nil
+	}
+	fee.Period = &period
+	posted, err := s.postFee(ctx, tx, fee, accountNumber)
+	if err != nil || !posted {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return nil, err
+	}
+	return fee, nil
+}
+
+func (s *PostgresStore) listFXRates(ctx context.Context) ([]*FXRate, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT base, quote, rate, source, updated_by, updated_at FROM fx_rates ORDER BY base, quote
+	`)
+	if err != nil {
+		s.logger.Error("Error fetching fx rates", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := []*FXRate{}
 	for rows.Next() {
-		var userID int
-		var username string
-		var accountID int
-		var accountFirstName, accountLastName, accountHobby string
-		var accountAge int
-		var accountAccount int64
-		var accountBalance float64
+		rate := &FXRate{}
+		if err := rows.Scan(&rate.Base, &rate.Quote, &rate.Rate, &rate.Source, &rate.UpdatedBy, &rate.UpdatedAt); err != nil {
+			s.logger.Error("Error scanning fx rate", "error", err)
+			return nil, err
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
 
-		err := rows.Scan(
-			&userID,
-			&username,
-			&accountID,
-			&accountFirstName,
-			&accountLastName,
-			&accountHobby,
-			&accountAge,
-			&accountAccount,
-			&accountBalance,
-		)
+// setFXRates creates or replaces the given rates together. A rate replaces
+// any stored for the same pair the other way round, so each pair has one.
+func (s *PostgresStore) setFXRates(ctx context.Context, rates []*FXRate) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error("Error starting transaction", "error", err)
+		return err
+	}
+	defer tx.Rollback()
 
+	for _, rate := range rates {
+		_, err := tx.ExecContext(ctx, `DELETE FROM fx_rates WHERE base = $1 AND quote = $2`, rate.Quote, rate.Base)
 		if err != nil {
-			log.Printf("Error scanning row: %v", err)
-			return user, err
+			s.logger.Error("Error replacing fx rate", "error", err)
+			return err
 		}
 
-		// Check if the user is already in the map, if not, create a new user
-		if _, ok := userAccountsMap[userID]; !ok {
-			user = getUserDetailsRequest{
-				ID:       userID,
-				Username: username,
-			}
-			userAccountsMap[userID] = user
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO fx_rates (base, quote, rate, source, updated_by)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (base, quote) DO UPDATE SET
+				rate = EXCLUDED.rate,
+				source = EXCLUDED.source,
+				updated_by = EXCLUDED.updated_by,
+				updated_at = CURRENT_TIMESTAMP
+			RETURNING updated_at
+		`, rate.Base, rate.Quote, rate.Rate, rate.Source, rate.UpdatedBy).Scan(&rate.UpdatedAt)
+		if err != nil {
+			s.logger.Error("Error saving fx rate", "error", err)
+			return err
 		}
+	}
 
-		// Create a temporary user variable to update the Accounts field
-		tempUser := userAccountsMap[userID]
+	if err := tx.Commit(); err != nil {
+		s.logger.Error("Error committing transaction", "error", err)
+		return err
+	}
+	return nil
+}
 
-		// If there is an associated account, add it to the user's accounts slice
-		if accountID != 0 {
-			account := AccountsRequest{
-				ID:         accountID,
-				FIRST_NAME: accountFirstName,
-				LAST_NAME:  accountLastName,
-				HOBBY:      accountHobby,
-				AGE:        accountAge,
-				ACCOUNT:    accountAccount,
-				BALANCE:    accountBalance,
-			}
-			tempUser.Accounts = append(tempUser.Accounts, account)
-		}
+// fxMidRate returns how many units of to one unit of from buys, using the
+// stored rate for the pair in either direction.
+func (s *PostgresStore) fxMidRate(ctx context.Context, from, to string) (float64, error) {
+	var rate float64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT CASE WHEN base = $1 THEN rate ELSE 1 / rate END
+		FROM fx_rates
+		WHERE (base = $1 AND quote = $2) OR (base = $2 AND quote = $1)
+	`, from, to).Scan(&rate)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("fx rate not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fx rate", "error", err)
+		return 0, err
+	}
+	return rate, nil
+}
 
-		// Update the user in the map with the temporary user
-		userAccountsMap[userID] = tempUser
+// createFXQuote prices quote at the current rate less the configured
+// spread and holds it for the quote TTL. Only currencies with a position
+// account can be converted.
+func (s *PostgresStore) createFXQuote(ctx context.Context, quote *FXQuote) error {
+	if s.fx.positionAccount(quote.FromCurrency) == 0 || s.fx.positionAccount(quote.ToCurrency) == 0 {
+		return fmt.Errorf("currency conversion is not available")
 	}
 
-	// Check if the user exists, and return it along with associated accounts
-	if user, ok := userAccountsMap[id]; ok {
-		return user, nil
+	mid, err := s.fxMidRate(ctx, quote.FromCurrency, quote.ToCurrency)
+	if err != nil {
+		return err
+	}
+	quote.MidRate = roundRate(mid)
+	quote.Spread = s.fx.spread(quote.FromCurrency, quote.ToCurrency)
+	quote.Rate = roundRate(mid * (1 - quote.Spread))
+	quote.ConvertedAmount = roundMinor(quote.Amount*quote.Rate, quote.ToCurrency)
+	if quote.ConvertedAmount <= 0 {
+		return fmt.Errorf("converted amount is too small")
 	}
 
-	return user, fmt.Errorf("User not found")
+	query := `
+		INSERT INTO fx_quotes (user_id, from_currency, to_currency, amount, mid_rate, spread, rate, converted_amount, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP + $9 * INTERVAL '1 second')
+		RETURNING ` + fxQuoteColumns
+
+	inserted, err := scanFXQuote(s.db.QueryRowContext(ctx, query,
+		quote.UserID,
+		quote.FromCurrency,
+		quote.ToCurrency,
+		quote.Amount,
+		quote.MidRate,
+		quote.Spread,
+		quote.Rate,
+		quote.ConvertedAmount,
+		s.fx.QuoteTTL.Seconds(),
+	))
+	if err != nil {
+		s.logger.Error("Error creating fx quote", "error", err)
+		return err
+	}
+	*quote = *inserted
+	return nil
 }
 
-func (s *PostgresStore) authenticateUser(username, password string) (*User, error) {
-	user, err := s.getUserByUsername(username)
+const fxQuoteColumns = `
+	id, user_id, from_currency, to_currency, amount, mid_rate, spread, rate,
+	converted_amount, expires_at, used_at, created_at
+`
+
+func scanFXQuote(row interface{ Scan(...interface{}) error }) (*FXQuote, error) {
+	quote := &FXQuote{}
+	err := row.Scan(
+		&quote.ID,
+		&quote.UserID,
+		&quote.FromCurrency,
+		&quote.ToCurrency,
+		&quote.Amount,
+		&quote.MidRate,
+		&quote.Spread,
+		&quote.Rate,
+		&quote.ConvertedAmount,
+		&quote.ExpiresAt,
+		&quote.UsedAt,
+		&quote.CreatedAt,
+	)
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, nil // User not found
+	return quote, nil
+}
+
+// useFXQuote locks one of the user's quotes and marks it used in tx, so a
+// rolled back transfer leaves the quote available.
+func (s *PostgresStore) useFXQuote(ctx context.Context, tx *sql.Tx, id, userID int) (*FXQuote, error) {
+	quote, err := scanFXQuote(tx.QueryRowContext(ctx, `
+		SELECT `+fxQuoteColumns+` FROM fx_quotes WHERE id = $1 AND user_id = $2 FOR UPDATE
+	`, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("fx quote not found")
+	}
+	if err != nil {
+		s.logger.Error("Error fetching fx quote", "error", err)
+		return nil, err
+	}
+	if quote.UsedAt != nil {
+		return nil, fmt.Errorf("fx quote already used")
 	}
 
-	// Compare the hashed password with the provided password
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	err = tx.QueryRowContext(ctx, `
+		UPDATE fx_quotes SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND expires_at > CURRENT_TIMESTAMP RETURNING used_at
+	`, id).Scan(&quote.UsedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("fx quote has expired")
+	}
 	if err != nil {
-		// Return a custom error message here
-		return nil, fmt.Errorf("invalid password") //password don't match
+		s.logger.Error("Error using fx quote", "error", err)
+		return nil, err
+	}
+	return quote, nil
+}
+
+// postFXPositions books a conversion through the bank's position accounts:
+// the one in the currency sold takes in the customer's money and the one in
+// the currency bought pays out the converted amount. transfer has already
+// locked both position accounts.
+func (s *PostgresStore) postFXPositions(ctx context.Context, tx *sql.Tx, quote *FXQuote, fromAccountNumber, toAccountNumber int64) error {
+	legs := []struct {
+		account      int64
+		currency     string
+		amount       float64
+		counterparty int64
+	}{
+		{s.fx.positionAccount(quote.FromCurrency), quote.FromCurrency, quote.Amount, fromAccountNumber},
+		{s.fx.positionAccount(quote.ToCurrency), quote.ToCurrency, -quote.ConvertedAmount, toAccountNumber},
 	}
 
-	return user, nil
+	description := fmt.Sprintf("FX conversion %s to %s", quote.FromCurrency, quote.ToCurrency)
+	for _, leg := range legs {
+		var id int
+		var balance float64
+		err := tx.QueryRowContext(ctx, `
+			UPDATE accounts SET balance = balance + $1, updated_at = CURRENT_TIMESTAMP
+			WHERE account_number = $2 AND currency = $3 AND deleted_at IS NULL RETURNING id, balance
+		`, leg.amount, leg.account, leg.currency).Scan(&id, &balance)
+		if err == sql.ErrNoRows {
+			s.logger.Error("FX position account does not exist", "account_number", leg.account, "currency", leg.currency)
+			return fmt.Errorf("fx position account not found")
+		}
+		if err != nil {
+			s.logger.Error("Error updating fx position", "error", err)
+			return err
+		}
+		if err := s.postLedgerEntry(ctx, tx, id, EntryFXConversion, leg.amount, balance, leg.counterparty, description); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in certFile/keyFile and picks up
+// replacements without a restart, so rotated certificates take effect on
+// the next handshake.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(logger *slog.Logger, certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parsing TLS certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// notAfter returns the expiry of the certificate being served.
+func (r *certReloader) notAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert.Leaf.NotAfter
+}
+
+// watch reloads the certificate whenever its files change, checking every
+// interval until ctx is cancelled. A broken replacement is logged and the
+// previous certificate stays in use.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		modTime, err := r.latestModTime()
+		if err != nil {
+			r.logger.Error("Error checking TLS certificate files", "error", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			r.logger.Error("Error reloading TLS certificate, keeping the previous one", "error", err)
+			continue
+		}
+		r.logger.Info("Reloaded TLS certificate", "not_after", r.notAfter())
+	}
+}
+
+// newServerTLSConfig builds the listener's TLS configuration. When a client
+// CA is configured, client certificates signed by it are verified and
+// callers presenting one are authenticated as service identities.
+func newServerTLSConfig(cfg TLSConfig, certs *certReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", cfg.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+type serviceIdentityKey struct{}
+
+// serviceIdentity is an internal caller authenticated by its client
+// certificate rather than a user token.
+type serviceIdentity struct {
+	Name string
+	Role string
+}
+
+func serviceIdentityFromContext(ctx context.Context) (serviceIdentity, bool) {
+	id, ok := ctx.Value(serviceIdentityKey{}).(serviceIdentity)
+	return id, ok
+}
+
+// withClientIdentity maps a verified client certificate's common name to a
+// service identity using server.tls.client_roles. Verified certificates
+// with an unmapped name carry no privileges.
+func (s *APIServer) withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		role, ok := s.config.Server.TLS.ClientRoles[name]
+		if !ok {
+			s.logger.Warn("Client certificate has no configured role", "client", name)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), serviceIdentityKey{}, serviceIdentity{Name: name, Role: role})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *APIServer) checkTLSCertificate(context.Context) (string, error) {
+	notAfter := s.certs.notAfter()
+	if time.Now().After(notAfter) {
+		return "", fmt.Errorf("TLS certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+	return "TLS certificate valid until " + notAfter.Format(time.RFC3339), nil
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("gobank")
+
+// setupTracing installs the global tracer provider and W3C trace-context
+// propagator. exporter is "otlp" (OTLP over HTTP, configured through the
+// standard OTEL_EXPORTER_OTLP_* variables), "stdout" or "none". The
+// returned function flushes and stops the provider.
+func setupTracing(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("gobank"),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// withTracing continues the caller's trace from the traceparent header, if
+// any, and wraps the request in a server span named after its route.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := routeTemplate(r)
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// tracedStorage wraps a Storage and records a span, parented to the
+// caller's span, around every call. The span's context is passed down so
+// that SQL spans nest under it.
+type tracedStorage struct {
+	Storage
+}
+
+func newTracedStorage(store Storage) *tracedStorage {
+	return &tracedStorage{Storage: store}
+}
+
+func (t *tracedStorage) trace(ctx context.Context, method string, f func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "Storage."+method, trace.WithAttributes(attribute.String("storage.method", method)))
+	defer span.End()
+
+	err := f(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+func traced[T any](ctx context.Context, t *tracedStorage, method string, f func(context.Context) (T, error)) (T, error) {
+	var result T
+	err := t.trace(ctx, method, func(ctx context.Context) error {
+		var err error
+		result, err = f(ctx)
+		return err
+	})
+	return result, err
+}
+
+func (t *tracedStorage) createAccount(ctx context.Context, account *Account) error {
+	return t.trace(ctx, "createAccount", func(ctx context.Context) error { return t.Storage.createAccount(ctx, account) })
+}
+
+func (t *tracedStorage) updateAccount(ctx context.Context, account *Account) error {
+	return t.trace(ctx, "updateAccount", func(ctx context.Context) error { return t.Storage.updateAccount(ctx, account) })
+}
+
+func (t *tracedStorage) getAccountById(ctx context.Context, id int) (*Account, error) {
+	return traced(ctx, t, "getAccountById", func(ctx context.Context) (*Account, error) { return t.Storage.getAccountById(ctx, id) })
+}
+
+func (t *tracedStorage) getAccountByNumber(ctx context.Context, accountNumber int64) (*Account, error) {
+	return traced(ctx, t, "getAccountByNumber", func(ctx context.Context) (*Account, error) {
+		return t.Storage.getAccountByNumber(ctx, accountNumber)
+	})
+}
+
+func (t *tracedStorage) getAccountByIBAN(ctx context.Context, iban string) (*Account, error) {
+	return traced(ctx, t, "getAccountByIBAN", func(ctx context.Context) (*Account, error) { return t.Storage.getAccountByIBAN(ctx, iban) })
+}
+
+func (t *tracedStorage) allAccounts(ctx context.Context, batchSize int) ([]*Account, error) {
+	return traced(ctx, t, "allAccounts", func(ctx context.Context) ([]*Account, error) { return t.Storage.allAccounts(ctx, batchSize) })
+}
+
+func (t *tracedStorage) transferBalance(ctx context.Context, from, to int64, amount float64) error {
+	return t.trace(ctx, "transferBalance", func(ctx context.Context) error { return t.Storage.transferBalance(ctx, from, to, amount) })
+}
+
+func (t *tracedStorage) getUserByUsername(ctx context.Context, username string) (*User, error) {
+	return traced(ctx, t, "getUserByUsername", func(ctx context.Context) (*User, error) { return t.Storage.getUserByUsername(ctx, username) })
+}
+
+func (t *tracedStorage) createUser(ctx context.Context, user *User) error {
+	return t.trace(ctx, "createUser", func(ctx context.Context) error { return t.Storage.createUser(ctx, user) })
+}
+
+func (t *tracedStorage) authenticateUser(ctx context.Context, username, password string) (*User, error) {
+	return traced(ctx, t, "authenticateUser", func(ctx context.Context) (*User, error) { return t.Storage.authenticateUser(ctx, username, password) })
+}
+
+func (t *tracedStorage) getUserDetails(ctx context.Context, id int) (getUserDetailsRequest, error) {
+	return traced(ctx, t, "getUserDetails", func(ctx context.Context) (getUserDetailsRequest, error) { return t.Storage.getUserDetails(ctx, id) })
+}
+
+func (t *tracedStorage) createProfile(ctx context.Context, profile *CustomerProfile) error {
+	return t.trace(ctx, "createProfile", func(ctx context.Context) error { return t.Storage.createProfile(ctx, profile) })
+}
+
+func (t *tracedStorage) getProfileByUserId(ctx context.Context, userID int) (*CustomerProfile, error) {
+	return traced(ctx, t, "getProfileByUserId", func(ctx context.Context) (*CustomerProfile, error) { return t.Storage.getProfileByUserId(ctx, userID) })
+}
+
+func (t *tracedStorage) updateProfile(ctx context.Context, profile *CustomerProfile, changedBy int) error {
+	return t.trace(ctx, "updateProfile", func(ctx context.Context) error { return t.Storage.updateProfile(ctx, profile, changedBy) })
+}
+
+func (t *tracedStorage) getProfileHistory(ctx context.Context, profileID int) ([]*ProfileHistoryEntry, error) {
+	return traced(ctx, t, "getProfileHistory", func(ctx context.Context) ([]*ProfileHistoryEntry, error) {
+		return t.Storage.getProfileHistory(ctx, profileID)
+	})
+}
+
+func (t *tracedStorage) getUserById(ctx context.Context, id int) (*User, error) {
+	return traced(ctx, t, "getUserById", func(ctx context.Context) (*User, error) { return t.Storage.getUserById(ctx, id) })
+}
+
+func (t *tracedStorage) changeAccountStatus(ctx context.Context, accountID int, status, reason, changedBy string) error {
+	return t.trace(ctx, "changeAccountStatus", func(ctx context.Context) error {
+		return t.Storage.changeAccountStatus(ctx, accountID, status, reason, changedBy)
+	})
+}
+
+func (t *tracedStorage) getPendingAccountIDs(ctx context.Context) ([]int, error) {
+	return traced(ctx, t, "getPendingAccountIDs", func(ctx context.Context) ([]int, error) {
+		return t.Storage.getPendingAccountIDs(ctx)
+	})
+}
+
+func (t *tracedStorage) getAccountStatusHistory(ctx context.Context, accountID int) ([]*AccountStatusChange, error) {
+	return traced(ctx, t, "getAccountStatusHistory", func(ctx context.Context) ([]*AccountStatusChange, error) {
+		return t.Storage.getAccountStatusHistory(ctx, accountID)
+	})
+}
+
+func (t *tracedStorage) getStatement(ctx context.Context, accountID int) (*Statement, error) {
+	return traced(ctx, t, "getStatement", func(ctx context.Context) (*Statement, error) { return t.Storage.getStatement(ctx, accountID) })
+}
+
+func (t *tracedStorage) softDeleteUser(ctx context.Context, id int) error {
+	return t.trace(ctx, "softDeleteUser", func(ctx context.Context) error { return t.Storage.softDeleteUser(ctx, id) })
+}
+
+func (t *tracedStorage) softDeleteAccount(ctx context.Context, id int) error {
+	return t.trace(ctx, "softDeleteAccount", func(ctx context.Context) error { return t.Storage.softDeleteAccount(ctx, id) })
+}
+
+func (t *tracedStorage) listDeleted(ctx context.Context) (*DeletedRecords, error) {
+	return traced(ctx, t, "listDeleted", func(ctx context.Context) (*DeletedRecords, error) { return t.Storage.listDeleted(ctx) })
+}
+
+func (t *tracedStorage) restoreUser(ctx context.Context, id int) error {
+	return t.trace(ctx, "restoreUser", func(ctx context.Context) error { return t.Storage.restoreUser(ctx, id) })
+}
+
+func (t *tracedStorage) restoreAccount(ctx context.Context, id int) error {
+	return t.trace(ctx, "restoreAccount", func(ctx context.Context) error { return t.Storage.restoreAccount(ctx, id) })
+}
+
+func (t *tracedStorage) purgeDeleted(ctx context.Context) (*PurgeResult, error) {
+	return traced(ctx, t, "purgeDeleted", func(ctx context.Context) (*PurgeResult, error) { return t.Storage.purgeDeleted(ctx) })
+}
+
+func (t *tracedStorage) appendAudit(ctx context.Context, event *AuditEvent) error {
+	return t.trace(ctx, "appendAudit", func(ctx context.Context) error { return t.Storage.appendAudit(ctx, event) })
+}
+
+func (t *tracedStorage) queryAudit(ctx context.Context, filter AuditFilter) ([]*AuditEvent, error) {
+	return traced(ctx, t, "queryAudit", func(ctx context.Context) ([]*AuditEvent, error) { return t.Storage.queryAudit(ctx, filter) })
+}
+
+func (t *tracedStorage) verifyAuditChain(ctx context.Context) (*AuditVerification, error) {
+	return traced(ctx, t, "verifyAuditChain", func(ctx context.Context) (*AuditVerification, error) { return t.Storage.verifyAuditChain(ctx) })
+}
+
+func (t *tracedStorage) getTransferLimitStatus(ctx context.Context, accountID int) (*TransferLimitStatus, error) {
+	return traced(ctx, t, "getTransferLimitStatus", func(ctx context.Context) (*TransferLimitStatus, error) {
+		return t.Storage.getTransferLimitStatus(ctx, accountID)
+	})
+}
+
+func (t *tracedStorage) getTransferLimitOverride(ctx context.Context, userID int) (*TransferLimitOverride, error) {
+	return traced(ctx, t, "getTransferLimitOverride", func(ctx context.Context) (*TransferLimitOverride, error) {
+		return t.Storage.getTransferLimitOverride(ctx, userID)
+	})
+}
+
+func (t *tracedStorage) setTransferLimitOverride(ctx context.Context, override *TransferLimitOverride) error {
+	return t.trace(ctx, "setTransferLimitOverride", func(ctx context.Context) error { return t.Storage.setTransferLimitOverride(ctx, override) })
+}
+
+func (t *tracedStorage) deleteTransferLimitOverride(ctx context.Context, userID int) error {
+	return t.trace(ctx, "deleteTransferLimitOverride", func(ctx context.Context) error { return t.Storage.deleteTransferLimitOverride(ctx, userID) })
+}
+
+func (t *tracedStorage) setOverdraftLimit(ctx context.Context, accountID int, limit float64) error {
+	return t.trace(ctx, "setOverdraftLimit", func(ctx context.Context) error { return t.Storage.setOverdraftLimit(ctx, accountID, limit) })
+}
+
+func (t *tracedStorage) chargeOverdrafts(ctx context.Context) (*OverdraftRun, error) {
+	return traced(ctx, t, "chargeOverdrafts", func(ctx context.Context) (*OverdraftRun, error) { return t.Storage.chargeOverdrafts(ctx) })
+}
+
+func (t *tracedStorage) placeHold(ctx context.Context, hold *Hold) error {
+	return t.trace(ctx, "placeHold", func(ctx context.Context) error { return t.Storage.placeHold(ctx, hold) })
+}
+
+func (t *tracedStorage) getHold(ctx context.Context, id int) (*Hold, error) {
+	return traced(ctx, t, "getHold", func(ctx context.Context) (*Hold, error) { return t.Storage.getHold(ctx, id) })
+}
+
+func (t *tracedStorage) listHolds(ctx context.Context, accountID int) ([]*Hold, error) {
+	return traced(ctx, t, "listHolds", func(ctx context.Context) ([]*Hold, error) { return t.Storage.listHolds(ctx, accountID) })
+}
+
+func (t *tracedStorage) captureHold(ctx context.Context, id int, amount float64) error {
+	return t.trace(ctx, "captureHold", func(ctx context.Context) error { return t.Storage.captureHold(ctx, id, amount) })
+}
+
+func (t *tracedStorage) releaseHold(ctx context.Context, id int) error {
+	return t.trace(ctx, "releaseHold", func(ctx context.Context) error { return t.Storage.releaseHold(ctx, id) })
+}
+
+func (t *tracedStorage) expireHolds(ctx context.Context) (int64, error) {
+	return traced(ctx, t, "expireHolds", func(ctx context.Context) (int64, error) { return t.Storage.expireHolds(ctx) })
+}
+
+func (t *tracedStorage) createScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	return t.trace(ctx, "createScheduledTransfer", func(ctx context.Context) error { return t.Storage.createScheduledTransfer(ctx, transfer) })
+}
+
+func (t *tracedStorage) getScheduledTransfer(ctx context.Context, id int) (*ScheduledTransfer, error) {
+	return traced(ctx, t, "getScheduledTransfer", func(ctx context.Context) (*ScheduledTransfer, error) {
+		return t.Storage.getScheduledTransfer(ctx, id)
+	})
+}
+
+func (t *tracedStorage) listScheduledTransfers(ctx context.Context, userID int) ([]*ScheduledTransfer, error) {
+	return traced(ctx, t, "listScheduledTransfers", func(ctx context.Context) ([]*ScheduledTransfer, error) {
+		return t.Storage.listScheduledTransfers(ctx, userID)
+	})
+}
+
+func (t *tracedStorage) cancelScheduledTransfer(ctx context.Context, id, userID int) error {
+	return t.trace(ctx, "cancelScheduledTransfer", func(ctx context.Context) error { return t.Storage.cancelScheduledTransfer(ctx, id, userID) })
+}
+
+func (t *tracedStorage) claimDueTransfers(ctx context.Context, limit int) ([]*ScheduledTransfer, error) {
+	return traced(ctx, t, "claimDueTransfers", func(ctx context.Context) ([]*ScheduledTransfer, error) {
+		return t.Storage.claimDueTransfers(ctx, limit)
+	})
+}
+
+func (t *tracedStorage) finishScheduledTransfer(ctx context.Context, transfer *ScheduledTransfer) error {
+	return t.trace(ctx, "finishScheduledTransfer", func(ctx context.Context) error { return t.Storage.finishScheduledTransfer(ctx, transfer) })
+}
+
+func (t *tracedStorage) createStandingOrder(ctx context.Context, order *StandingOrder) error {
+	return t.trace(ctx, "createStandingOrder", func(ctx context.Context) error { return t.Storage.createStandingOrder(ctx, order) })
+}
+
+func (t *tracedStorage) getStandingOrder(ctx context.Context, id int) (*StandingOrder, error) {
+	return traced(ctx, t, "getStandingOrder", func(ctx context.Context) (*StandingOrder, error) { return t.Storage.getStandingOrder(ctx, id) })
+}
+
+func (t *tracedStorage) listStandingOrders(ctx context.Context, userID int) ([]*StandingOrder, error) {
+	return traced(ctx, t, "listStandingOrders", func(ctx context.Context) ([]*StandingOrder, error) {
+		return t.Storage.listStandingOrders(ctx, userID)
+	})
+}
+
+func (t *tracedStorage) changeStandingOrder(ctx context.Context, id int, action string) error {
+	return t.trace(ctx, "changeStandingOrder", func(ctx context.Context) error { return t.Storage.changeStandingOrder(ctx, id, action) })
+}
+
+func (t *tracedStorage) getStandingOrderHistory(ctx context.Context, id int) ([]*ScheduledTransfer, error) {
+	return traced(ctx, t, "getStandingOrderHistory", func(ctx context.Context) ([]*ScheduledTransfer, error) {
+		return t.Storage.getStandingOrderHistory(ctx, id)
+	})
+}
+
+func (t *tracedStorage) generateStandingOrderTransfers(ctx context.Context, today time.Time) (int, error) {
+	return traced(ctx, t, "generateStandingOrderTransfers", func(ctx context.Context) (int, error) {
+		return t.Storage.generateStandingOrderTransfers(ctx, today)
+	})
+}
+
+func (t *tracedStorage) createNotification(ctx context.Context, notification *Notification) error {
+	return t.trace(ctx, "createNotification", func(ctx context.Context) error { return t.Storage.createNotification(ctx, notification) })
+}
+
+func (t *tracedStorage) listNotifications(ctx context.Context, userID int, unreadOnly bool) ([]*Notification, error) {
+	return traced(ctx, t, "listNotifications", func(ctx context.Context) ([]*Notification, error) {
+		return t.Storage.listNotifications(ctx, userID, unreadOnly)
+	})
+}
+
+func (t *tracedStorage) markNotificationRead(ctx context.Context, id, userID int) error {
+	return t.trace(ctx, "markNotificationRead", func(ctx context.Context) error { return t.Storage.markNotificationRead(ctx, id, userID) })
+}
+
+func (t *tracedStorage) createInterestProduct(ctx context.Context, product *InterestProduct) error {
+	return t.trace(ctx, "createInterestProduct", func(ctx context.Context) error { return t.Storage.createInterestProduct(ctx, product) })
+}
+
+func (t *tracedStorage) listInterestProducts(ctx context.Context) ([]*InterestProduct, error) {
+	return traced(ctx, t, "listInterestProducts", func(ctx context.Context) ([]*InterestProduct, error) {
+		return t.Storage.listInterestProducts(ctx)
+	})
+}
+
+func (t *tracedStorage) setAccountInterestProduct(ctx context.Context, accountID, productID int) error {
+	return t.trace(ctx, "setAccountInterestProduct", func(ctx context.Context) error {
+		return t.Storage.setAccountInterestProduct(ctx, accountID, productID)
+	})
+}
+
+func (t *tracedStorage) getInterestSummary(ctx context.Context, accountID int) (*InterestSummary, error) {
+	return traced(ctx, t, "getInterestSummary", func(ctx context.Context) (*InterestSummary, error) {
+		return t.Storage.getInterestSummary(ctx, accountID)
+	})
+}
+
+func (t *tracedStorage) runInterest(ctx context.Context, date time.Time) (*InterestRun, error) {
+	return traced(ctx, t, "runInterest", func(ctx context.Context) (*InterestRun, error) { return t.Storage.runInterest(ctx, date) })
+}
+
+func (t *tracedStorage) listFeeRules(ctx context.Context) ([]*FeeRule, error) {
+	return traced(ctx, t, "listFeeRules", func(ctx context.Context) ([]*FeeRule, error) { return t.Storage.listFeeRules(ctx) })
+}
+
+func (t *tracedStorage) setFeeRule(ctx context.Context, rule *FeeRule) error {
+	return t.trace(ctx, "setFeeRule", func(ctx context.Context) error { return t.Storage.setFeeRule(ctx, rule) })
+}
+
+func (t *tracedStorage) deleteFeeRule(ctx context.Context, accountType, event string) error {
+	return t.trace(ctx, "deleteFeeRule", func(ctx context.Context) error { return t.Storage.deleteFeeRule(ctx, accountType, event) })
+}
+
+func (t *tracedStorage) listFees(ctx context.Context, accountID int) ([]*FeeCharge, error) {
+	return traced(ctx, t, "listFees", func(ctx context.Context) ([]*FeeCharge, error) { return t.Storage.listFees(ctx, accountID) })
+}
+
+func (t *tracedStorage) getFee(ctx context.Context, id int) (*FeeCharge, error) {
+	return traced(ctx, t, "getFee", func(ctx context.Context) (*FeeCharge, error) { return t.Storage.getFee(ctx, id) })
+}
+
+func (t *tracedStorage) waiveFee(ctx context.Context, id int, waivedBy, reason string) error {
+	return t.trace(ctx, "waiveFee", func(ctx context.Context) error { return t.Storage.waiveFee(ctx, id, waivedBy, reason) })
+}
+
+func (t *tracedStorage) listFXRates(ctx context.Context) ([]*FXRate, error) {
+	return traced(ctx, t, "listFXRates", func(ctx context.Context) ([]*FXRate, error) { return t.Storage.listFXRates(ctx) })
+}
+
+func (t *tracedStorage) setFXRates(ctx context.Context, rates []*FXRate) error {
+	return t.trace(ctx, "setFXRates", func(ctx context.Context) error { return t.Storage.setFXRates(ctx, rates) })
+}
+
+func (t *tracedStorage) createFXQuote(ctx context.Context, quote *FXQuote) error {
+	return t.trace(ctx, "createFXQuote", func(ctx context.Context) error { return t.Storage.createFXQuote(ctx, quote) })
+}
+
+func (t *tracedStorage) convertBalance(ctx context.Context, from, to int64, amount float64, quoteID int) error {
+	return t.trace(ctx, "convertBalance", func(ctx context.Context) error { return t.Storage.convertBalance(ctx, from, to, amount, quoteID) })
+}
+
+func (t *tracedStorage) chargeMaintenanceFees(ctx context.Context, period time.Time) (*FeeRun, error) {
+	return traced(ctx, t, "chargeMaintenanceFees", func(ctx context.Context) (*FeeRun, error) {
+		return t.Storage.chargeMaintenanceFees(ctx, period)
+	})
+}
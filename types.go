@@ -1,67 +1,99 @@
 package main
 
 import (
-	"math/rand"
 	"time"
 
 	_ "github.com/google/uuid"
 )
 
+// Account types. Transfer limits default per type; savings accounts share
+// the personal limits. Only savings accounts earn interest.
+const (
+	AccountTypePersonal = "personal"
+	AccountTypeBusiness = "business"
+	AccountTypeSavings  = "savings"
+)
+
 type createAccountRequest struct {
-	FIRST_NAME string  `json:"firstName"`
-	LAST_NAME  string  `json:"lastName"`
-	HOBBY      string  `json:"hobby"`
-	AGE        int     `json:"age"`
-	BALANCE    float64 `json:"balance"`
-	UserID     int     `json:"user_id"`
+	BALANCE float64 `json:"balance"`
+	UserID  int     `json:"user_id"`
+	Type    string  `json:"account_type"`
+	// Currency is an ISO 4217 code; it defaults to currency.default.
+	Currency string `json:"currency"`
 }
 
 type AccountsRequest struct {
-	ID         int     `json:"id"`
-	FIRST_NAME string  `json:"firstName"`
-	LAST_NAME  string  `json:"lastName"`
-	HOBBY      string  `json:"hobby"`
-	AGE        int     `json:"age"`
-	ACCOUNT    int64   `json:"account"`
-	BALANCE    float64 `json:"balance"`
+	ID       int     `json:"id"`
+	ACCOUNT  int64   `json:"account"`
+	IBAN     string  `json:"iban"`
+	Currency string  `json:"currency"`
+	BALANCE  float64 `json:"balance"`
+	Status   string  `json:"status"`
 }
 
+// getUserDetailsRequest lists the user's accounts oldest first. Balances
+// totals them per currency.
 type getUserDetailsRequest struct {
-	ID       int               `json:"id"`
-	Username string            `json:"username"`
-	Accounts []AccountsRequest `json:"accounts"`
+	ID       int                `json:"id"`
+	Username string             `json:"username"`
+	Profile  *CustomerProfile   `json:"profile,omitempty"`
+	Accounts []AccountsRequest  `json:"accounts"`
+	Balances map[string]float64 `json:"balances"`
+}
+
+// sourceAccount picks the account a payment is made from: the one numbered
+// accountNumber, or the user's oldest account if that is zero.
+func (u getUserDetailsRequest) sourceAccount(accountNumber int64) (AccountsRequest, bool) {
+	for _, account := range u.Accounts {
+		if accountNumber == 0 || account.ACCOUNT == accountNumber {
+			return account, true
+		}
+	}
+	return AccountsRequest{}, false
 }
 
+// Account holds banking data only; personal details live on the
+// CustomerProfile it references. BALANCE is the ledger balance, repeated as
+// LedgerBalance; AvailableBalance is that less any active holds.
+// OverdraftLimit is how far below zero the available balance may go.
+// InterestProductID is the rate card a savings account earns interest on.
+// Every amount on the account is in its Currency.
 type Account struct {
-	ID         int       `json:"id"`
-	UserID     int       `json:"user_id"`
-	FIRST_NAME string    `json:"firstName"`
-	LAST_NAME  string    `json:"lastName"`
-	HOBBY      string    `json:"hobby"`
-	AGE        int       `json:"age"`
-	ACCOUNT    int64     `json:"account"`
-	BALANCE    float64   `json:"balance"`
-	CREATED_AT time.Time `json:"created_at"`
-	UPDATED_AT time.Time `json:"updated_at"`
+	ID                int        `json:"id"`
+	UserID            int        `json:"user_id"`
+	ProfileID         int        `json:"profile_id"`
+	ACCOUNT           int64      `json:"account"`
+	BBAN              string     `json:"bban"`
+	IBAN              string     `json:"iban"`
+	Type              string     `json:"account_type"`
+	Currency          string     `json:"currency"`
+	BALANCE           float64    `json:"balance"`
+	LedgerBalance     float64    `json:"ledger_balance"`
+	AvailableBalance  float64    `json:"available_balance"`
+	OverdraftLimit    float64    `json:"overdraft_limit"`
+	InterestProductID *int       `json:"interest_product_id,omitempty"`
+	Status            string     `json:"status"`
+	CREATED_AT        time.Time  `json:"created_at"`
+	UPDATED_AT        time.Time  `json:"updated_at"`
+	DeletedAt         *time.Time `json:"deleted_at,omitempty"`
 }
 
-func newAccount(firstName, lastName, hobby string, age int, balance float64, userId int) *Account {
+// payeeAccount is what anyone but the owner sees when looking up an IBAN:
+// enough to confirm a transfer destination, nothing about its balance or
+// who holds it.
+type payeeAccount struct {
+	IBAN     string `json:"iban"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+}
+
+// newAccount leaves ACCOUNT unset; the store assigns a number from its
+// AccountNumberScheme so that collisions can be retried on insert.
+func newAccount(balance float64, userId, profileId int) *Account {
 	return &Account{
 		//ID:         rand.Intn(10000),
-		FIRST_NAME: firstName,
-		LAST_NAME:  lastName,
-		HOBBY:      hobby,
-		ACCOUNT:    generateUniqueAccountNumber(),
-		AGE:        age,
-		BALANCE:    balance,
-		UserID:     userId,
+		BALANCE:   balance,
+		UserID:    userId,
+		ProfileID: profileId,
 	}
 }
-
-func generateUniqueAccountNumber() int64 {
-	// Seed the random number generator with the current time
-	rand.Seed(time.Now().UnixNano())
-
-	// Generate a random int64 within the range of a bigint column
-	return rand.Int63n(9223372036854775807) // Max value for a signed 64-bit integer
-}